@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -10,171 +12,446 @@ import (
 	"strings"
 )
 
-func main() {
-	var genKey bool
-	flag.BoolVar(&genKey, "g", false, "Generate RSA key files")
-	var bits int
-	flag.IntVar(&bits, "b", 2048, "RSA key length, only valid for 1024, 2048, 4096")
-	var keyPath string
-	flag.StringVar(&keyPath, "p", "", "RSA key files directory path")
-
-	var encFile bool
-	flag.BoolVar(&encFile, "e", false, "Encrypt file")
-	var decFile bool
-	flag.BoolVar(&decFile, "d", false, "Decrypt file")
-	var fileName string
-	flag.StringVar(&fileName, "f", "", "Directory/file to encrypt/decrypt")
-	var keyFile string
-	flag.StringVar(&keyFile, "k", "", "RSA public/private file path")
-	var aesLen int
-	flag.IntVar(&aesLen, "l", 32, "AES key length for encrypt, only valid for 16, 24, 32")
-	var aesCpt string
-	flag.StringVar(&aesCpt, "t", "cfb", "AES cipher type for encrypt, only valid for cfb, ctr, ofb")
-
-	flag.Parse()
-	//	log.Println("bits:", bits)
-	//	log.Println("genKey:", genKey)
-	//	log.Println("encFile:", encFile)
-	//	log.Println("decFile:", decFile)
-	//	log.Println("fileName:", fileName)
-	//	log.Println("dirPath:", dirPath)
+// Repeatable string flag
+type listFlag []string
 
-	relFile, _ := exec.LookPath(os.Args[0])
-	selfName := filepath.Base(relFile)
-	absFile, _ := filepath.Abs(relFile)
-	absPath, _ := filepath.Abs(filepath.Dir(absFile))
-	//fmt.Println("selfName:", selfName)
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// What every subcommand gets
+type cmdEnv struct {
+	self string    // program name, for usage
+	cfg  *Config   // defaults for the flags
+	json bool      // set by -json
+	rp   *Reporter // -json output, created by parse
+}
+
+type command struct {
+	name  string
+	args  string // synopsis after the flags
+	short string
+	run   func(env *cmdEnv, cmd *command, args []string) error
+}
+
+var commands = []*command{
+	{"keygen", "", "Generate an RSA, X25519, Ed25519 or ECDSA key pair", runKeygen},
+	{"encrypt", "<file|directory>", "Encrypt a file or the files of a directory", runEncrypt},
+	{"decrypt", "<file|directory>", "Decrypt a file or the files of a directory", runDecrypt},
+	{"inspect", "<file|directory>...", "Show the headers of encrypted files", runInspect},
+	{"verify", "<file|directory>...", "Check that encrypted files decrypt to their checksum", runVerify},
+	{"rekey", "<file|directory>...", "Wrap the data keys of encrypted files for another public key", runRekey},
+	{"unwrap", "<file>", "Write the shares of a threshold-encrypted file's data key that your keys unwrap, for decrypt -part", runUnwrap},
+	{"rollback", "<directory>", "Roll back an interrupted in-place run of a directory", runRollback},
+	{"keyring", "list | add <alias> <key file> | remove <alias>", "Manage the keys in the keyring", runKeyring},
+	{"key", "fingerprint <key file>... | export <key file> | list [directory] | convert <key file> | split <key file> | combine <share file>...", "Show, export, convert and back up key files", runKey},
+	{"sign", "<file>", "Sign a file in the OpenSSH SSHSIG format, with a key file or ssh-agent", runSign},
+	{"checksig", "<file>", "Check the SSH signature of a file", runChecksig},
+	{"config", "", "Show the settings from config files and the environment", runConfig},
+}
 
-	var err error
-	if genKey == true {
-		if bits != 1024 && bits != 2048 && bits != 4096 && bits != 8192 {
-			log.Fatal("Error: -b only valid for 1024 2048 4096")
+// Invalid command line, reported with a pointer to the help
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, v ...interface{}) error {
+	return &usageError{fmt.Sprintf(format, v...)}
+}
+
+// Flag set of cmd with -json and its usage text
+func (env *cmdEnv) flagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.BoolVar(&env.json, "json", false, "Report one JSON record per file and a summary on stdout")
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s [flags] %s\n\n%s\n\nFlags:\n", env.self, cmd.name, cmd.args, cmd.short)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+var errParse = errors.New("invalid flags")
+
+func (env *cmdEnv) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
 		}
+		// already reported by fs
+		return errParse
+	}
+	if env.json {
+		env.rp = NewReporter(os.Stdout, fs.Name())
+	}
+	return nil
+}
 
-		if keyPath == "" {
-			keyPath = filepath.Join(absPath, "keys")
-		} else {
-			if !IsDirExist(keyPath) {
-				log.Fatal("Error: path ", keyPath, " isn't exist")
+// Read a key file, pointing at keygen if it is missing
+func (env *cmdEnv) readKey(keyFile string) ([]byte, error) {
+	if !IsFileExist(keyFile) {
+		return nil, errors.New("rsa key file " + keyFile + " isn't exist, simply generate RSA key: " + env.self + " keygen")
+	}
+	bKey := RsaReadKey(keyFile)
+	if bKey == nil {
+		return nil, errors.New("read key file " + keyFile + " failed")
+	}
+	return bKey, nil
+}
+
+// Public keys to encrypt for as one PEM bundle; names are key files,
+// keyring aliases, fingerprints or age1... X25519 keys, without names the configured recipients
+// or else public.pem in the key directory. A name without a path separator
+// is looked up in the keyring first
+func (env *cmdEnv) recipientKeys(names []string) ([]byte, error) {
+	if len(names) == 0 {
+		names = env.cfg.Recipients
+	}
+	if len(names) == 0 {
+		names = []string{filepath.Join(env.cfg.KeyDir, "public.pem")}
+	}
+
+	kr := OpenKeyring(env.cfg.Keyring)
+	var bundle []byte
+	for _, name := range names {
+		var bKey []byte
+		var err error
+		if strings.HasPrefix(name, VaultPrefix) {
+			var v *VaultTransit
+			if v, err = NewVaultTransit(name); err == nil {
+				bKey = v.PEM()
 			}
+		} else if strings.HasPrefix(name, SshAgentPrefix) {
+			bKey = SshAgentPEM(name)
+		} else if strings.HasPrefix(name, AgeRecipientHrp+"1") && !IsFileExist(name) {
+			bKey, err = AgeRecipientPEM(name)
+		} else if strings.ContainsAny(name, `/\`) {
+			bKey, err = env.readKey(name)
+		} else if bKey, err = kr.Recipient(name); err != nil && (IsFileExist(name) || !validAlias(name)) {
+			// an alias of the keyring goes before a file of the same name
+			// in the working directory, which needs "./" to be chosen
+			bKey, err = env.readKey(name)
 		}
-
-		log.Println("RSA key length", bits)
-		log.Println("Directory at", keyPath)
-		err = RsaGenKey(keyPath, bits)
 		if err != nil {
-			log.Println(err.Error())
-			log.Fatal("Error: generate RSA key failed")
-		}
-		log.Println("Generate RSA key OK")
-		log.Println("Please backup your RSA key files carefully")
-		log.Println("If RSA key files are lost, all encrypted files cannot be decrypted")
-	} else if encFile == true || decFile == true {
-		if keyFile == "" {
-			if encFile == true {
-				keyFile = filepath.Join(absPath, "keys", "public.pem")
-			} else {
-				keyFile = filepath.Join(absPath, "keys", "private.pem")
-			}
+			return nil, err
 		}
+		bundle = append(append(bundle, bKey...), '\n')
+	}
+	return bundle, nil
+}
 
-		if !IsFileExist(keyFile) {
-			log.Println("Error: rsa key file", keyFile, "isn't exist")
-			log.Fatal("Simply generate RSA key: ", selfName, " -g")
-		}
+// Private keys to decrypt with as one PEM bundle: keyFile alone if given,
+// else the keyring identities, the PKCS#11 key and the configured private
+// key or private.pem in the key directory
+func (env *cmdEnv) identityKeys(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return env.readKey(keyFile)
+	}
 
-		if !IsFileExist(fileName) && !IsDirExist(fileName) {
-			if encFile == true {
-				log.Fatal("Error: ", fileName, " to encrypt isn't exist")
-			} else {
-				log.Fatal("Error: ", fileName, " to decrypt isn't exist")
-			}
+	bundle, err := OpenKeyring(env.cfg.Keyring).Identities()
+	if err != nil {
+		return nil, err
+	}
+	// log in to the token now, rather than fail every file
+	if k := env.cfg.Pkcs11Key(); k != nil {
+		if _, err = OpenPkcs11Key(k); err != nil {
+			return nil, err
 		}
-
-		bKey := RsaReadKey(keyFile)
-		if bKey == nil {
-			log.Fatal("Error: read key file ", keyFile, " failed")
+		bundle = append(bundle, k.PEM()...)
+	}
+	keyFile = env.cfg.PrivateKey
+	if keyFile == "" {
+		keyFile = filepath.Join(env.cfg.KeyDir, "private.pem")
+	}
+	// with a Vault, ssh-agent or passphrase to ask, files for them need no
+	// local key
+	if IsFileExist(keyFile) || len(bundle) == 0 && os.Getenv("VAULT_ADDR") == "" && os.Getenv("SSH_AUTH_SOCK") == "" &&
+		os.Getenv("BITCRYPT_PASSPHRASE") == "" {
+		bKey, err := env.readKey(keyFile)
+		if err != nil {
+			return nil, err
 		}
+		bundle = append(bundle, bKey...)
+	}
+	return bundle, nil
+}
 
-		inPath := fileName
-		if aesLen != 16 && aesLen != 24 && aesLen != 32 {
-			aesLen = 32
+// Add the partial unwraps in the files parts to the keys from
+// identityKeys, which need not have found any if there are parts
+func (env *cmdEnv) withParts(bKey []byte, err error, keyFile string, parts []string) ([]byte, error) {
+	if err != nil && (keyFile != "" || len(parts) == 0) {
+		return nil, err
+	}
+	for _, part := range parts {
+		data, err := ioutil.ReadFile(part)
+		if err != nil {
+			return nil, err
 		}
-		if aesCpt != "cfb" && aesCpt != "ctr" && aesCpt != "ofb" {
-			aesCpt = "cfb"
+		if _, err = ParseShare(data); err != nil {
+			return nil, errors.New(part + ": " + err.Error())
 		}
+		bKey = append(append(bKey, '\n'), data...)
+	}
+	return bKey, nil
+}
 
-		isDirFlag := false
-		if encFile == true {
-			if IsDirExist(inPath) {
-				isDirFlag = true
-				err = EncryptDir(inPath, bKey, aesLen, aesCpt)
-			} else {
-				outPath := inPath + ".enc"
-				err = EncryptFile(inPath, outPath, bKey, aesLen, aesCpt)
-			}
+// Old style "-e -f path ..." command lines, mapped onto the subcommands
+func legacyArgs(args []string) []string {
+	modes := map[string]string{
+		"g":        "keygen",
+		"e":        "encrypt",
+		"d":        "decrypt",
+		"inspect":  "inspect",
+		"verify":   "verify",
+		"rollback": "rollback",
+	}
 
-			if err != nil {
-				log.Println(err.Error())
-				log.Fatal("Error: encrypt ", inPath, " failed")
-			} else {
-				if isDirFlag == true {
-					log.Println("Encrypt directory", inPath, "OK")
-				} else {
-					log.Println("Encrypt file", inPath, "OK")
-				}
-			}
+	name, path := "", ""
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimLeft(args[i], "-")
+		if !strings.HasPrefix(args[i], "-") {
+			rest = append(rest, args[i])
+		} else if mode, ok := modes[arg]; ok {
+			name = mode
+		} else if arg == "f" && i+1 < len(args) {
+			path = args[i+1]
+			i++
+		} else if strings.HasPrefix(arg, "f=") {
+			path = arg[2:]
 		} else {
-			if IsDirExist(inPath) {
-				isDirFlag = true
-				err = DecryptDir(inPath, bKey)
-			} else {
-				outPath := inPath
-				if strings.HasSuffix(outPath, ".enc") == true {
-					outPath = strings.TrimSuffix(outPath, ".enc")
-				}
-				err = DecryptFile(inPath, outPath, bKey)
-			}
+			rest = append(rest, args[i])
+		}
+	}
+	if name == "" {
+		return args
+	}
+
+	args = append([]string{name}, rest...)
+	if path != "" {
+		args = append(args, path)
+	}
+	return args
+}
+
+func main() {
+	relFile, _ := exec.LookPath(os.Args[0])
+	selfName := filepath.Base(relFile)
+	absFile, _ := filepath.Abs(relFile)
+	absPath, _ := filepath.Abs(filepath.Dir(absFile))
+	//fmt.Println("selfName:", selfName)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+	if cfg.Sources["key_dir"] == "" && !IsDirExist(cfg.KeyDir) && IsDirExist(filepath.Join(absPath, "keys")) {
+		// keys generated by older versions next to the program
+		cfg.KeyDir = filepath.Join(absPath, "keys")
+		cfg.Sources["key_dir"] = "next to " + selfName
+	}
+	AesWorkers = cfg.Workers
+
+	env := &cmdEnv{
+		self: selfName,
+		cfg:  cfg,
+	}
 
-			if err != nil {
-				log.Println(err.Error())
-				log.Fatal("Error: decrypt ", inPath, " failed")
-			} else {
-				if isDirFlag == true {
-					log.Println("Decrypt directory", inPath, "OK")
-				} else {
-					log.Println("Decrypt file", inPath, "OK")
+	args := os.Args[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		args = legacyArgs(args)
+	}
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		if len(args) > 1 {
+			for _, cmd := range commands {
+				if cmd.name == args[1] {
+					// the flags only exist once the command defines them
+					cmd.run(env, cmd, []string{"-h"})
+					return
 				}
 			}
 		}
-	} else {
-		flag.PrintDefaults()
-
-		fmt.Println("")
-		fmt.Println("")
-		fmt.Println("Example 1: generate RSA key files")
-		fmt.Println(selfName, "-g -b 2048")
-		fmt.Println(selfName, "-g -b 2048 -p some/directory")
-
-		fmt.Println("")
-		fmt.Println("Example 2: encrypt file")
-		fmt.Println(selfName, "-e -f some/file")
-		fmt.Println(selfName, "-e -f some/file -k some/directory/public.pem")
-
-		fmt.Println("")
-		fmt.Println("Example 3: decrypt file")
-		fmt.Println(selfName, "-d -f some/file")
-		fmt.Println(selfName, "-d -f some/file -k some/directory/private.pem")
-
-		fmt.Println("")
-		fmt.Println("Example 4: encrypt directory")
-		fmt.Println(selfName, "-e -f some/directory")
-		fmt.Println(selfName, "-e -f some/directory -k some/directory/public.pem")
-
-		fmt.Println("")
-		fmt.Println("Example 5: decrypt directory")
-		fmt.Println(selfName, "-d -f some/directory")
-		fmt.Println(selfName, "-d -f some/directory -k some/directory/private.pem")
-		fmt.Println("")
+		usage(selfName)
+		return
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if c.name == args[0] {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		log.Println("Error: unknown command", args[0])
+		log.Println("Run", selfName, "help for the commands")
+		os.Exit(2)
+	}
+
+	err = cmd.run(env, cmd, args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err == errParse {
+		os.Exit(2)
+	}
+	if env.rp != nil {
+		env.rp.Summary(err)
+	}
+	if err != nil {
+		log.Println("Error:", err.Error())
+		if _, ok := err.(*usageError); ok {
+			log.Println("Run", selfName, "help", cmd.name, "for its flags")
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+func usage(selfName string) {
+	fmt.Println("Usage:", selfName, "<command> [flags] [paths]")
+	fmt.Println("")
+	fmt.Println("Commands:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-9s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Println("")
+	fmt.Println("Run", selfName, "help <command> for the flags of a command")
+
+	fmt.Println("")
+	fmt.Println("")
+	fmt.Println("Example 1: generate RSA key files")
+	fmt.Println(selfName, "keygen -b 2048")
+	fmt.Println(selfName, "keygen -b 2048 -p some/directory")
+	fmt.Println(selfName, "keygen -type x25519 -p some/directory")
+
+	fmt.Println("")
+	fmt.Println("Example 2: encrypt file")
+	fmt.Println(selfName, "encrypt some/file")
+	fmt.Println(selfName, "encrypt -k some/directory/public.pem some/file")
+	fmt.Println(selfName, "encrypt -o other/directory some/file")
+	fmt.Println(selfName, "encrypt -rm -shred some/file")
+
+	fmt.Println("")
+	fmt.Println("Example 3: decrypt file")
+	fmt.Println(selfName, "decrypt some/file")
+	fmt.Println(selfName, "decrypt -k some/directory/private.pem some/file")
+
+	fmt.Println("")
+	fmt.Println("Example 4: encrypt directory")
+	fmt.Println(selfName, "encrypt some/directory")
+	fmt.Println(selfName, "encrypt -k some/directory/public.pem some/directory")
+
+	fmt.Println("")
+	fmt.Println("Example 5: decrypt directory")
+	fmt.Println(selfName, "decrypt some/directory")
+	fmt.Println(selfName, "decrypt -k some/directory/private.pem some/directory")
+	fmt.Println(selfName, "decrypt -o other/directory -force some/directory")
+
+	fmt.Println("")
+	fmt.Println("Example 6: list, then remove stale outputs of deleted source files")
+	fmt.Println(selfName, "encrypt -mirror -dry-run some/directory")
+	fmt.Println(selfName, "encrypt -mirror -trash some/directory")
+
+	fmt.Println("")
+	fmt.Println("Example 7: encrypt a directory without its build outputs, see also", IgnoreFileName)
+	fmt.Println(selfName, "encrypt -x build/ -x '*.o' some/directory")
+
+	fmt.Println("")
+	fmt.Println("Example 8: encrypt a directory in place, roll back if interrupted")
+	fmt.Println(selfName, "encrypt -inplace some/directory")
+	fmt.Println(selfName, "rollback some/directory")
+
+	fmt.Println("")
+	fmt.Println("Example 9: encrypt a directory, progress as JSON lines for another program")
+	fmt.Println(selfName, "encrypt -progress json some/directory 2>progress.log")
+
+	fmt.Println("")
+	fmt.Println("Example 10: check encrypted files, with a JSON record per file on stdout")
+	fmt.Println(selfName, "inspect some/directory_enc")
+	fmt.Println(selfName, "verify -k some/directory/private.pem -json some/directory_enc")
+
+	fmt.Println("")
+	fmt.Println("Example 11: let another key decrypt the files")
+	fmt.Println(selfName, "rekey -k old/private.pem -to new/public.pem some/directory_enc")
+
+	fmt.Println("")
+	fmt.Println("Example 12: keep a team's keys by name and decrypt with whichever matches")
+	fmt.Println(selfName, "keyring add alice alice/public.pem")
+	fmt.Println(selfName, "keyring add me some/directory/private.pem")
+	fmt.Println(selfName, "encrypt -r alice -r me some/file")
+	fmt.Println(selfName, "decrypt some/file.enc")
+
+	fmt.Println("")
+	fmt.Println("Example 13: defaults for every run, see", selfName, "config")
+	fmt.Println("echo 'recipients = [\"team/public.pem\"]' >" + ProjectConfigName)
+	fmt.Println("BITCRYPT_CIPHER=gcm", selfName, "encrypt some/directory")
+
+	fmt.Println("")
+	fmt.Println("Example 14: compare key fingerprints, hand out a public key, use a PKCS#8 key")
+	fmt.Println(selfName, "key fingerprint some/directory/private.pem")
+	fmt.Println(selfName, "key export -o mine.pem some/directory/private.pem")
+	fmt.Println(selfName, "key convert -to pkcs8 -o private8.pem some/directory/private.pem")
+
+	fmt.Println("")
+	fmt.Println("Example 15: back up a private key as 5 shares, any 3 of which give it back")
+	fmt.Println(selfName, "key split -n 5 -m 3 -o backup some/directory/private.pem")
+	fmt.Println(selfName, "key combine -o private.pem backup/private.share-1-of-5.txt backup/private.share-4-of-5.txt backup/private.share-5-of-5.txt")
+
+	fmt.Println("")
+	fmt.Println("Example 16: any two of three officers are needed to decrypt")
+	fmt.Println(selfName, "encrypt -threshold 2 -r alice -r bob -r carol some/file")
+	fmt.Println(selfName, "unwrap -o bob.part some/file.enc", "   # on bob's machine")
+	fmt.Println(selfName, "decrypt -part bob.part some/file.enc", "  # on alice's machine")
+
+	fmt.Println("")
+	fmt.Println("Example 17: let a HashiCorp Vault transit key wrap the data keys, with VAULT_ADDR and VAULT_TOKEN set")
+	fmt.Println(selfName, "encrypt -r vault:transit/backup -r me some/file")
+	fmt.Println(selfName, "decrypt some/file.enc")
+
+	fmt.Println("")
+	fmt.Println("Example 18: let an ed25519 key in ssh-agent wrap the data keys, no private.pem needed to decrypt")
+	fmt.Println(selfName, "encrypt -r ssh-agent:SHA256:abc some/file")
+	fmt.Println(selfName, "decrypt some/file.enc")
+
+	fmt.Println("")
+	fmt.Println("Example 19: sign with the ssh-agent key, check it here or with ssh-keygen -Y verify -n file")
+	fmt.Println(selfName, "sign -agent some/file")
+	fmt.Println(selfName, "checksig -signer ~/.ssh/id_ed25519.pub some/file")
+
+	fmt.Println("")
+	fmt.Println("Example 20: decrypt with the RSA key in an HSM or smartcard, in a build with -tags pkcs11")
+	fmt.Println("BITCRYPT_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so BITCRYPT_PKCS11_LABEL=backup BITCRYPT_PKCS11_PIN=1234", selfName, "decrypt some/file.enc")
+
+	fmt.Println("")
+	fmt.Println("Example 21: write an age file for an age user and an ssh key, and read an age file with an age-keygen key")
+	fmt.Println(selfName, "encrypt -format age -r age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p -r ~/.ssh/id_ed25519.pub some/file")
+	fmt.Println(selfName, "decrypt -k key.txt some/file.age")
+
+	fmt.Println("")
+	fmt.Println("Example 22: give a gpg user our key, send them a file they decrypt with gpg, and read the files they send")
+	fmt.Println(selfName, "key export -to openpgp -uid \"Backup <backup@example.com>\" -o backup.asc private.pem")
+	fmt.Println(selfName, "encrypt -format openpgp -armor -r partner.asc some/file")
+	fmt.Println(selfName, "decrypt some/file.gpg")
+
+	fmt.Println("")
+	fmt.Println("The older form", selfName, "-e -f some/file and so on still works")
+	fmt.Println("")
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
 	}
+	return fi.Size()
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Run fn on each encrypted file below paths, report it as action and go on
+// with the rest after a failure
+func (env *cmdEnv) eachEncFile(paths []string, action string, fn func(path string) (*FileHeader, error)) error {
+	failed := 0
+	for _, inPath := range paths {
+		if !IsFileExist(inPath) && !IsDirExist(inPath) {
+			return errors.New(inPath + " isn't exist")
+		}
+
+		err := WalkEncFiles(inPath, func(path string) error {
+			start := time.Now()
+			fh, err := fn(path)
+			if err != nil {
+				failed++
+				log.Println("Error for", path)
+				log.Println(err.Error())
+			}
+
+			if env.rp != nil {
+				ev := &ProgressEvent{Path: path, Action: action, Bytes: fileSize(path), Duration: time.Since(start), Err: err}
+				if err != nil {
+					ev.Action = "failed"
+				}
+				env.rp.File(ev, fh)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d entries failed", failed)
+	}
+	return nil
+}
+
+func runInspect(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	keyFile := fs.String("k", "", "RSA private key file path to also show the cipher, default the keyring identities and the configured private key if any")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usagef("inspect takes one or more files or directories")
+	}
+
+	bKey, err := env.identityKeys(*keyFile)
+	if err != nil && *keyFile != "" {
+		return err
+	}
+
+	kr := OpenKeyring(env.cfg.Keyring)
+	return env.eachEncFile(fs.Args(), "inspected", func(path string) (*FileHeader, error) {
+		fh, err := InspectFile(path, bKey)
+		if err == nil && env.rp == nil {
+			fmt.Printf("%s: v%d, modified %s, md5 %s, %d bytes", path, fh.Version, fh.Modified.Format(time.RFC3339), fh.Checksum, fh.EncSize)
+			if fh.Cipher != "" {
+				fmt.Printf(", aes-%d-%s, %d bytes plain", fh.KeyBits, fh.Cipher, fh.Size)
+			}
+			fmt.Println()
+			for _, fprt := range fh.Recipients {
+				name := kr.Alias(fprt)
+				for _, ref := range fh.VaultKeys {
+					if v, err := NewVaultTransit(ref); err == nil && v.Fingerprint() == fprt {
+						name = VaultPrefix + ref
+					}
+				}
+				fmt.Printf("  recipient %s %s\n", KeyID(fprt), name)
+			}
+			if fh.Shared {
+				fmt.Println("  data key split into shares among the recipients")
+			}
+		}
+		return fh, err
+	})
+}
+
+func runVerify(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	keyFile := fs.String("k", "", "RSA private key file path, default the keyring identities and the configured private key")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usagef("verify takes one or more files or directories")
+	}
+
+	bKey, err := env.identityKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	return env.eachEncFile(fs.Args(), "verified", func(path string) (*FileHeader, error) {
+		err := VerifyFile(path, bKey)
+		if err == nil && env.rp == nil {
+			log.Println("Verify", path, "OK")
+		}
+		return nil, err
+	})
+}
+
+func runRekey(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	keyFile := fs.String("k", "", "RSA private key the files are encrypted for, default the keyring identities and the configured private key")
+	var recipients listFlag
+	fs.Var(&recipients, "to", "Recipient to encrypt the files for instead: key file, keyring alias or fingerprint, repeatable")
+	threshold := fs.Int("threshold", 0, "Split the data keys so that this many of the -to recipients are needed to decrypt")
+	var parts listFlag
+	fs.Var(&parts, "part", "Partial unwrap from "+env.self+" unwrap of a threshold-encrypted file, repeatable")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usagef("rekey takes one or more files or directories")
+	}
+	if len(recipients) == 0 {
+		return usagef("rekey needs -to")
+	}
+
+	bKey, err := env.identityKeys(*keyFile)
+	bKey, err = env.withParts(bKey, err, *keyFile, parts)
+	if err != nil {
+		return err
+	}
+	toKey, err := env.recipientKeys(recipients)
+	if err != nil {
+		return err
+	}
+
+	return env.eachEncFile(fs.Args(), "rekeyed", func(path string) (*FileHeader, error) {
+		CleanTempFiles(path)
+		err := RekeyFile(path, bKey, toKey, *threshold)
+		if err == nil && env.rp == nil {
+			log.Println("Rekey", path, "OK")
+		}
+		return nil, err
+	})
+}
+
+func runUnwrap(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	keyFile := fs.String("k", "", "Private key file path, default the keyring identities and the configured private key")
+	outPath := fs.String("o", "", "Output file, default stdout")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("unwrap takes one encrypted file")
+	}
+
+	bKey, err := env.identityKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+	shares, err := UnwrapShares(fs.Arg(0), bKey)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	for _, sh := range shares {
+		out = append(out, sh.Armor()...)
+	}
+
+	if *outPath == "" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	if IsFileExist(*outPath) {
+		return errors.New(*outPath + " already exist")
+	}
+	if err = WriteFileAtomic(*outPath, out, 0600); err != nil {
+		return err
+	}
+	log.Println("Unwrap", len(shares), "share of", fs.Arg(0), "to", *outPath, "OK")
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func runConfig(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usagef("config takes no arguments")
+	}
+
+	cfg := env.cfg
+	settings := []struct {
+		key, value string
+	}{
+		{"key_dir", strconv.Quote(cfg.KeyDir)},
+		{"keyring", strconv.Quote(cfg.Keyring)},
+		{"private_key", strconv.Quote(cfg.PrivateKey)},
+		{"recipients", tomlList(cfg.Recipients)},
+		{"cipher", strconv.Quote(cfg.Cipher)},
+		{"key_length", strconv.Itoa(cfg.KeyLen)},
+		{"exclude", tomlList(cfg.Excludes)},
+		{"jobs", strconv.Itoa(cfg.Workers)},
+		{"pkcs11_module", strconv.Quote(cfg.PKCS11Module)},
+		{"pkcs11_slot", strconv.Itoa(cfg.PKCS11Slot)},
+		{"pkcs11_label", strconv.Quote(cfg.PKCS11Label)},
+	}
+
+	if env.rp != nil {
+		env.rp.enc.Encode(cfg)
+		return nil
+	}
+
+	fmt.Println("# user config:", UserConfigFile())
+	fmt.Println("# precedence: flags, BITCRYPT_* variables,", ProjectConfigName, "of the working directory or its parents, user config")
+	for _, s := range settings {
+		source := cfg.Sources[s.key]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Printf("%s = %s  # %s\n", s.key, s.value, source)
+	}
+	return nil
+}
+
+func tomlList(list []string) string {
+	var quoted []string
+	for _, s := range list {
+		quoted = append(quoted, strconv.Quote(s))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Flags of encrypt and decrypt
+type cryptFlags struct {
+	keyFile  string
+	outName  string
+	progress string
+	opts     DirOptions
+}
+
+func addCryptFlags(fs *flag.FlagSet, cf *cryptFlags, keyHelp string) {
+	fs.StringVar(&cf.keyFile, "k", "", keyHelp)
+	fs.StringVar(&cf.outName, "o", "", "Output directory/file, default next to the input")
+	fs.IntVar(&AesWorkers, "j", AesWorkers, "Number of goroutines for ctr/gcm encrypt/decrypt")
+	fs.StringVar(&cf.progress, "progress", "auto", "Progress of a directory: auto (tty on a terminal, else none), tty, json (lines on stderr) or none")
+
+	opts := &cf.opts
+	fs.BoolVar(&opts.Mirror, "mirror", false, "Remove outputs of a directory whose source no longer exists")
+	fs.BoolVar(&opts.Trash, "trash", false, "With -mirror, move such outputs to "+TrashDirName+" instead of removing them")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "With -mirror, only list such outputs")
+	fs.BoolVar(&opts.InPlace, "inplace", false, "Replace the files of a directory by their counterparts")
+	fs.BoolVar(&opts.KeepGoing, "keep-going", false, "Journal files of a directory that fail and go on with the rest")
+	fs.BoolVar(&opts.FollowLinks, "follow", false, "Follow symlinks in a directory instead of keeping them as symlinks, not with -inplace")
+	fs.Var((*listFlag)(&opts.Includes), "i", "Only take files of a directory matching this pattern, repeatable")
+	fs.Var((*listFlag)(&opts.Excludes), "x", "Leave out files of a directory matching this gitignore-style pattern, repeatable")
+	fs.BoolVar(&opts.NoDefaultExcludes, "no-default-excludes", false, "Don't leave out .git and .svn directories by default")
+}
+
+// Check the flags shared by encrypt and decrypt against inPath
+func (cf *cryptFlags) check(env *cmdEnv, fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		return "", usagef("%s takes one file or directory", fs.Name())
+	}
+	if AesWorkers < 1 {
+		return "", usagef("-j must be at least 1")
+	}
+	switch cf.progress {
+	case "auto", "tty", "json", "none":
+	default:
+		return "", usagef("-progress only valid for auto, tty, json, none")
+	}
+
+	opts := &cf.opts
+	if (opts.Trash || opts.DryRun) && !opts.Mirror {
+		return "", usagef("-trash and -dry-run need -mirror")
+	}
+	if opts.Shred && !opts.Remove {
+		return "", usagef("-shred needs -rm")
+	}
+	if opts.FollowLinks && opts.InPlace {
+		// replacing a symlink would leave its target as it was
+		return "", usagef("-follow not valid with -inplace, which leaves symlinks as they are")
+	}
+
+	inPath := fs.Arg(0)
+	if !IsFileExist(inPath) && !IsDirExist(inPath) {
+		return "", errors.New(inPath + " to " + fs.Name() + " isn't exist")
+	}
+	if !IsDirExist(inPath) && (opts.Mirror || opts.InPlace || opts.Checksum || opts.KeepGoing ||
+		opts.FollowLinks || opts.Force || len(opts.Includes) > 0 || len(opts.Excludes) > 0) {
+		return "", usagef("directory flags given for file %s", inPath)
+	}
+	opts.Excludes = append(append([]string(nil), env.cfg.Excludes...), opts.Excludes...)
+	return inPath, nil
+}
+
+func checkAesFlags(aesLen int, aesCpt string) error {
+	if aesLen != 16 && aesLen != 24 && aesLen != 32 {
+		return usagef("-l only valid for 16 24 32")
+	}
+	if aesCpt != "cfb" && aesCpt != "ctr" && aesCpt != "ofb" && aesCpt != "gcm" {
+		return usagef("-t only valid for cfb ctr ofb gcm")
+	}
+	return nil
+}
+
+// Check -format and the age flags of encrypt against inPath and the
+// number of recipients
+func checkFormatFlags(inPath string, nRecipients int, opts *DirOptions) error {
+	switch EncryptFormat {
+	case "bitcrypt":
+		if ArmorOutput || AgePassphrase {
+			return usagef("-armor needs -format age or openpgp, -passphrase -format age")
+		}
+	case "age", "openpgp":
+		if IsDirExist(inPath) {
+			return usagef("-format %s only valid for a single file", EncryptFormat)
+		}
+		if opts.Threshold != 0 || opts.Remove {
+			return usagef("-threshold and -rm not valid with -format %s", EncryptFormat)
+		}
+		if AgePassphrase && EncryptFormat != "age" {
+			return usagef("-passphrase needs -format age")
+		}
+		if AgePassphrase && nRecipients > 0 {
+			return usagef("-passphrase takes no -k or -r")
+		}
+	default:
+		return usagef("-format only valid for bitcrypt, age, openpgp")
+	}
+	return nil
+}
+
+// Output file of a single file: outName if given, else defPath, and name
+// inside that if it is a directory; an outName ending in a separator has
+// to be an existing directory rather than become a file of that name
+func fileOutPath(defPath, outName, name string) (string, error) {
+	outPath := defPath
+	if outName != "" {
+		if strings.HasSuffix(outName, "/") || strings.HasSuffix(outName, string(filepath.Separator)) {
+			if !IsDirExist(outName) {
+				return "", errors.New("output directory " + outName + " isn't exist")
+			}
+		}
+		outPath = outName
+	}
+	if IsDirExist(outPath) {
+		outPath = filepath.Join(outPath, name)
+	}
+	return outPath, nil
+}
+
+// Hook the directory run up to -json or -progress
+func (env *cmdEnv) dirProgress(cf *cryptFlags) (*ProgressStats, error) {
+	if env.rp != nil {
+		cf.opts.Progress = env.rp.Progress
+		return env.rp.Stats, nil
+	}
+
+	stats := NewProgressStats()
+	progress, err := StderrProgress(cf.progress, stats)
+	cf.opts.Progress = progress
+	return stats, err
+}
+
+func runEncrypt(env *cmdEnv, cmd *command, args []string) error {
+	var cf cryptFlags
+	fs := env.flagSet(cmd)
+	addCryptFlags(fs, &cf, "RSA public key file path, default the configured recipients")
+	var recipients listFlag
+	fs.Var(&recipients, "r", "Recipient to encrypt for: key file, keyring alias or fingerprint, repeatable")
+	aesLen := fs.Int("l", env.cfg.KeyLen, "AES key length, only valid for 16, 24, 32")
+	aesCpt := fs.String("t", env.cfg.Cipher, "AES cipher type, only valid for cfb, ctr, ofb, gcm")
+	fs.BoolVar(&cf.opts.Checksum, "checksum", false, "Rehash every file of a directory instead of trusting the index")
+	fs.BoolVar(&cf.opts.Remove, "rm", false, "Remove the plaintext once its encrypted output is verified")
+	fs.BoolVar(&cf.opts.Shred, "shred", false, "With -rm, overwrite the plaintext before removing it, refused for files with other hard links")
+	fs.IntVar(&cf.opts.Threshold, "threshold", 0, "Split the data key so that this many of the recipients are needed to decrypt")
+	fs.StringVar(&EncryptFormat, "format", "bitcrypt", "Output format: bitcrypt, or age (age-encryption.org/v1) or openpgp (for gpg) for a single file")
+	fs.BoolVar(&ArmorOutput, "armor", false, "With -format age or openpgp, write ASCII armor")
+	fs.BoolVar(&AgePassphrase, "passphrase", false, "With -format age, encrypt for the passphrase in BITCRYPT_PASSPHRASE instead of keys")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+
+	inPath, err := cf.check(env, fs)
+	if err != nil {
+		return err
+	}
+	if err = checkAesFlags(*aesLen, *aesCpt); err != nil {
+		return err
+	}
+	if cf.keyFile != "" {
+		recipients = append(listFlag{cf.keyFile}, recipients...)
+	}
+	if err = checkFormatFlags(inPath, len(recipients), &cf.opts); err != nil {
+		return err
+	}
+	var bKey []byte
+	if !AgePassphrase {
+		if bKey, err = env.recipientKeys(recipients); err != nil {
+			return err
+		}
+	}
+
+	if IsDirExist(inPath) {
+		cf.opts.OutDir = cf.outName
+		stats, err := env.dirProgress(&cf)
+		if err != nil {
+			return err
+		}
+		err = EncryptDir(inPath, bKey, *aesLen, *aesCpt, &cf.opts)
+		if stats.Duration > 0 {
+			log.Println("Summary:", stats.Summary())
+		}
+		if err != nil {
+			return err
+		}
+		log.Println("Encrypt directory", inPath, "OK")
+		return nil
+	}
+
+	ext := ".enc"
+	switch {
+	case EncryptFormat == "age":
+		ext = ".age"
+	case EncryptFormat == "openpgp" && ArmorOutput:
+		ext = ".asc"
+	case EncryptFormat == "openpgp":
+		ext = ".gpg"
+	}
+	outPath, err := fileOutPath(inPath+ext, cf.outName, filepath.Base(inPath)+ext)
+	if err != nil {
+		return err
+	}
+	CleanTempFiles(outPath)
+	start, size := time.Now(), fileSize(inPath)
+	if cf.opts.Remove {
+		err = EncryptFileRemove(inPath, outPath, bKey, *aesLen, *aesCpt, cf.opts.Threshold, cf.opts.Shred)
+	} else {
+		err = EncryptFile(inPath, outPath, bKey, *aesLen, *aesCpt, cf.opts.Threshold)
+	}
+	if env.rp != nil {
+		env.rp.FileDone(inPath, outPath, "encrypted", size, start, err)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Encrypt file", inPath, "OK")
+	return nil
+}
+
+func runDecrypt(env *cmdEnv, cmd *command, args []string) error {
+	var cf cryptFlags
+	fs := env.flagSet(cmd)
+	addCryptFlags(fs, &cf, "RSA private key file path, default the keyring identities and the configured private key")
+	fs.BoolVar(&cf.opts.Force, "force", false, "Decrypt a directory into a non-empty output directory")
+	var parts listFlag
+	fs.Var(&parts, "part", "Partial unwrap from "+env.self+" unwrap of a threshold-encrypted file, repeatable")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+
+	inPath, err := cf.check(env, fs)
+	if err != nil {
+		return err
+	}
+	bKey, err := env.identityKeys(cf.keyFile)
+	bKey, err = env.withParts(bKey, err, cf.keyFile, parts)
+	if err != nil {
+		return err
+	}
+
+	if IsDirExist(inPath) {
+		cf.opts.OutDir = cf.outName
+		stats, err := env.dirProgress(&cf)
+		if err != nil {
+			return err
+		}
+		err = DecryptDir(inPath, bKey, &cf.opts)
+		if stats.Duration > 0 {
+			log.Println("Summary:", stats.Summary())
+		}
+		if err != nil {
+			return err
+		}
+		log.Println("Decrypt directory", inPath, "OK")
+		return nil
+	}
+
+	plainPath := inPath
+	switch ext := filepath.Ext(inPath); ext {
+	case ".enc", ".age", ".gpg", ".pgp", ".asc":
+		plainPath = strings.TrimSuffix(inPath, ext)
+	}
+	outPath := inPath + ".dec"
+	if plainPath != inPath {
+		outPath = plainPath
+	}
+	if outPath, err = fileOutPath(outPath, cf.outName, filepath.Base(plainPath)); err != nil {
+		return err
+	}
+	CleanTempFiles(outPath)
+	start, size := time.Now(), fileSize(inPath)
+	err = DecryptFile(inPath, outPath, bKey)
+	if env.rp != nil {
+		env.rp.FileDone(inPath, outPath, "decrypted", size, start, err)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Decrypt file", inPath, "OK")
+	return nil
+}
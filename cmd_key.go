@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func runKey(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	to := fs.String("to", "spki", "Encoding for export and convert: "+strings.Join(KeyEncodings, ", ")+", each with -der for DER, or age")
+	fs.StringVar(&PgpUserID, "uid", "", "User ID of an openpgp key, default bitcrypt and its key ID")
+	outPath := fs.String("o", "", "Output file for export, convert and combine, default stdout; directory of the shares for split")
+	count := fs.Int("n", 5, "Number of shares split makes")
+	threshold := fs.Int("m", 3, "Number of shares needed to combine them")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usagef("key takes fingerprint, export, list, convert, split or combine")
+	}
+	// flags may also follow the action
+	action := fs.Arg(0)
+	if err := env.parse(fs, fs.Args()[1:]); err != nil {
+		return err
+	}
+	files := fs.Args()
+
+	switch action {
+	case "fingerprint":
+		if len(files) == 0 {
+			return usagef("key fingerprint takes key files")
+		}
+		for _, path := range files {
+			ki, err := ReadKeyInfo(path)
+			if err != nil {
+				return err
+			}
+			if env.rp != nil {
+				env.rp.enc.Encode(ki)
+				continue
+			}
+			fmt.Println(path)
+			fmt.Println("  sha256:", ki.Fingerprint)
+			fmt.Println("  short: ", ki.Short)
+			if ki.SSH != "" {
+				fmt.Println("  ssh:   ", ki.SSH)
+			}
+		}
+		return nil
+
+	case "list":
+		if len(files) > 1 {
+			return usagef("key list takes at most one directory")
+		}
+		dir := env.cfg.KeyDir
+		if len(files) == 1 {
+			dir = files[0]
+		}
+		list, err := ListKeys(dir)
+		if err != nil {
+			return err
+		}
+		for _, ki := range list {
+			if env.rp != nil {
+				env.rp.enc.Encode(ki)
+			} else {
+				fmt.Printf("%-7s %-10s %-5d %-16s %s  %s\n", ki.Kind, ki.Type, ki.Bits, ki.Encoding, ki.Short, ki.Path)
+			}
+		}
+		return nil
+
+	case "export", "convert":
+		if len(files) != 1 {
+			return usagef("key %s takes one key file", action)
+		}
+		if action == "export" && PrivateEncoding(*to) {
+			return usagef("key export writes a public key, -to only valid for spki, pkcs1-public, age, openpgp")
+		}
+		data, err := ioutil.ReadFile(files[0])
+		if err != nil {
+			return err
+		}
+		kf, err := ParseKeyFile(data)
+		if err != nil {
+			return errors.New(files[0] + ": " + err.Error())
+		}
+		if action == "export" && kf.Private == nil {
+			return errors.New(files[0] + " isn't a private key")
+		}
+		out, err := kf.Encode(*to)
+		if err != nil {
+			return err
+		}
+
+		if *outPath == "" {
+			_, err = os.Stdout.Write(out)
+			return err
+		}
+		if IsFileExist(*outPath) {
+			return errors.New(*outPath + " already exist")
+		}
+		perm := os.FileMode(0644)
+		if PrivateEncoding(*to) {
+			perm = 0600
+		}
+		if err = WriteFileAtomic(*outPath, out, perm); err != nil {
+			return err
+		}
+		log.Println("Write", *to, "key", *outPath, "OK")
+		return nil
+
+	case "split":
+		if len(files) != 1 {
+			return usagef("key split takes one private key file")
+		}
+		if *threshold < 2 || *threshold > *count || *count > 255 {
+			return usagef("-m and -n need 2 <= m <= n <= 255")
+		}
+		return env.splitKey(files[0], *outPath, *count, *threshold)
+
+	case "combine":
+		if len(files) == 0 {
+			return usagef("key combine takes share files")
+		}
+		return env.combineKey(files, *outPath)
+	}
+	return usagef("key takes fingerprint, export, list, convert, split or combine")
+}
+
+// Write the shares of the private key in keyFile to outDir, next to the
+// key by default
+func (env *cmdEnv) splitKey(keyFile, outDir string, n, m int) error {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	if kf, err := ParseKeyFile(data); err != nil {
+		return errors.New(keyFile + ": " + err.Error())
+	} else if kf.Private == nil {
+		return errors.New(keyFile + " isn't a private key")
+	}
+
+	if outDir == "" {
+		outDir = filepath.Dir(keyFile)
+	} else if !IsDirExist(outDir) {
+		return errors.New("path " + outDir + " isn't exist")
+	}
+	base := strings.TrimSuffix(filepath.Base(keyFile), filepath.Ext(keyFile))
+	var paths []string
+	for i := 1; i <= n; i++ {
+		path := filepath.Join(outDir, fmt.Sprintf("%s.share-%d-of-%d.txt", base, i, n))
+		if IsFileExist(path) {
+			return errors.New(path + " already exist")
+		}
+		paths = append(paths, path)
+	}
+
+	start := time.Now()
+	shares, err := ShamirSplit(data, n, m)
+	if err != nil {
+		return err
+	}
+	for i, sh := range shares {
+		armor := sh.Armor()
+		if err = WriteFileAtomic(paths[i], armor, 0600); err != nil {
+			return err
+		}
+		if env.rp != nil {
+			env.rp.FileDone(paths[i], "", "generated", int64(len(armor)), start, nil)
+		}
+	}
+	log.Println("Split", keyFile, "into", n, "shares, any", m, "give it back OK")
+	log.Println("Please hand the shares to different people or places, and print or copy them")
+	return nil
+}
+
+// Put a private key back together from share files
+func (env *cmdEnv) combineKey(files []string, outPath string) error {
+	var shares []*Share
+	for _, path := range files {
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sh, err := ParseShare(text)
+		if err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+		shares = append(shares, sh)
+	}
+	data, err := ShamirCombine(shares)
+	if err != nil {
+		return err
+	}
+
+	if outPath == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if IsFileExist(outPath) {
+		return errors.New(outPath + " already exist")
+	}
+	if err = WriteFileAtomic(outPath, data, 0600); err != nil {
+		return err
+	}
+	log.Println("Combine", len(shares), "shares into", outPath, "OK")
+	return nil
+}
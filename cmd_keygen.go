@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func runKeygen(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	keyType := fs.String("type", "rsa", "Key type: rsa, x25519 (encryption), ed25519 or ecdsa (P-256, signing)")
+	bits := fs.Int("b", 2048, "RSA key length, only valid for 2048, 3072, 4096, 8192")
+	force := fs.Bool("force", false, "Allow a 1024 bits RSA key")
+	keyPath := fs.String("p", "", "Key files directory path, default "+env.cfg.KeyDir)
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 {
+		return usagef("keygen takes no arguments")
+	}
+	switch *keyType {
+	case "rsa":
+		if *bits == 1024 && !*force {
+			return usagef("RSA keys under 2048 bits are weak, give -force to create one anyway")
+		}
+		if *bits != 1024 && *bits != 2048 && *bits != 3072 && *bits != 4096 && *bits != 8192 {
+			return usagef("-b only valid for 2048 3072 4096 8192")
+		}
+	case "x25519", "ed25519", "ecdsa":
+		bitsSet := false
+		fs.Visit(func(f *flag.Flag) { bitsSet = bitsSet || f.Name == "b" })
+		if bitsSet {
+			return usagef("-b only valid for rsa keys")
+		}
+	default:
+		return usagef("-type only valid for %s", strings.Join(KeyGenTypes, " "))
+	}
+	if *keyPath == "" {
+		*keyPath = env.cfg.KeyDir
+		if err := os.MkdirAll(filepath.Dir(*keyPath), 0700); err != nil {
+			return err
+		}
+	} else if !IsDirExist(*keyPath) {
+		return errors.New("path " + *keyPath + " isn't exist")
+	}
+
+	if *keyType == "rsa" {
+		log.Println("RSA key length", *bits)
+	} else {
+		log.Println("Key type", *keyType)
+	}
+	log.Println("Directory at", *keyPath)
+	start := time.Now()
+	if err := GenKey(*keyPath, *keyType, *bits); err != nil {
+		return err
+	}
+
+	privName, pubName := KeyFileNames(*keyType)
+	if env.rp != nil {
+		for _, name := range []string{privName, pubName} {
+			path := filepath.Join(*keyPath, name)
+			if fi, err := os.Stat(path); err == nil {
+				env.rp.FileDone(path, "", "generated", fi.Size(), start, nil)
+			}
+		}
+	}
+	log.Println("Generate", *keyType, "key", privName, pubName, "OK")
+	if *keyType == "rsa" || *keyType == "x25519" {
+		log.Println("Please backup your key files carefully")
+		log.Println("If key files are lost, all encrypted files cannot be decrypted")
+	}
+	return nil
+}
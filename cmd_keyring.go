@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+func runKeyring(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+
+	kr := OpenKeyring(env.cfg.Keyring)
+	switch {
+	case fs.NArg() == 1 && fs.Arg(0) == "list":
+		list, err := kr.List()
+		if err != nil {
+			return err
+		}
+		for _, ent := range list {
+			if env.rp != nil {
+				env.rp.enc.Encode(ent)
+			} else {
+				fmt.Printf("%-9s %-20s %s\n", ent.Kind, ent.Alias, ent.Fingerprint)
+			}
+		}
+		return nil
+
+	case fs.NArg() == 3 && fs.Arg(0) == "add":
+		data, err := ioutil.ReadFile(fs.Arg(2))
+		if err != nil {
+			return err
+		}
+		if err = kr.Add(fs.Arg(1), data); err != nil {
+			return err
+		}
+		log.Println("Add", fs.Arg(1), "to keyring", kr.Dir, "OK")
+		return nil
+
+	case fs.NArg() == 2 && fs.Arg(0) == "remove":
+		if err := kr.Remove(fs.Arg(1)); err != nil {
+			return err
+		}
+		log.Println("Remove", fs.Arg(1), "from keyring", kr.Dir, "OK")
+		return nil
+	}
+	return usagef("keyring takes list, add <alias> <key file> or remove <alias>")
+}
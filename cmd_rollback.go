@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+func runRollback(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	keyFile := fs.String("k", "", "Private key to undo an encryption, public key to undo a decryption")
+	aesLen := fs.Int("l", env.cfg.KeyLen, "AES key length to encrypt with again, only valid for 16, 24, 32")
+	aesCpt := fs.String("t", env.cfg.Cipher, "AES cipher type to encrypt with again, only valid for cfb, ctr, ofb, gcm")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return usagef("rollback takes one directory")
+	}
+	if err := checkAesFlags(*aesLen, *aesCpt); err != nil {
+		return err
+	}
+	dir := fs.Arg(0)
+	if !IsDirExist(dir) {
+		return errors.New("directory " + dir + " to roll back isn't exist")
+	}
+
+	jnl, err := ReadJournal(dir)
+	if err != nil {
+		return err
+	}
+	if jnl == nil || !strings.HasPrefix(jnl.Mode, "inplace-") {
+		return errors.New("no unfinished in-place run in " + dir)
+	}
+
+	// undoing an encryption needs the private key and vice versa
+	var bKey []byte
+	if jnl.Mode == "inplace-enc" {
+		bKey, err = env.identityKeys(*keyFile)
+	} else if *keyFile != "" {
+		bKey, err = env.recipientKeys([]string{*keyFile})
+	} else {
+		bKey, err = env.recipientKeys(nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = RollbackDir(dir, bKey, *aesLen, *aesCpt); err != nil {
+		return err
+	}
+	log.Println("Roll back directory", dir, "OK")
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+func runSign(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	keyFile := fs.String("k", "", "Private key file to sign with: rsa, ed25519 or ecdsa")
+	agent := fs.Bool("agent", false, "Sign with a key held by ssh-agent")
+	sel := fs.String("ssh", "", "With -agent, the key by fingerprint or comment, default the first one")
+	namespace := fs.String("n", "file", "Signature namespace, as ssh-keygen -Y sign -n")
+	outPath := fs.String("o", "", "Signature file, default the file with .sig")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("sign takes one file")
+	}
+	if *sel != "" {
+		*agent = true
+	}
+	if (*keyFile == "") == !*agent {
+		return usagef("sign needs either -k or -agent")
+	}
+
+	var signer SshSigner
+	var err error
+	if *agent {
+		signer, err = NewAgentSshSigner(*sel)
+	} else {
+		var bKey []byte
+		if bKey, err = env.readKey(*keyFile); err == nil {
+			var keys []crypto.PrivateKey
+			if keys, err = PrivateKeys(bKey); err == nil {
+				signer, err = NewLocalSshSigner(keys[0])
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	inPath := fs.Arg(0)
+	if *outPath == "" {
+		*outPath = inPath + ".sig"
+	}
+	if IsFileExist(*outPath) {
+		return errors.New(*outPath + " already exist")
+	}
+	start := time.Now()
+	sig, err := SignFileSsh(inPath, signer, *namespace)
+	if err == nil {
+		err = WriteFileAtomic(*outPath, sig, 0644)
+	}
+	if env.rp != nil {
+		env.rp.FileDone(inPath, *outPath, "signed", fileSize(inPath), start, err)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Sign", inPath, "by", SshFingerprint(signer.PublicBlob()), "OK")
+	return nil
+}
+
+func runChecksig(env *cmdEnv, cmd *command, args []string) error {
+	fs := env.flagSet(cmd)
+	sigPath := fs.String("s", "", "Signature file, default the file with .sig")
+	namespace := fs.String("n", "file", "Signature namespace, as ssh-keygen -Y verify -n")
+	var signers listFlag
+	fs.Var(&signers, "signer", "Accepted signer: key file, OpenSSH public key file, keyring alias or SHA256: fingerprint, repeatable")
+	if err := env.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usagef("checksig takes one file")
+	}
+
+	inPath := fs.Arg(0)
+	if *sigPath == "" {
+		*sigPath = inPath + ".sig"
+	}
+	armored, err := ioutil.ReadFile(*sigPath)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	blob, err := VerifyFileSsh(inPath, armored, *namespace)
+	who := ""
+	if err == nil {
+		who, err = env.judgeSigner(blob, signers)
+	}
+	if env.rp != nil {
+		env.rp.FileDone(inPath, *sigPath, "checked", fileSize(inPath), start, err)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Good signature of", inPath, "by", who)
+	return nil
+}
+
+// Name the signer with key blob, which must be one of signers if given;
+// without signers only a keyring recipient is trusted
+func (env *cmdEnv) judgeSigner(blob []byte, signers []string) (string, error) {
+	who := SshFingerprint(blob)
+	kr := OpenKeyring(env.cfg.Keyring)
+	if pub, err := ParseSshPublicKey(blob); err == nil {
+		if alias := kr.Alias(KeyFingerprint(pub)); alias != "" {
+			who += " (" + alias + ")"
+			if len(signers) == 0 {
+				return who, nil
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return "", errors.New("signer " + who + " isn't in the keyring, give -signer to accept it")
+	}
+
+	for _, name := range signers {
+		if strings.HasPrefix(name, "SHA256:") {
+			if name == SshFingerprint(blob) {
+				return who, nil
+			}
+			continue
+		}
+
+		var data []byte
+		var err error
+		if IsFileExist(name) {
+			data, err = ioutil.ReadFile(name)
+		} else {
+			data, err = kr.Recipient(name)
+		}
+		if err != nil {
+			return "", err
+		}
+		var want []byte
+		if want, _, err = ParseSshAuthorizedKey(data); err != nil {
+			kf, err := ParseKeyFile(data)
+			if err != nil {
+				return "", errors.New(name + ": " + err.Error())
+			}
+			if want, err = SshPublicKeyBlob(kf.Public); err != nil {
+				return "", errors.New(name + ": " + err.Error())
+			}
+		}
+		if string(want) == string(blob) {
+			return who, nil
+		}
+	}
+	return "", errors.New("signed by " + who + ", not by any -signer")
+}
@@ -12,6 +12,10 @@ import (
 )
 
 func AesEncryptFd(inFile, outFile *os.File, key, iv []byte, ctp int) error {
+	if ctp == 2 || ctp == 8 {
+		return AesEncryptChunks(inFile, outFile, key, iv, ctp)
+	}
+
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return err
@@ -21,8 +25,6 @@ func AesEncryptFd(inFile, outFile *os.File, key, iv []byte, ctp int) error {
 	switch ctp {
 	case 1:
 		stream = cipher.NewCFBEncrypter(block, iv[:])
-	case 2:
-		stream = cipher.NewCTR(block, iv[:])
 	default:
 		stream = cipher.NewOFB(block, iv[:])
 	}
@@ -41,6 +43,10 @@ func AesEncryptFd(inFile, outFile *os.File, key, iv []byte, ctp int) error {
 }
 
 func AesDecryptFd(inFile, outFile *os.File, key, iv []byte, ctp int) error {
+	if ctp == 2 || ctp == 8 {
+		return AesDecryptChunks(inFile, outFile, key, iv, ctp)
+	}
+
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return err
@@ -50,8 +56,6 @@ func AesDecryptFd(inFile, outFile *os.File, key, iv []byte, ctp int) error {
 	switch ctp {
 	case 1:
 		stream = cipher.NewCFBDecrypter(block, iv[:])
-	case 2:
-		stream = cipher.NewCTR(block, iv[:])
 	default:
 		stream = cipher.NewOFB(block, iv[:])
 	}
@@ -88,6 +92,8 @@ func AesEncryptFile(inPath, outPath string, key, iv []byte, aesCtp string) error
 		ctp = 1
 	case "ctr":
 		ctp = 2
+	case "gcm":
+		ctp = 8
 	default:
 		ctp = 4
 	}
@@ -114,6 +120,8 @@ func AesDecryptFile(inPath, outPath string, key, iv []byte, aesCtp string) error
 		ctp = 1
 	case "ctr":
 		ctp = 2
+	case "gcm":
+		ctp = 8
 	default:
 		ctp = 4
 	}
@@ -0,0 +1,1116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The age file format, age-encryption.org/v1: a text header of recipient
+// stanzas each wrapping the 16-byte file key, its HMAC, then the payload
+// in ChaCha20-Poly1305 chunks of 64 KiB. Recipients are X25519 keys
+// (age1...), a passphrase (scrypt) and ssh-rsa and ssh-ed25519 keys
+
+const (
+	ageVersionLine = "age-encryption.org/v1"
+	ageArmorBegin  = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageArmorEnd    = "-----END AGE ENCRYPTED FILE-----"
+	ageChunkSize   = 64 * 1024
+	ageFileKeySize = 16
+	ageColumns     = 64
+
+	AgeRecipientHrp = "age"
+	AgeIdentityHrp  = "AGE-SECRET-KEY-"
+)
+
+// Format EncryptFile writes, "bitcrypt", "age" or "openpgp"; age and
+// OpenPGP files are ASCII armored if ArmorOutput, and age files are for
+// BITCRYPT_PASSPHRASE instead of the keys if AgePassphrase
+var (
+	EncryptFormat = "bitcrypt"
+	ArmorOutput   bool
+	AgePassphrase bool
+)
+
+// Work factor of new scrypt stanzas and the most a file may ask for, as
+// log2 of scrypt's N
+var (
+	AgeScryptLogN    = 18
+	ageScryptMaxLogN = 22
+)
+
+// One recipient stanza of an age header
+type AgeStanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+// Wraps the file key for one recipient
+type AgeRecipient interface {
+	Wrap(fileKey []byte) (*AgeStanza, error)
+}
+
+// Unwraps the file key from a stanza, errAgeNoMatch for stanzas of other
+// recipients
+type AgeIdentity interface {
+	Unwrap(s *AgeStanza) ([]byte, error)
+}
+
+var errAgeNoMatch = errors.New("age stanza of another recipient")
+
+var ageB64 = base64.RawStdEncoding.Strict()
+
+// Seal the file key under key with the zero nonce, as every stanza type does
+func ageAeadWrap(key, fileKey []byte) ([]byte, error) {
+	aead, err := NewChaCha20Poly1305(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chachaNonceSize), fileKey, nil), nil
+}
+
+// Open a stanza body, errAgeNoMatch if it isn't sealed under key
+func ageAeadUnwrap(key, body []byte) ([]byte, error) {
+	if len(body) != ageFileKeySize+poly1305TagSize {
+		return nil, errors.New("age stanza body of wrong size")
+	}
+	aead, err := NewChaCha20Poly1305(key)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, chachaNonceSize), body, nil)
+	if err != nil {
+		return nil, errAgeNoMatch
+	}
+	return fileKey, nil
+}
+
+// Decode a base64 stanza argument of n bytes
+func ageArg(s *AgeStanza, i, n int) ([]byte, error) {
+	b, err := ageB64.DecodeString(s.Args[i])
+	if err != nil || len(b) != n {
+		return nil, errors.New("invalid " + s.Type + " stanza")
+	}
+	return b, nil
+}
+
+// X25519 recipient, an age1... string
+type ageX25519Recipient struct {
+	pub *ecdh.PublicKey
+}
+
+const ageX25519Label = "age-encryption.org/v1/X25519"
+
+func (r *ageX25519Recipient) Wrap(fileKey []byte) (*AgeStanza, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(r.pub)
+	if err != nil {
+		return nil, err
+	}
+	share := eph.PublicKey().Bytes()
+	key, err := hkdf.Key(sha256.New, shared, append(append([]byte(nil), share...), r.pub.Bytes()...), ageX25519Label, chachaKeySize)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ageAeadWrap(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &AgeStanza{Type: "X25519", Args: []string{ageB64.EncodeToString(share)}, Body: body}, nil
+}
+
+type ageX25519Identity struct {
+	priv *ecdh.PrivateKey
+}
+
+func (id *ageX25519Identity) Unwrap(s *AgeStanza) ([]byte, error) {
+	if s.Type != "X25519" {
+		return nil, errAgeNoMatch
+	}
+	if len(s.Args) != 1 {
+		return nil, errors.New("invalid X25519 stanza")
+	}
+	share, err := ageArg(s, 0, 32)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().NewPublicKey(share)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := id.priv.ECDH(eph)
+	if err != nil {
+		return nil, errors.New("invalid X25519 stanza share")
+	}
+	salt := append(share, id.priv.PublicKey().Bytes()...)
+	key, err := hkdf.Key(sha256.New, shared, salt, ageX25519Label, chachaKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ageAeadUnwrap(key, s.Body)
+}
+
+// Passphrase recipient and identity; a file for it has no other recipient
+type ageScrypt struct {
+	passphrase []byte
+}
+
+const ageScryptLabel = "age-encryption.org/v1/scrypt"
+
+func (p *ageScrypt) key(salt []byte, logN int) ([]byte, error) {
+	return Scrypt(p.passphrase, append([]byte(ageScryptLabel), salt...), 1<<uint(logN), 8, 1, chachaKeySize)
+}
+
+func (p *ageScrypt) Wrap(fileKey []byte) (*AgeStanza, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := p.key(salt, AgeScryptLogN)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ageAeadWrap(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &AgeStanza{Type: "scrypt", Args: []string{ageB64.EncodeToString(salt), strconv.Itoa(AgeScryptLogN)}, Body: body}, nil
+}
+
+func (p *ageScrypt) Unwrap(s *AgeStanza) ([]byte, error) {
+	if s.Type != "scrypt" {
+		return nil, errAgeNoMatch
+	}
+	if len(s.Args) != 2 {
+		return nil, errors.New("invalid scrypt stanza")
+	}
+	salt, err := ageArg(s, 0, 16)
+	if err != nil {
+		return nil, err
+	}
+	// decimal without sign or leading zeros
+	logN, err := strconv.Atoi(s.Args[1])
+	if err != nil || s.Args[1] != strconv.Itoa(logN) || logN <= 0 {
+		return nil, errors.New("invalid scrypt work factor")
+	}
+	if logN > ageScryptMaxLogN {
+		return nil, errors.New("scrypt work factor " + s.Args[1] + " too large")
+	}
+	if len(s.Body) != ageFileKeySize+poly1305TagSize {
+		return nil, errors.New("invalid scrypt stanza")
+	}
+	key, err := p.key(salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := ageAeadUnwrap(key, s.Body)
+	if err == errAgeNoMatch {
+		return nil, errors.New("incorrect passphrase")
+	}
+	return fileKey, err
+}
+
+// Short tag of an ssh key in its stanzas
+func ageSshTag(blob []byte) []byte {
+	sum := sha256.Sum256(blob)
+	return sum[:4]
+}
+
+const (
+	ageSshRsaLabel     = "age-encryption.org/v1/ssh-rsa"
+	ageSshEd25519Label = "age-encryption.org/v1/ssh-ed25519"
+)
+
+// ssh-rsa recipient and identity, RSA-OAEP of the file key; priv is nil to
+// only wrap
+type ageSshRsa struct {
+	pub  *rsa.PublicKey
+	priv *rsa.PrivateKey
+	blob []byte
+}
+
+func newAgeSshRsa(pub *rsa.PublicKey, priv *rsa.PrivateKey) (*ageSshRsa, error) {
+	blob, err := SshPublicKeyBlob(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &ageSshRsa{pub: pub, priv: priv, blob: blob}, nil
+}
+
+func (k *ageSshRsa) Wrap(fileKey []byte) (*AgeStanza, error) {
+	body, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, k.pub, fileKey, []byte(ageSshRsaLabel))
+	if err != nil {
+		return nil, err
+	}
+	return &AgeStanza{Type: "ssh-rsa", Args: []string{ageB64.EncodeToString(ageSshTag(k.blob))}, Body: body}, nil
+}
+
+func (k *ageSshRsa) Unwrap(s *AgeStanza) ([]byte, error) {
+	if s.Type != "ssh-rsa" {
+		return nil, errAgeNoMatch
+	}
+	if len(s.Args) != 1 {
+		return nil, errors.New("invalid ssh-rsa stanza")
+	}
+	tag, err := ageArg(s, 0, 4)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(tag, ageSshTag(k.blob)) {
+		return nil, errAgeNoMatch
+	}
+	fileKey, err := rsa.DecryptOAEP(sha256.New(), nil, k.priv, s.Body, []byte(ageSshRsaLabel))
+	if err != nil {
+		return nil, errAgeNoMatch
+	}
+	return fileKey, nil
+}
+
+// ssh-ed25519 recipient and identity: X25519 with the Montgomery form of
+// the key, tweaked by the key's ssh blob; priv is nil to only wrap
+type ageSshEd25519 struct {
+	blob  []byte
+	pub   *ecdh.PublicKey
+	priv  *ecdh.PrivateKey
+	tweak *ecdh.PrivateKey
+}
+
+func newAgeSshEd25519(pub ed25519.PublicKey, priv ed25519.PrivateKey) (*ageSshEd25519, error) {
+	blob, err := SshPublicKeyBlob(pub)
+	if err != nil {
+		return nil, err
+	}
+	k := &ageSshEd25519{blob: blob}
+	if k.pub, err = ed25519ToX25519(pub); err != nil {
+		return nil, err
+	}
+	if priv != nil {
+		h := sha512.Sum512(priv.Seed())
+		if k.priv, err = ecdh.X25519().NewPrivateKey(h[:32]); err != nil {
+			return nil, err
+		}
+	}
+	tweak, err := hkdf.Key(sha256.New, nil, blob, ageSshEd25519Label, 32)
+	if err != nil {
+		return nil, err
+	}
+	k.tweak, err = ecdh.X25519().NewPrivateKey(tweak)
+	return k, err
+}
+
+// X25519(tweak, point)
+func (k *ageSshEd25519) tweaked(point []byte) ([]byte, error) {
+	p, err := ecdh.X25519().NewPublicKey(point)
+	if err != nil {
+		return nil, err
+	}
+	return k.tweak.ECDH(p)
+}
+
+func (k *ageSshEd25519) Wrap(fileKey []byte) (*AgeStanza, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(k.pub)
+	if err != nil {
+		return nil, err
+	}
+	if shared, err = k.tweaked(shared); err != nil {
+		return nil, err
+	}
+	share := eph.PublicKey().Bytes()
+	key, err := hkdf.Key(sha256.New, shared, append(append([]byte(nil), share...), k.pub.Bytes()...), ageSshEd25519Label, chachaKeySize)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ageAeadWrap(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{ageB64.EncodeToString(ageSshTag(k.blob)), ageB64.EncodeToString(share)}
+	return &AgeStanza{Type: "ssh-ed25519", Args: args, Body: body}, nil
+}
+
+func (k *ageSshEd25519) Unwrap(s *AgeStanza) ([]byte, error) {
+	if s.Type != "ssh-ed25519" {
+		return nil, errAgeNoMatch
+	}
+	if len(s.Args) != 2 {
+		return nil, errors.New("invalid ssh-ed25519 stanza")
+	}
+	tag, err := ageArg(s, 0, 4)
+	if err != nil {
+		return nil, err
+	}
+	share, err := ageArg(s, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(tag, ageSshTag(k.blob)) {
+		return nil, errAgeNoMatch
+	}
+	eph, err := ecdh.X25519().NewPublicKey(share)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := k.priv.ECDH(eph)
+	if err != nil {
+		return nil, errors.New("invalid ssh-ed25519 stanza share")
+	}
+	if shared, err = k.tweaked(shared); err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, shared, append(share, k.pub.Bytes()...), ageSshEd25519Label, chachaKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ageAeadUnwrap(key, s.Body)
+}
+
+// Montgomery u = (1 + y) / (1 - y) of an Edwards25519 point
+func ed25519ToX25519(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := append([]byte(nil), pub...)
+	le[31] &= 0x7f
+	for i, j := 0, len(le)-1; i < j; i, j = i+1, j-1 {
+		le[i], le[j] = le[j], le[i]
+	}
+	y := new(big.Int).SetBytes(le)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	if y.Cmp(p) >= 0 || den.Sign() == 0 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den.ModInverse(den, p))
+	u.Mod(u, p)
+
+	out := u.FillBytes(make([]byte, 32))
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return ecdh.X25519().NewPublicKey(out)
+}
+
+// X25519 public key of an age1... recipient
+func ParseAgeRecipient(s string) (*ecdh.PublicKey, error) {
+	hrp, data, err := Bech32Decode(s)
+	if err != nil || hrp != AgeRecipientHrp {
+		return nil, errors.New("invalid age recipient " + s)
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+// PEM public key of an age1... recipient, for key bundles
+func AgeRecipientPEM(s string) ([]byte, error) {
+	pub, err := ParseAgeRecipient(s)
+	if err != nil {
+		return nil, err
+	}
+	return (&KeyFile{Public: pub}).Encode("spki")
+}
+
+// X25519 private key of an AGE-SECRET-KEY-1... identity
+func ParseAgeIdentity(s string) (*ecdh.PrivateKey, error) {
+	hrp, data, err := Bech32Decode(s)
+	if err != nil || hrp != strings.ToLower(AgeIdentityHrp) {
+		return nil, errors.New("invalid age identity")
+	}
+	return ecdh.X25519().NewPrivateKey(data)
+}
+
+func AgeRecipientString(pub *ecdh.PublicKey) string {
+	s, _ := Bech32Encode(AgeRecipientHrp, pub.Bytes())
+	return s
+}
+
+func AgeIdentityString(priv *ecdh.PrivateKey) string {
+	s, _ := Bech32Encode(AgeIdentityHrp, priv.Bytes())
+	return s
+}
+
+// Recipient of a public key: x25519, rsa or ed25519
+func NewAgeRecipient(pub interface{}) (AgeRecipient, error) {
+	switch k := pub.(type) {
+	case *ecdh.PublicKey:
+		if KeyType(k) == "x25519" {
+			return &ageX25519Recipient{pub: k}, nil
+		}
+	case *rsa.PublicKey:
+		return newAgeSshRsa(k, nil)
+	case ed25519.PublicKey:
+		return newAgeSshEd25519(k, nil)
+	}
+	return nil, errors.New(KeyType(pub) + " key can't be an age recipient, only x25519, rsa and ed25519 keys can")
+}
+
+// Identity of a private key: x25519, rsa or ed25519, nil for others
+func NewAgeIdentity(priv interface{}) AgeIdentity {
+	switch k := priv.(type) {
+	case *ecdh.PrivateKey:
+		if KeyType(k.PublicKey()) == "x25519" {
+			return &ageX25519Identity{priv: k}
+		}
+	case *rsa.PrivateKey:
+		if id, err := newAgeSshRsa(&k.PublicKey, k); err == nil {
+			return id
+		}
+	case ed25519.PrivateKey:
+		if id, err := newAgeSshEd25519(k.Public().(ed25519.PublicKey), k); err == nil {
+			return id
+		}
+	}
+	return nil
+}
+
+// Lines of bundle outside its PEM blocks, trimmed, without blanks and
+// # comments
+func bundleTextLines(bundle []byte) []string {
+	var lines []string
+	inPem := false
+	for _, line := range strings.Split(string(bundle), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "-----BEGIN "):
+			inPem = true
+		case strings.HasPrefix(line, "-----END "):
+			inPem = false
+		case !inPem && line != "" && line[0] != '#':
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Recipients in bundle: PEM public keys, age1... recipients and ssh
+// authorized_keys lines
+func AgeRecipients(bundle []byte) ([]AgeRecipient, error) {
+	var list []AgeRecipient
+	for rest := bundle; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		enc, ok := pemEncodings[block.Type]
+		if !ok {
+			return nil, errors.New(strings.ToLower(block.Type) + " can't be an age recipient")
+		}
+		if PrivateEncoding(enc) {
+			continue
+		}
+		kf, err := parseKeyDer(block.Bytes, enc)
+		if err != nil {
+			return nil, err
+		}
+		r, err := NewAgeRecipient(kf.Public)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+
+	if len(pgpArmorBlocks(bundle)) > 0 {
+		return nil, errors.New("openpgp key can't be an age recipient")
+	}
+	for _, line := range bundleTextLines(bundle) {
+		var pub interface{}
+		var err error
+		if strings.HasPrefix(line, AgeRecipientHrp+"1") {
+			pub, err = ParseAgeRecipient(line)
+		} else {
+			var blob []byte
+			if blob, _, err = ParseSshAuthorizedKey([]byte(line)); err == nil {
+				pub, err = ParseSshPublicKey(blob)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		r, err := NewAgeRecipient(pub)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("public key error")
+	}
+	return list, nil
+}
+
+// Identities in bundle: PEM and openssh private keys and AGE-SECRET-KEY-1
+// lines, as age-keygen writes them
+func AgeIdentities(bundle []byte) []AgeIdentity {
+	var list []AgeIdentity
+	keys, _ := pemKeys(bundle, true)
+	for _, kf := range keys {
+		if id := NewAgeIdentity(kf.Private); id != nil {
+			list = append(list, id)
+		}
+	}
+	for _, line := range bundleTextLines(bundle) {
+		if priv, err := ParseAgeIdentity(line); err == nil {
+			list = append(list, &ageX25519Identity{priv: priv})
+		}
+	}
+	return list
+}
+
+// Passphrase recipient or identity, from BITCRYPT_PASSPHRASE
+func NewAgePassphrase() (*ageScrypt, error) {
+	pass := os.Getenv("BITCRYPT_PASSPHRASE")
+	if pass == "" {
+		return nil, errors.New("BITCRYPT_PASSPHRASE isn't set")
+	}
+	return &ageScrypt{passphrase: []byte(pass)}, nil
+}
+
+// HMAC key of the header and ChaCha20-Poly1305 of the payload
+func ageHeaderMac(fileKey, header []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nil, "header", 32)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	return mac.Sum(nil), nil
+}
+
+func agePayloadAead(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, "payload", chachaKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return NewChaCha20Poly1305(key)
+}
+
+// Header wrapping fileKey for recipients, with its MAC line
+func ageHeader(fileKey []byte, recipients []AgeRecipient) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(ageVersionLine + "\n")
+	for _, r := range recipients {
+		s, err := r.Wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(strings.Join(append([]string{"->", s.Type}, s.Args...), " ") + "\n")
+		body := ageB64.EncodeToString(s.Body)
+		for ; len(body) >= ageColumns; body = body[ageColumns:] {
+			buf.WriteString(body[:ageColumns] + "\n")
+		}
+		buf.WriteString(body + "\n")
+	}
+	buf.WriteString("---")
+	mac, err := ageHeaderMac(fileKey, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(" " + ageB64.EncodeToString(mac) + "\n")
+	return buf.Bytes(), nil
+}
+
+// Parse the header at r, giving its stanzas, the text its MAC covers and
+// the MAC
+func readAgeHeader(r *bufio.Reader) ([]*AgeStanza, []byte, []byte, error) {
+	raw := new(bytes.Buffer)
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", errors.New("age header truncated")
+		}
+		return line[:len(line)-1], nil
+	}
+	invalid := errors.New("invalid age header")
+
+	line, err := readLine()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if line != ageVersionLine {
+		return nil, nil, nil, errors.New("unsupported age version " + line)
+	}
+	raw.WriteString(line + "\n")
+
+	var stanzas []*AgeStanza
+	for {
+		if line, err = readLine(); err != nil {
+			return nil, nil, nil, err
+		}
+		if strings.HasPrefix(line, "--- ") {
+			mac, err := ageB64.DecodeString(line[4:])
+			if err != nil || len(mac) != sha256.Size {
+				return nil, nil, nil, invalid
+			}
+			raw.WriteString("---")
+			return stanzas, raw.Bytes(), mac, nil
+		}
+		if !strings.HasPrefix(line, "-> ") {
+			return nil, nil, nil, invalid
+		}
+		args := strings.Split(line[3:], " ")
+		for _, a := range args {
+			if a == "" || strings.IndexFunc(a, func(c rune) bool { return c < 33 || c > 126 }) >= 0 {
+				return nil, nil, nil, invalid
+			}
+		}
+		raw.WriteString(line + "\n")
+
+		s := &AgeStanza{Type: args[0], Args: args[1:]}
+		for {
+			if line, err = readLine(); err != nil {
+				return nil, nil, nil, err
+			}
+			b, err := ageB64.DecodeString(line)
+			if err != nil || len(line) > ageColumns {
+				return nil, nil, nil, invalid
+			}
+			raw.WriteString(line + "\n")
+			s.Body = append(s.Body, b...)
+			if len(line) < ageColumns {
+				break
+			}
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+// File key of stanzas for the first identity that has one
+func ageUnwrap(stanzas []*AgeStanza, identities []AgeIdentity) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type == "scrypt" && len(stanzas) != 1 {
+			return nil, errors.New("age scrypt stanza must be the only one")
+		}
+	}
+	for _, id := range identities {
+		for _, s := range stanzas {
+			fileKey, err := id.Unwrap(s)
+			if err == errAgeNoMatch {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(fileKey) != ageFileKeySize {
+				return nil, errors.New("invalid age file key")
+			}
+			return fileKey, nil
+		}
+	}
+	return nil, errors.New("no identity matches any recipient of the age file")
+}
+
+// Nonce of chunk counter, the last chunk flagged
+func ageChunkNonce(nonce *[chachaNonceSize]byte, counter uint64, last bool) {
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	nonce[11] = 0
+	if last {
+		nonce[11] = 1
+	}
+}
+
+func ageEncryptStream(r *bufio.Reader, w io.Writer, aead cipher.AEAD) error {
+	var nonce [chachaNonceSize]byte
+	buf := make([]byte, ageChunkSize+poly1305TagSize)
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, buf[:ageChunkSize])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < ageChunkSize
+		if !last {
+			if _, err = r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		ageChunkNonce(&nonce, counter, last)
+		if _, err = w.Write(aead.Seal(buf[:0], nonce[:], buf[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func ageDecryptStream(r *bufio.Reader, w io.Writer, aead cipher.AEAD) error {
+	var nonce [chachaNonceSize]byte
+	buf := make([]byte, ageChunkSize+poly1305TagSize)
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(buf)
+		if !last {
+			if _, err = r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n < poly1305TagSize || last && counter > 0 && n == poly1305TagSize {
+			return errors.New("age payload truncated")
+		}
+		ageChunkNonce(&nonce, counter, last)
+		plain, err := aead.Open(buf[:0], nonce[:], buf[:n], nil)
+		if err != nil {
+			return errors.New("age payload authentication failed")
+		}
+		if _, err = w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Writes base64 lines of ageColumns between the armor lines
+type ageArmorWriter struct {
+	w    io.Writer
+	enc  io.WriteCloser
+	col  int
+	fail error
+}
+
+func newAgeArmorWriter(w io.Writer) (*ageArmorWriter, error) {
+	if _, err := io.WriteString(w, ageArmorBegin+"\n"); err != nil {
+		return nil, err
+	}
+	a := &ageArmorWriter{w: w}
+	a.enc = base64.NewEncoder(base64.StdEncoding, ageLineWriter{a})
+	return a, nil
+}
+
+type ageLineWriter struct {
+	a *ageArmorWriter
+}
+
+func (l ageLineWriter) Write(p []byte) (int, error) {
+	a := l.a
+	for i := range p {
+		if a.col == ageColumns {
+			if _, err := a.w.Write([]byte{'\n'}); err != nil {
+				return i, err
+			}
+			a.col = 0
+		}
+		if _, err := a.w.Write(p[i : i+1]); err != nil {
+			return i, err
+		}
+		a.col++
+	}
+	return len(p), nil
+}
+
+func (a *ageArmorWriter) Write(p []byte) (int, error) {
+	return a.enc.Write(p)
+}
+
+func (a *ageArmorWriter) Close() error {
+	if err := a.enc.Close(); err != nil {
+		return err
+	}
+	end := ageArmorEnd + "\n"
+	if a.col > 0 {
+		end = "\n" + end
+	}
+	_, err := io.WriteString(a.w, end)
+	return err
+}
+
+// Reads the data of an armored age file: base64 lines of ageColumns, the
+// last one shorter or followed by the end line, and nothing but whitespace
+// around
+type ageArmorReader struct {
+	r      *bufio.Reader
+	unread []byte
+	done   bool
+}
+
+func (a *ageArmorReader) line() (string, error) {
+	line, err := a.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("age armor truncated")
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func newAgeArmorReader(r *bufio.Reader) (*ageArmorReader, error) {
+	a := &ageArmorReader{r: r}
+	for skipped := 0; ; {
+		line, err := a.line()
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(line) != "" {
+			if line != ageArmorBegin {
+				return nil, errors.New("invalid age armor")
+			}
+			return a, nil
+		}
+		if skipped += len(line) + 1; skipped > 1024 {
+			return nil, errors.New("invalid age armor")
+		}
+	}
+}
+
+// Only whitespace may follow the end line
+func (a *ageArmorReader) end() error {
+	rest, err := io.ReadAll(io.LimitReader(a.r, 1024))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(rest)) != 0 || len(rest) == 1024 {
+		return errors.New("data after age armor")
+	}
+	a.done = true
+	return nil
+}
+
+func (a *ageArmorReader) Read(p []byte) (int, error) {
+	for len(a.unread) == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		line, err := a.line()
+		if err != nil {
+			return 0, err
+		}
+		if line == ageArmorEnd {
+			if err = a.end(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		data, err := base64.StdEncoding.Strict().DecodeString(line)
+		if err != nil || len(line) > ageColumns {
+			return 0, errors.New("invalid age armor")
+		}
+		if len(line) < ageColumns {
+			if line, err = a.line(); err != nil {
+				return 0, err
+			}
+			if line != ageArmorEnd {
+				return 0, errors.New("invalid age armor")
+			}
+			if err = a.end(); err != nil {
+				return 0, err
+			}
+		}
+		a.unread = data
+	}
+	n := copy(p, a.unread)
+	a.unread = a.unread[n:]
+	return n, nil
+}
+
+// Whether inPath is an age file, armored or not
+func IsAgeFile(inPath string) bool {
+	f, err := os.Open(inPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(f, head)
+	text := string(head[:n])
+	return strings.HasPrefix(text, "age-encryption.org/") || strings.HasPrefix(strings.TrimSpace(text), ageArmorBegin)
+}
+
+// Encrypt inPath into the age file outPath for recipients, ASCII armored
+// if armor
+func EncryptFileAge(inPath, outPath string, recipients []AgeRecipient, armor bool) (err error) {
+	if IsSameFile(inPath, outPath) {
+		return errors.New("output file is the input file")
+	}
+	if len(recipients) == 0 {
+		return errors.New("public key error")
+	}
+
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	fileKey := make([]byte, ageFileKeySize)
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(fileKey); err != nil {
+		return err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	hdr, err := ageHeader(fileKey, recipients)
+	if err != nil {
+		return err
+	}
+	aead, err := agePayloadAead(fileKey, nonce)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := CreateTempFile(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			AbortTempFile(outFile)
+		}
+	}()
+
+	bw := bufio.NewWriterSize(outFile, ageChunkSize)
+	var w io.Writer = bw
+	var aw *ageArmorWriter
+	if armor {
+		if aw, err = newAgeArmorWriter(bw); err != nil {
+			return err
+		}
+		w = aw
+	}
+	if _, err = w.Write(append(hdr, nonce...)); err != nil {
+		return err
+	}
+	if err = ageEncryptStream(bufio.NewReaderSize(inFile, ageChunkSize), w, aead); err != nil {
+		return err
+	}
+	if aw != nil {
+		if err = aw.Close(); err != nil {
+			return err
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	outFile.Chmod(inInfo.Mode())
+	return CommitTempFile(outFile, outPath)
+}
+
+// EncryptFile in the age format, for the keys in bundle or the passphrase
+func encryptFileAge(inPath, outPath string, bundle []byte) error {
+	if AgePassphrase {
+		p, err := NewAgePassphrase()
+		if err != nil {
+			return err
+		}
+		return EncryptFileAge(inPath, outPath, []AgeRecipient{p}, ArmorOutput)
+	}
+	recipients, err := AgeRecipients(bundle)
+	if err != nil {
+		return err
+	}
+	return EncryptFileAge(inPath, outPath, recipients, ArmorOutput)
+}
+
+// DecryptFile of an age file, with the keys in bundle and the passphrase
+// if set
+func decryptFileAge(inPath, outPath string, bundle []byte) error {
+	identities := AgeIdentities(bundle)
+	if p, err := NewAgePassphrase(); err == nil {
+		identities = append(identities, p)
+	}
+	return DecryptFileAge(inPath, outPath, identities)
+}
+
+// Decrypt the age file inPath, armored or not, with the first of
+// identities that a recipient stanza is for
+func DecryptFileAge(inPath, outPath string, identities []AgeIdentity) (err error) {
+	if IsSameFile(inPath, outPath) {
+		return errors.New("output file is the input file")
+	}
+
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	r := bufio.NewReaderSize(inFile, ageChunkSize)
+	if head, _ := r.Peek(len(ageVersionLine)); string(head) != ageVersionLine {
+		ar, err := newAgeArmorReader(r)
+		if err != nil {
+			return err
+		}
+		r = bufio.NewReaderSize(ar, ageChunkSize)
+	}
+
+	stanzas, header, mac, err := readAgeHeader(r)
+	if err != nil {
+		return err
+	}
+	fileKey, err := ageUnwrap(stanzas, identities)
+	if err != nil {
+		return err
+	}
+	want, err := ageHeaderMac(fileKey, header)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, want) {
+		return errors.New("age header MAC check failed")
+	}
+	nonce := make([]byte, 16)
+	if _, err = io.ReadFull(r, nonce); err != nil {
+		return errors.New("age payload truncated")
+	}
+	aead, err := agePayloadAead(fileKey, nonce)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := CreateTempFile(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			AbortTempFile(outFile)
+		}
+	}()
+
+	bw := bufio.NewWriterSize(outFile, ageChunkSize)
+	if err = ageDecryptStream(r, bw, aead); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	outFile.Chmod(inInfo.Mode())
+	return CommitTempFile(outFile, outPath)
+}
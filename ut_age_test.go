@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs the age test vectors of c2sp.org/CCTV/age in testdata/age: each
+// file has "key: value" lines, a blank line and the age file
+func TestAgeTestkit(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "age", "*"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("no age test vectors", err)
+	}
+
+	tmp := t.TempDir()
+	for _, file := range files {
+		name := filepath.Base(file)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := bytes.Index(data, []byte("\n\n"))
+		if i < 0 {
+			t.Fatalf("%s: no blank line after the vector header", name)
+		}
+
+		var expect, payload string
+		var identities []AgeIdentity
+		for _, line := range strings.Split(string(data[:i]), "\n") {
+			key, value, _ := strings.Cut(line, ": ")
+			switch key {
+			case "expect":
+				expect = value
+			case "payload":
+				payload = value
+			case "identity":
+				identities = append(identities, AgeIdentities([]byte(value))...)
+			case "passphrase":
+				identities = append(identities, &ageScrypt{passphrase: []byte(value)})
+			}
+		}
+
+		inPath := filepath.Join(tmp, name+".age")
+		outPath := filepath.Join(tmp, name)
+		if err = os.WriteFile(inPath, data[i+2:], 0600); err != nil {
+			t.Fatal(err)
+		}
+		err = DecryptFileAge(inPath, outPath, identities)
+
+		switch {
+		case expect == "success" && err != nil:
+			t.Errorf("%s: %v", name, err)
+		case expect == "success":
+			plain, _ := os.ReadFile(outPath)
+			if sum := sha256.Sum256(plain); hex.EncodeToString(sum[:]) != payload {
+				t.Errorf("%s: payload doesn't match", name)
+			}
+		case err == nil:
+			t.Errorf("%s: decrypted, want %s", name, expect)
+		case IsFileExist(outPath):
+			t.Errorf("%s: output left after %v", name, err)
+		case expect == "HMAC failure" && !strings.Contains(err.Error(), "MAC"):
+			t.Errorf("%s: %v, want a MAC failure", name, err)
+		case expect == "no match" && !strings.Contains(err.Error(), "no identity matches") &&
+			!strings.Contains(err.Error(), "incorrect passphrase"):
+			t.Errorf("%s: %v, want no match", name, err)
+		}
+	}
+}
+
+// Writes an age file for recipients with the given chunks of payload, each
+// flagged last or not, to make streams that EncryptFileAge never writes
+func writeAgeChunks(t *testing.T, path string, recipients []AgeRecipient, chunks [][]byte, last []bool) {
+	t.Helper()
+	fileKey := make([]byte, ageFileKeySize)
+	nonce := make([]byte, 16)
+	rand.Read(fileKey)
+	rand.Read(nonce)
+	hdr, err := ageHeader(fileKey, recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := agePayloadAead(fileKey, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := append(hdr, nonce...)
+	var chunkNonce [chachaNonceSize]byte
+	for i, chunk := range chunks {
+		ageChunkNonce(&chunkNonce, uint64(i), last[i])
+		out = aead.Seal(out, chunkNonce[:], chunk, nil)
+	}
+	if err = os.WriteFile(path, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgeNegative(t *testing.T) {
+	const id = "AGE-SECRET-KEY-1XMWWC06LY3EE5RYTXM9MFLAZ2U56JJJ36S0MYPDRWSVLUL66MV4QX3S7F6"
+	identities := AgeIdentities([]byte(id))
+	priv, err := ParseAgeIdentity(id)
+	if err != nil || len(identities) != 1 {
+		t.Fatal("age identity", err)
+	}
+	recipients, err := AgeRecipients([]byte(AgeRecipientString(priv.PublicKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := t.TempDir()
+	plainPath := filepath.Join(tmp, "plain")
+	plain := make([]byte, ageChunkSize+1000)
+	rand.Read(plain)
+	if err = os.WriteFile(plainPath, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	encPath := filepath.Join(tmp, "plain.age")
+	if err = EncryptFileAge(plainPath, encPath, recipients, false); err != nil {
+		t.Fatal(err)
+	}
+	enc, _ := os.ReadFile(encPath)
+
+	decrypt := func(data []byte) error {
+		inPath := filepath.Join(tmp, "in.age")
+		outPath := filepath.Join(tmp, "out")
+		os.Remove(outPath)
+		if err := os.WriteFile(inPath, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := DecryptFileAge(inPath, outPath, identities)
+		if err != nil && IsFileExist(outPath) {
+			t.Errorf("output left after %v", err)
+		}
+		return err
+	}
+	if err = decrypt(enc); err != nil {
+		t.Fatal(err)
+	}
+
+	// the MAC line of the header with one bit flipped
+	i := bytes.Index(enc, []byte("\n--- ")) + 5
+	j := i + bytes.IndexByte(enc[i:], '\n')
+	mac, err := ageB64.DecodeString(string(enc[i:j]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac[0] ^= 1
+	badMac := append(append(append([]byte(nil), enc[:i]...), ageB64.EncodeToString(mac)...), enc[j:]...)
+	if err = decrypt(badMac); err == nil || !strings.Contains(err.Error(), "MAC") {
+		t.Errorf("bad header MAC: %v", err)
+	}
+
+	// the final chunk cut short, or left out
+	if err = decrypt(enc[:len(enc)-1]); err == nil {
+		t.Error("truncated final chunk decrypted")
+	}
+	if err = decrypt(enc[:len(enc)-1000-poly1305TagSize]); err == nil {
+		t.Error("file without its final chunk decrypted")
+	}
+
+	// an empty final chunk is only valid for an empty payload
+	full := plain[:ageChunkSize]
+	writeAgeChunks(t, filepath.Join(tmp, "in.age"), recipients, [][]byte{full, nil}, []bool{false, true})
+	if err = DecryptFileAge(filepath.Join(tmp, "in.age"), filepath.Join(tmp, "out"), identities); err == nil {
+		t.Error("empty last chunk decrypted")
+	}
+	writeAgeChunks(t, filepath.Join(tmp, "in.age"), recipients, [][]byte{nil}, []bool{true})
+	if err = DecryptFileAge(filepath.Join(tmp, "in.age"), filepath.Join(tmp, "empty"), identities); err != nil {
+		t.Errorf("empty payload: %v", err)
+	}
+
+	// a scrypt stanza next to another one
+	defer func(logN int) { AgeScryptLogN = logN }(AgeScryptLogN)
+	AgeScryptLogN = 10
+	pass := &ageScrypt{passphrase: []byte("password")}
+	mixed := append([]AgeRecipient{pass}, recipients...)
+	writeAgeChunks(t, filepath.Join(tmp, "in.age"), mixed, [][]byte{[]byte("x")}, []bool{true})
+	for _, ids := range [][]AgeIdentity{{pass}, identities} {
+		err = DecryptFileAge(filepath.Join(tmp, "in.age"), filepath.Join(tmp, "out"), ids)
+		if err == nil || !strings.Contains(err.Error(), "scrypt") {
+			t.Errorf("scrypt stanza with another: %v", err)
+		}
+	}
+}
+
+// Encrypted and armored files read back the same
+func TestAgeRoundTrip(t *testing.T) {
+	defer func(logN int) { AgeScryptLogN = logN }(AgeScryptLogN)
+	AgeScryptLogN = 10
+
+	priv, err := ParseAgeIdentity("AGE-SECRET-KEY-1XMWWC06LY3EE5RYTXM9MFLAZ2U56JJJ36S0MYPDRWSVLUL66MV4QX3S7F6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass := &ageScrypt{passphrase: []byte("password")}
+	tmp := t.TempDir()
+	for _, size := range []int{0, 1, ageChunkSize, 2*ageChunkSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		plainPath := filepath.Join(tmp, "plain")
+		if err = os.WriteFile(plainPath, plain, 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, armor := range []bool{false, true} {
+			for _, rcp := range []AgeRecipient{&ageX25519Recipient{pub: priv.PublicKey()}, pass} {
+				encPath, outPath := filepath.Join(tmp, "plain.age"), filepath.Join(tmp, "out")
+				os.Remove(encPath)
+				os.Remove(outPath)
+				if err = EncryptFileAge(plainPath, encPath, []AgeRecipient{rcp}, armor); err != nil {
+					t.Fatal(err)
+				}
+				if !IsAgeFile(encPath) {
+					t.Errorf("size %d armor %v: not an age file", size, armor)
+				}
+				ids := []AgeIdentity{&ageX25519Identity{priv: priv}, pass}
+				if err = DecryptFileAge(encPath, outPath, ids); err != nil {
+					t.Fatalf("size %d armor %v: %v", size, armor, err)
+				}
+				if got, _ := os.ReadFile(outPath); !bytes.Equal(got, plain) {
+					t.Errorf("size %d armor %v: payload differs", size, armor)
+				}
+			}
+		}
+	}
+}
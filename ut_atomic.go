@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Outputs are written to ".<name>.bctmp-<random>" next to the target first
+const TempFileMark = ".bctmp-"
+
+// Temp files untouched for this long are left from an interrupted run,
+// younger ones may belong to a run still going
+const TempFileMaxAge = time.Hour
+
+func IsTempFile(name string) bool {
+	name = filepath.Base(name)
+	return strings.HasPrefix(name, ".") && strings.Contains(name, TempFileMark)
+}
+
+// Create a temp file in the directory of outPath, for CommitTempFile
+func CreateTempFile(outPath string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Dir(outPath), "."+filepath.Base(outPath)+TempFileMark)
+}
+
+// Close and remove an uncommitted temp file
+func AbortTempFile(tmpFile *os.File) {
+	tmpFile.Close()
+	os.Remove(tmpFile.Name())
+}
+
+// Fsync and close tmpFile, rename it over outPath and fsync the directory,
+// the temp file is removed if any step before the rename fails; outPath is
+// in place but might not survive a crash if the directory fsync fails
+func CommitTempFile(tmpFile *os.File, outPath string) error {
+	err := tmpFile.Sync()
+	if err != nil {
+		AbortTempFile(tmpFile)
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err = os.Rename(tmpFile.Name(), outPath); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err = SyncDir(filepath.Dir(outPath)); err != nil {
+		return fmt.Errorf("%s is written, but syncing its directory failed: %w", outPath, err)
+	}
+	return nil
+}
+
+// Fsync a directory so a rename in it is durable, a no-op on windows
+func SyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Atomically replace fileName with data
+func WriteFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmpFile, err := CreateTempFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmpFile.Write(data); err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if err != nil {
+		AbortTempFile(tmpFile)
+		return err
+	}
+	return CommitTempFile(tmpFile, fileName)
+}
+
+// Whether the temp file f is old enough to be left by an interrupted run
+func isStaleTempFile(f os.FileInfo) bool {
+	return !f.IsDir() && time.Since(f.ModTime()) > TempFileMaxAge
+}
+
+// Remove temp files left for outPath by an interrupted run
+func CleanTempFiles(outPath string) {
+	dir, err := os.Open(filepath.Dir(outPath))
+	if err != nil {
+		return
+	}
+	names, _ := dir.Readdirnames(-1)
+	dir.Close()
+
+	prefix := "." + filepath.Base(outPath) + TempFileMark
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(outPath), name)
+		if f, err := os.Lstat(path); err == nil && isStaleTempFile(f) {
+			os.Remove(path)
+		}
+	}
+}
+
+// Remove temp files left anywhere below dir by an interrupted run
+func CleanTempDir(dir string) {
+	filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if f != nil && IsTempFile(path) && isStaleTempFile(f) {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
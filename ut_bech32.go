@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Bech32 of BIP 173, as age writes its keys: no length limit, all upper or
+// all lower case
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	var out []byte
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+// Regroup data from frombits to tobits per value, padding the last one
+// if pad, else requiring it to be zero bits
+func bech32ConvertBits(data []byte, frombits, tobits uint, pad bool) ([]byte, error) {
+	var out []byte
+	acc, nbits := uint32(0), uint(0)
+	maxv := uint32(1)<<tobits - 1
+	for _, b := range data {
+		acc = acc<<frombits | uint32(b)
+		nbits += frombits
+		for nbits >= tobits {
+			nbits -= tobits
+			out = append(out, byte(acc>>nbits&maxv))
+		}
+	}
+	if pad {
+		if nbits > 0 {
+			out = append(out, byte(acc<<(tobits-nbits)&maxv))
+		}
+	} else if nbits >= frombits || acc<<(tobits-nbits)&maxv != 0 {
+		return nil, errors.New("invalid bech32 padding")
+	}
+	return out, nil
+}
+
+// Bech32 of data with human readable part hrp, upper case if hrp is
+func Bech32Encode(hrp string, data []byte) (string, error) {
+	values, err := bech32ConvertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	lower := strings.ToLower(hrp)
+	poly := bech32Polymod(append(append(bech32HrpExpand(lower), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var sb strings.Builder
+	sb.WriteString(lower + "1")
+	for _, v := range values {
+		sb.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[poly>>uint(5*(5-i))&31])
+	}
+	if hrp != lower {
+		return strings.ToUpper(sb.String()), nil
+	}
+	return sb.String(), nil
+}
+
+// Human readable part, lower case, and data of a bech32 string
+func Bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case bech32")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndex(s, "1")
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("invalid bech32 separator")
+	}
+	hrp := s[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, errors.New("invalid bech32 character")
+		}
+	}
+	var values []byte
+	for i := pos + 1; i < len(s); i++ {
+		v := strings.IndexByte(bech32Charset, s[i])
+		if v < 0 {
+			return "", nil, errors.New("invalid bech32 character")
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32HrpExpand(hrp), values...)) != 1 {
+		return "", nil, errors.New("invalid bech32 checksum")
+	}
+	data, err := bech32ConvertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
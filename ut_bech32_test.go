@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test vectors of BIP 173
+func TestBech32Valid(t *testing.T) {
+	for _, s := range []string{
+		"A12UEL5L",
+		"a12uel5l",
+		"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"11" + strings.Repeat("q", 82) + "c8247j",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+		"?1ezyfcl",
+	} {
+		hrp, data, err := Bech32Decode(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if strings.ToUpper(s) == s {
+			hrp = strings.ToUpper(hrp)
+		}
+		got, err := Bech32Encode(hrp, data)
+		if err != nil || got != s {
+			t.Errorf("%s encodes back as %s, %v", s, got, err)
+		}
+	}
+}
+
+// The 90 character limit of BIP 173 is left out, as age keys are longer
+func TestBech32Invalid(t *testing.T) {
+	for _, s := range []string{
+		"\x201nwldj5",   // hrp character out of range
+		"\x7f1axkwrx",   // hrp character out of range
+		"\x801eym55h",   // hrp character out of range
+		"pzry9x0s0muk",  // no separator
+		"1pzry9x0s0muk", // empty hrp
+		"x1b4n0q5v",     // invalid data character
+		"li1dgmt3",      // too short checksum
+		"de1lg7wt\xff",  // invalid character in checksum
+		"A1G7SGD8",      // checksum of the upper case hrp
+		"10a06t8",       // empty hrp
+		"1qzzfhee",      // empty hrp
+		"A12uEL5L",      // mixed case
+	} {
+		if _, _, err := Bech32Decode(s); err == nil {
+			t.Errorf("%q decoded", s)
+		}
+	}
+}
+
+func TestBech32AgeKeys(t *testing.T) {
+	// from the age testkit
+	id := "AGE-SECRET-KEY-1XMWWC06LY3EE5RYTXM9MFLAZ2U56JJJ36S0MYPDRWSVLUL66MV4QX3S7F6"
+	priv, err := ParseAgeIdentity(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := AgeIdentityString(priv); got != id {
+		t.Errorf("identity encodes back as %s", got)
+	}
+	rcp := AgeRecipientString(priv.PublicKey())
+	pub, err := ParseAgeRecipient(rcp)
+	if err != nil || !pub.Equal(priv.PublicKey()) {
+		t.Errorf("recipient %s doesn't parse back: %v", rcp, err)
+	}
+	if _, err = ParseAgeRecipient(strings.ToUpper(rcp[:len(rcp)-1]) + "Q"); err == nil {
+		t.Error("recipient with a bad checksum parsed")
+	}
+}
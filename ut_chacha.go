@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// ChaCha20-Poly1305 of RFC 8439, which the age format needs; the standard
+// library only uses its own inside crypto/tls and crypto/hpke
+
+const (
+	chachaKeySize   = 32
+	chachaNonceSize = 12
+	poly1305TagSize = 16
+)
+
+type chacha20Poly1305 struct {
+	key [chachaKeySize]byte
+}
+
+func NewChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if len(key) != chachaKeySize {
+		return nil, errors.New("chacha20poly1305 needs a 32 byte key")
+	}
+	c := new(chacha20Poly1305)
+	copy(c.key[:], key)
+	return c, nil
+}
+
+func (c *chacha20Poly1305) NonceSize() int { return chachaNonceSize }
+func (c *chacha20Poly1305) Overhead() int  { return poly1305TagSize }
+
+func (c *chacha20Poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != chachaNonceSize {
+		panic("chacha20poly1305: bad nonce length")
+	}
+	ret, out := growSlice(dst, len(plaintext)+poly1305TagSize)
+	chachaXor(&c.key, nonce, 1, out, plaintext)
+	tag := c.tag(nonce, additionalData, out[:len(plaintext)])
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (c *chacha20Poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != chachaNonceSize {
+		panic("chacha20poly1305: bad nonce length")
+	}
+	if len(ciphertext) < poly1305TagSize {
+		return nil, errors.New("chacha20poly1305: message authentication failed")
+	}
+	ct, tag := ciphertext[:len(ciphertext)-poly1305TagSize], ciphertext[len(ciphertext)-poly1305TagSize:]
+	want := c.tag(nonce, additionalData, ct)
+	if subtle.ConstantTimeCompare(want[:], tag) != 1 {
+		return nil, errors.New("chacha20poly1305: message authentication failed")
+	}
+	ret, out := growSlice(dst, len(ct))
+	chachaXor(&c.key, nonce, 1, out, ct)
+	return ret, nil
+}
+
+// Poly1305 of additionalData and ct, keyed by the first block of the stream
+func (c *chacha20Poly1305) tag(nonce, additionalData, ct []byte) [poly1305TagSize]byte {
+	var block [64]byte
+	chachaBlock(&c.key, nonce, 0, &block)
+	p := newPoly1305(block[:32])
+	p.write(additionalData, true)
+	p.write(ct, true)
+	var lens [16]byte
+	binary.LittleEndian.PutUint64(lens[:8], uint64(len(additionalData)))
+	binary.LittleEndian.PutUint64(lens[8:], uint64(len(ct)))
+	p.write(lens[:], false)
+	return p.sum()
+}
+
+// dst extended by n bytes, and those n bytes
+func growSlice(dst []byte, n int) ([]byte, []byte) {
+	total := len(dst) + n
+	if cap(dst) >= total {
+		return dst[:total], dst[len(dst):total]
+	}
+	ret := make([]byte, total)
+	copy(ret, dst)
+	return ret, ret[len(dst):]
+}
+
+func chachaQuarter(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b
+	d = bits.RotateLeft32(d^a, 16)
+	c += d
+	b = bits.RotateLeft32(b^c, 12)
+	a += b
+	d = bits.RotateLeft32(d^a, 8)
+	c += d
+	b = bits.RotateLeft32(b^c, 7)
+	return a, b, c, d
+}
+
+// Keystream block counter of key and nonce
+func chachaBlock(key *[chachaKeySize]byte, nonce []byte, counter uint32, out *[64]byte) {
+	var s [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		s[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	s[12] = counter
+	s[13] = binary.LittleEndian.Uint32(nonce[0:])
+	s[14] = binary.LittleEndian.Uint32(nonce[4:])
+	s[15] = binary.LittleEndian.Uint32(nonce[8:])
+
+	x := s
+	for i := 0; i < 10; i++ {
+		x[0], x[4], x[8], x[12] = chachaQuarter(x[0], x[4], x[8], x[12])
+		x[1], x[5], x[9], x[13] = chachaQuarter(x[1], x[5], x[9], x[13])
+		x[2], x[6], x[10], x[14] = chachaQuarter(x[2], x[6], x[10], x[14])
+		x[3], x[7], x[11], x[15] = chachaQuarter(x[3], x[7], x[11], x[15])
+		x[0], x[5], x[10], x[15] = chachaQuarter(x[0], x[5], x[10], x[15])
+		x[1], x[6], x[11], x[12] = chachaQuarter(x[1], x[6], x[11], x[12])
+		x[2], x[7], x[8], x[13] = chachaQuarter(x[2], x[7], x[8], x[13])
+		x[3], x[4], x[9], x[14] = chachaQuarter(x[3], x[4], x[9], x[14])
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+s[i])
+	}
+}
+
+// XOR src with the keystream from block counter on into dst
+func chachaXor(key *[chachaKeySize]byte, nonce []byte, counter uint32, dst, src []byte) {
+	var block [64]byte
+	for len(src) > 0 {
+		chachaBlock(key, nonce, counter, &block)
+		counter++
+		n := subtle.XORBytes(dst, src, block[:])
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// Poly1305 one-time authenticator, the accumulator h in three 64-bit limbs
+// reduced modulo 2^130-5 after each 16-byte block
+type poly1305 struct {
+	r0, r1     uint64
+	s0, s1     uint64
+	h0, h1, h2 uint64
+}
+
+func newPoly1305(key []byte) *poly1305 {
+	return &poly1305{
+		r0: binary.LittleEndian.Uint64(key[0:]) & 0x0ffffffc0fffffff,
+		r1: binary.LittleEndian.Uint64(key[8:]) & 0x0ffffffc0ffffffc,
+		s0: binary.LittleEndian.Uint64(key[16:]),
+		s1: binary.LittleEndian.Uint64(key[24:]),
+	}
+}
+
+// Add msg in 16-byte blocks, a short last block zero padded if pad (as
+// the AEAD construction does) or else ended by a 1 byte
+func (p *poly1305) write(msg []byte, pad bool) {
+	for len(msg) > 0 {
+		var block [16]byte
+		hibit := uint64(1)
+		n := copy(block[:], msg)
+		msg = msg[n:]
+		if n < 16 && !pad {
+			block[n] = 1
+			hibit = 0
+		}
+
+		var c uint64
+		p.h0, c = bits.Add64(p.h0, binary.LittleEndian.Uint64(block[0:]), 0)
+		p.h1, c = bits.Add64(p.h1, binary.LittleEndian.Uint64(block[8:]), c)
+		p.h2 += c + hibit
+
+		// h * r, h2 is at most 7 and r below 2^124 so the products fit
+		h0r0hi, h0r0lo := bits.Mul64(p.h0, p.r0)
+		h1r0hi, h1r0lo := bits.Mul64(p.h1, p.r0)
+		h0r1hi, h0r1lo := bits.Mul64(p.h0, p.r1)
+		h1r1hi, h1r1lo := bits.Mul64(p.h1, p.r1)
+		h2r0 := p.h2 * p.r0
+		h2r1 := p.h2 * p.r1
+
+		m1lo, c := bits.Add64(h1r0lo, h0r1lo, 0)
+		m1hi, _ := bits.Add64(h1r0hi, h0r1hi, c)
+		m2lo, c := bits.Add64(h2r0, h1r1lo, 0)
+		m2hi, _ := bits.Add64(0, h1r1hi, c)
+
+		t0 := h0r0lo
+		t1, c := bits.Add64(m1lo, h0r0hi, 0)
+		t2, c := bits.Add64(m2lo, m1hi, c)
+		t3, _ := bits.Add64(h2r1, m2hi, c)
+
+		// t = t mod 2^130 + 5 * (t >> 130), as 4 * (t >> 130) + (t >> 130)
+		p.h0, p.h1, p.h2 = t0, t1, t2&3
+		cc0, cc1 := t2&^3, t3
+		p.h0, c = bits.Add64(p.h0, cc0, 0)
+		p.h1, c = bits.Add64(p.h1, cc1, c)
+		p.h2 += c
+		cc0, cc1 = cc0>>2|cc1<<62, cc1>>2
+		p.h0, c = bits.Add64(p.h0, cc0, 0)
+		p.h1, c = bits.Add64(p.h1, cc1, c)
+		p.h2 += c
+	}
+}
+
+func (p *poly1305) sum() [poly1305TagSize]byte {
+	// h mod 2^130-5, then plus s
+	g0, b := bits.Sub64(p.h0, 0xfffffffffffffffb, 0)
+	g1, b := bits.Sub64(p.h1, 0xffffffffffffffff, b)
+	_, b = bits.Sub64(p.h2, 3, b)
+	mask := b - 1 // all ones if h >= 2^130-5
+	h0 := p.h0&^mask | g0&mask
+	h1 := p.h1&^mask | g1&mask
+
+	var c uint64
+	h0, c = bits.Add64(h0, p.s0, 0)
+	h1, _ = bits.Add64(h1, p.s1, c)
+	var tag [poly1305TagSize]byte
+	binary.LittleEndian.PutUint64(tag[0:], h0)
+	binary.LittleEndian.PutUint64(tag[8:], h1)
+	return tag
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors of RFC 8439
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+var rfc8439Sunscreen = []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+
+func rfc8439Key() *[chachaKeySize]byte {
+	var key [chachaKeySize]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return &key
+}
+
+// 2.3.2
+func TestChaChaBlock(t *testing.T) {
+	var out [64]byte
+	chachaBlock(rfc8439Key(), unhex(t, "000000090000004a00000000"), 1, &out)
+	want := unhex(t, "10f1e7e4d13b5915500fdd1fa32071c4c7d1f4c733c068030422aa9ac3d46c4e"+
+		"d2826446079faa0914c2d705d98b02a2b5129cd1de164eb9cbd083e8a2503c4e")
+	if !bytes.Equal(out[:], want) {
+		t.Errorf("block %x, want %x", out, want)
+	}
+}
+
+// 2.4.2
+func TestChaChaXor(t *testing.T) {
+	got := make([]byte, len(rfc8439Sunscreen))
+	chachaXor(rfc8439Key(), unhex(t, "000000000000004a00000000"), 1, got, rfc8439Sunscreen)
+	want := unhex(t, "6e2e359a2568f98041ba0728dd0d6981e97e7aec1d4360c20a27afccfd9fae0b"+
+		"f91b65c5524733ab8f593dabcd62b3571639d624e65152ab8f530c359f0861d8"+
+		"07ca0dbf500d6a6156a38e088a22b65e52bc514d16ccf806818ce91ab7793736"+
+		"5af90bbf74a35be6b40b8eedf2785e42874d")
+	if !bytes.Equal(got, want) {
+		t.Errorf("ciphertext %x, want %x", got, want)
+	}
+}
+
+// 2.5.2
+func TestPoly1305(t *testing.T) {
+	p := newPoly1305(unhex(t, "85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b"))
+	p.write([]byte("Cryptographic Forum Research Group"), false)
+	tag := p.sum()
+	if want := unhex(t, "a8061dc1305136c6c22b8baf0c0127a9"); !bytes.Equal(tag[:], want) {
+		t.Errorf("tag %x, want %x", tag, want)
+	}
+}
+
+// 2.8.2
+func TestChaCha20Poly1305(t *testing.T) {
+	aead, err := NewChaCha20Poly1305(unhex(t, "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := unhex(t, "070000004041424344454647")
+	aad := unhex(t, "50515253c0c1c2c3c4c5c6c7")
+	want := unhex(t, "d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d6"+
+		"3dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b36"+
+		"92ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc"+
+		"3ff4def08e4b7a9de576d26586cec64b6116"+
+		"1ae10b594f09e26a7e902ecbd0600691")
+
+	ct := aead.Seal(nil, nonce, rfc8439Sunscreen, aad)
+	if !bytes.Equal(ct, want) {
+		t.Fatalf("sealed %x, want %x", ct, want)
+	}
+	pt, err := aead.Open(nil, nonce, ct, aad)
+	if err != nil || !bytes.Equal(pt, rfc8439Sunscreen) {
+		t.Fatalf("open: %v", err)
+	}
+
+	ct[len(ct)-1] ^= 1
+	if _, err = aead.Open(nil, nonce, ct, aad); err == nil {
+		t.Error("open of a bad tag succeeded")
+	}
+	ct[len(ct)-1] ^= 1
+	if _, err = aead.Open(nil, nonce, ct, aad[1:]); err == nil {
+		t.Error("open with other additional data succeeded")
+	}
+}
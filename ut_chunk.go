@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Plaintext bytes per chunk for the ctr and gcm payloads
+const AesChunkSize = 64 * 1024
+
+// Number of goroutines used for ctr and gcm payloads
+var AesWorkers = runtime.NumCPU()
+
+// Advance a CTR iv by blocks, the same way cipher.NewCTR counts
+func AesCtrIv(iv []byte, blocks uint64) []byte {
+	civ := make([]byte, len(iv))
+	copy(civ, iv)
+
+	for i := len(civ) - 1; i >= 0 && blocks > 0; i-- {
+		sum := uint64(civ[i]) + blocks&0xff
+		civ[i] = byte(sum)
+		blocks = blocks>>8 + sum>>8
+	}
+	return civ
+}
+
+// GCM nonce for chunk i, the chunk index is xored into the iv
+func AesGcmNonce(iv []byte, i int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, iv)
+
+	var idx [8]byte
+	binary.BigEndian.PutUint64(idx[:], uint64(i))
+	for j := 0; j < 8; j++ {
+		nonce[4+j] ^= idx[j]
+	}
+	return nonce
+}
+
+// GCM additional data, marks the final chunk against truncation
+func AesGcmAad(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Plaintext size of a gcm payload of csize bytes
+func AesGcmPlainSize(csize int64) (int64, error) {
+	full := int64(AesChunkSize + 16)
+	n := (csize + full - 1) / full
+	if n == 0 || csize-(n-1)*full < 16 {
+		return 0, errors.New("gcm payload truncated")
+	}
+	return csize - n*16, nil
+}
+
+// Run fn for chunks 0..n-1 on AesWorkers goroutines, each with its own buffer
+func aesChunkRun(n int64, fn func(i int64, buf []byte) error) error {
+	workers := AesWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if int64(workers) > n {
+		workers = int(n)
+	}
+
+	var next int64 = -1
+	var failed int32
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, AesChunkSize+16)
+			for atomic.LoadInt32(&failed) == 0 {
+				i := atomic.AddInt64(&next, 1)
+				if i >= n {
+					return
+				}
+				if err := fn(i, buf); err != nil {
+					once.Do(func() { firstErr = err })
+					atomic.StoreInt32(&failed, 1)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// Encrypt inFile from its current offset to outFile at its current offset,
+// chunk by chunk with pread/pwrite, ctp must be 2 (ctr) or 8 (gcm)
+func AesEncryptChunks(inFile, outFile *os.File, key, iv []byte, ctp int) error {
+	inOff, outOff, size, err := aesChunkOffsets(inFile, outFile)
+	if err != nil {
+		return err
+	}
+
+	var n, outSize int64
+	switch ctp {
+	case 2:
+		n = (size + AesChunkSize - 1) / AesChunkSize
+		outSize = size
+	case 8:
+		// an empty file still has one final chunk carrying the tag
+		n = (size + AesChunkSize - 1) / AesChunkSize
+		if n == 0 {
+			n = 1
+		}
+		outSize = size + n*16
+	default:
+		return errors.New("aes cipher type not chunked")
+	}
+
+	err = aesChunkRun(n, func(i int64, buf []byte) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+
+		l := int64(AesChunkSize)
+		if size-i*AesChunkSize < l {
+			l = size - i*AesChunkSize
+		}
+		if _, err := inFile.ReadAt(buf[:l], inOff+i*AesChunkSize); err != nil {
+			return err
+		}
+
+		if ctp == 2 {
+			stream := cipher.NewCTR(block, AesCtrIv(iv, uint64(i*AesChunkSize/aes.BlockSize)))
+			stream.XORKeyStream(buf[:l], buf[:l])
+			_, err = outFile.WriteAt(buf[:l], outOff+i*AesChunkSize)
+			return err
+		}
+
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		sealed := gcm.Seal(buf[:0], AesGcmNonce(iv, i), buf[:l], AesGcmAad(i == n-1))
+		_, err = outFile.WriteAt(sealed, outOff+i*(AesChunkSize+16))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = outFile.Seek(outOff+outSize, 0)
+	return err
+}
+
+// Decrypt a chunked payload written by AesEncryptChunks
+func AesDecryptChunks(inFile, outFile *os.File, key, iv []byte, ctp int) error {
+	inOff, outOff, csize, err := aesChunkOffsets(inFile, outFile)
+	if err != nil {
+		return err
+	}
+
+	var n, size int64
+	switch ctp {
+	case 2:
+		n = (csize + AesChunkSize - 1) / AesChunkSize
+		size = csize
+	case 8:
+		size, err = AesGcmPlainSize(csize)
+		if err != nil {
+			return err
+		}
+		n = (csize + AesChunkSize + 15) / (AesChunkSize + 16)
+	default:
+		return errors.New("aes cipher type not chunked")
+	}
+
+	err = aesChunkRun(n, func(i int64, buf []byte) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+
+		l := int64(AesChunkSize)
+		if size-i*AesChunkSize < l {
+			l = size - i*AesChunkSize
+		}
+
+		if ctp == 2 {
+			if _, err := inFile.ReadAt(buf[:l], inOff+i*AesChunkSize); err != nil {
+				return err
+			}
+			stream := cipher.NewCTR(block, AesCtrIv(iv, uint64(i*AesChunkSize/aes.BlockSize)))
+			stream.XORKeyStream(buf[:l], buf[:l])
+			_, err = outFile.WriteAt(buf[:l], outOff+i*AesChunkSize)
+			return err
+		}
+
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		if _, err := inFile.ReadAt(buf[:l+16], inOff+i*(AesChunkSize+16)); err != nil {
+			return err
+		}
+		plain, err := gcm.Open(buf[:0], AesGcmNonce(iv, i), buf[:l+16], AesGcmAad(i == n-1))
+		if err != nil {
+			return errors.New("gcm chunk authentication failed")
+		}
+		_, err = outFile.WriteAt(plain, outOff+i*AesChunkSize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = outFile.Seek(outOff+size, 0)
+	return err
+}
+
+// Current offsets of both files and the input bytes left to process
+func aesChunkOffsets(inFile, outFile *os.File) (int64, int64, int64, error) {
+	inOff, err := inFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	outOff, err := outFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if inInfo.Size() < inOff {
+		return 0, 0, 0, errors.New("input shorter than its header")
+	}
+	return inOff, outOff, inInfo.Size() - inOff, nil
+}
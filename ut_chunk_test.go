@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fixed key and an iv whose counter carries into the upper bytes
+var (
+	testChunkKey = bytes.Repeat([]byte{0x42}, 32)
+	testChunkIv  = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf0}
+)
+
+const testChunkHdr = "header" // payloads start after a header
+
+// Run a chunk function over data written after testChunkHdr, the output
+// after testChunkHdr too
+func runChunks(t *testing.T, fn func(in, out *os.File, key, iv []byte, ctp int) error, data []byte, ctp, workers int) ([]byte, error) {
+	t.Helper()
+	defer func(n int) { AesWorkers = n }(AesWorkers)
+	AesWorkers = workers
+
+	dir := t.TempDir()
+	inPath, outPath := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	if err := os.WriteFile(inPath, append([]byte(testChunkHdr), data...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(inPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	in.Seek(int64(len(testChunkHdr)), 0)
+	out.WriteString(testChunkHdr)
+
+	if err = fn(in, out, testChunkKey, testChunkIv, ctp); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:len(testChunkHdr)]) != testChunkHdr {
+		t.Fatal("header overwritten")
+	}
+	return b[len(testChunkHdr):], nil
+}
+
+func TestAesChunksWorkers(t *testing.T) {
+	for _, size := range []int{0, 1, AesChunkSize, 3*AesChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		for _, ctp := range []int{2, 8} {
+			one, err := runChunks(t, AesEncryptChunks, plain, ctp, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			many, err := runChunks(t, AesEncryptChunks, plain, ctp, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(one, many) {
+				t.Errorf("size %d type %d: output differs with the worker count", size, ctp)
+			}
+			back, err := runChunks(t, AesDecryptChunks, many, ctp, 3)
+			if err != nil || !bytes.Equal(back, plain) {
+				t.Errorf("size %d type %d: decrypt: %v", size, ctp, err)
+			}
+		}
+	}
+}
+
+// Chunked ctr is one CTR stream, as files of the unchunked code were written
+func TestAesChunksCtrStream(t *testing.T) {
+	plain := make([]byte, 5*AesChunkSize+17)
+	rand.Read(plain)
+	got, err := runChunks(t, AesEncryptChunks, plain, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := aes.NewCipher(testChunkKey)
+	want := make([]byte, len(plain))
+	cipher.NewCTR(block, testChunkIv).XORKeyStream(want, plain)
+	if !bytes.Equal(got, want) {
+		t.Error("chunked ctr differs from a single stream")
+	}
+}
+
+func TestAesChunksGcmReorder(t *testing.T) {
+	plain := make([]byte, 3*AesChunkSize+5)
+	rand.Read(plain)
+	enc, err := runChunks(t, AesEncryptChunks, plain, 8, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := AesChunkSize + 16
+
+	swapped := append([]byte(nil), enc...)
+	copy(swapped[:full], enc[full:2*full])
+	copy(swapped[full:2*full], enc[:full])
+	flipped := append([]byte(nil), enc...)
+	flipped[full+100] ^= 1
+
+	for name, data := range map[string][]byte{
+		"last chunk removed": enc[:3*full],
+		"chunks swapped":     swapped,
+		"bit flipped":        flipped,
+		"tag cut short":      enc[:len(enc)-1],
+	} {
+		if _, err = runChunks(t, AesDecryptChunks, data, 8, 4); err == nil {
+			t.Errorf("%s: decrypted", name)
+		}
+	}
+}
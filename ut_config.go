@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Per-project config file, looked up from the working directory upwards
+const ProjectConfigName = ".bitcrypt.toml"
+
+// Defaults for the command line. Each setting is taken from the first of:
+// flags, BITCRYPT_* environment variables, the project config, the user
+// config, built-in defaults; exclude patterns of all of them add up.
+type Config struct {
+	KeyDir     string   `json:"key_dir"`     // BITCRYPT_KEY_DIR
+	Keyring    string   `json:"keyring"`     // BITCRYPT_KEYRING
+	PrivateKey string   `json:"private_key"` // BITCRYPT_PRIVATE_KEY
+	Recipients []string `json:"recipients"`  // BITCRYPT_RECIPIENTS, key files or keyring aliases to encrypt for
+	Cipher     string   `json:"cipher"`      // BITCRYPT_CIPHER
+	KeyLen     int      `json:"key_length"`  // BITCRYPT_KEY_LENGTH
+	Excludes   []string `json:"exclude"`     // BITCRYPT_EXCLUDE
+	Workers    int      `json:"jobs"`        // BITCRYPT_JOBS
+
+	// PKCS#11 token holding a private key, -tags pkcs11 builds only
+	PKCS11Module string `json:"pkcs11_module"` // BITCRYPT_PKCS11_MODULE, module library path
+	PKCS11Slot   int    `json:"pkcs11_slot"`   // BITCRYPT_PKCS11_SLOT, -1 for the first token
+	PKCS11Label  string `json:"pkcs11_label"`  // BITCRYPT_PKCS11_LABEL, label of the key
+
+	Sources map[string]string `json:"sources"` // where each setting came from
+}
+
+// $XDG_CONFIG_HOME/bitcrypt, or the platform's equivalent
+func UserConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "bitcrypt")
+}
+
+// User config file, BITCRYPT_CONFIG overrides the default location
+func UserConfigFile() string {
+	if path := os.Getenv("BITCRYPT_CONFIG"); path != "" {
+		return path
+	}
+	if dir := UserConfigDir(); dir != "" {
+		return filepath.Join(dir, "config.toml")
+	}
+	return ""
+}
+
+// Nearest ProjectConfigName in dir or its parents, "" if none
+func FindProjectConfig(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, ProjectConfigName)
+		if IsFileExist(path) {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Config of a run in the working directory
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		KeyDir:  filepath.Join(UserConfigDir(), "keys"),
+		Keyring: filepath.Join(UserConfigDir(), "keyring"),
+		Cipher:  "cfb",
+		KeyLen:  32,
+		Workers: runtime.NumCPU(),
+		Sources: make(map[string]string),
+
+		PKCS11Slot: -1,
+	}
+
+	if path := UserConfigFile(); path != "" && IsFileExist(path) {
+		if err := cfg.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	wd, _ := os.Getwd()
+	if path := FindProjectConfig(wd); path != "" {
+		if err := cfg.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ReadEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Token key of the pkcs11_* settings, nil unless a module is set
+func (cfg *Config) Pkcs11Key() *Pkcs11Key {
+	if cfg.PKCS11Module == "" {
+		return nil
+	}
+	return &Pkcs11Key{Module: cfg.PKCS11Module, Slot: cfg.PKCS11Slot, Label: cfg.PKCS11Label}
+}
+
+// Apply the settings of a config file, relative paths in it are taken
+// relative to its directory
+func (cfg *Config) ReadFile(path string) error {
+	values, err := ParseToml(path)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	for key, value := range values {
+		if err = cfg.set(key, value, dir, path); err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	return nil
+}
+
+// Apply the BITCRYPT_* environment variables, lists are comma separated
+func (cfg *Config) ReadEnv() error {
+	for _, key := range []string{"key_dir", "keyring", "private_key", "recipients", "cipher", "key_length", "exclude", "jobs", "pkcs11_module", "pkcs11_slot", "pkcs11_label"} {
+		name := "BITCRYPT_" + strings.ToUpper(key)
+		s, ok := os.LookupEnv(name)
+		if !ok || s == "" {
+			continue
+		}
+
+		var value interface{} = s
+		switch key {
+		case "recipients", "exclude":
+			value = strings.Split(s, ",")
+		case "key_length", "jobs", "pkcs11_slot":
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return errors.New(name + " is not a number")
+			}
+			value = int64(n)
+		}
+		if err := cfg.set(key, value, "", name); err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) set(key string, value interface{}, dir, source string) error {
+	str, isStr := value.(string)
+	list, isList := value.([]string)
+	num, isNum := value.(int64)
+	path := func(p string) string {
+		if dir != "" && p != "" && !filepath.IsAbs(p) {
+			return filepath.Join(dir, p)
+		}
+		return p
+	}
+	// keyring aliases, fingerprints, vault and ssh-agent keys are left alone
+	keyName := func(p string) string {
+		if !strings.HasPrefix(p, VaultPrefix) && !strings.HasPrefix(p, SshAgentPrefix) && (strings.ContainsAny(p, `/\`) || strings.HasSuffix(p, ".pem")) {
+			return path(p)
+		}
+		return p
+	}
+
+	switch {
+	case key == "key_dir" && isStr:
+		cfg.KeyDir = path(str)
+	case key == "keyring" && isStr:
+		cfg.Keyring = path(str)
+	case key == "private_key" && isStr:
+		cfg.PrivateKey = path(str)
+	case key == "recipients" && isList:
+		cfg.Recipients = nil
+		for _, r := range list {
+			cfg.Recipients = append(cfg.Recipients, keyName(r))
+		}
+	case key == "recipients" && isStr:
+		cfg.Recipients = []string{keyName(str)}
+	case key == "cipher" && isStr:
+		if str != "cfb" && str != "ctr" && str != "ofb" && str != "gcm" {
+			return errors.New("cipher only valid for cfb, ctr, ofb, gcm")
+		}
+		cfg.Cipher = str
+	case key == "key_length" && isNum:
+		if num != 16 && num != 24 && num != 32 {
+			return errors.New("key_length only valid for 16, 24, 32")
+		}
+		cfg.KeyLen = int(num)
+	case key == "exclude" && isList:
+		cfg.Excludes = append(cfg.Excludes, list...)
+	case key == "exclude" && isStr:
+		cfg.Excludes = append(cfg.Excludes, str)
+	case key == "jobs" && isNum:
+		if num < 1 {
+			return errors.New("jobs must be at least 1")
+		}
+		cfg.Workers = int(num)
+	case key == "pkcs11_module" && isStr:
+		// a bare library name is for the dynamic loader to find
+		if strings.ContainsAny(str, `/\`) {
+			str = path(str)
+		}
+		cfg.PKCS11Module = str
+	case key == "pkcs11_slot" && isNum:
+		if num < -1 {
+			return errors.New("pkcs11_slot must be a slot ID, or -1 for the first token")
+		}
+		cfg.PKCS11Slot = int(num)
+	case key == "pkcs11_label" && isStr:
+		cfg.PKCS11Label = str
+	case key == "key_dir" || key == "keyring" || key == "private_key" || key == "recipients" || key == "cipher" ||
+		key == "key_length" || key == "exclude" || key == "jobs" ||
+		key == "pkcs11_module" || key == "pkcs11_slot" || key == "pkcs11_label":
+		return errors.New("wrong type for " + key)
+	default:
+		return errors.New("unknown setting " + key)
+	}
+
+	if key == "exclude" && cfg.Sources[key] != "" {
+		source = cfg.Sources[key] + ", " + source
+	}
+	cfg.Sources[key] = source
+	return nil
+}
+
+// Parse the subset of TOML a config file needs: key = value lines with
+// strings, integers, booleans and arrays of strings, and # comments. Values
+// are string, int64, bool or []string.
+func ParseToml(path string) (map[string]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]interface{})
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		bad := func(msg string) error {
+			return fmt.Errorf("%s:%d: %s", path, lineNo, msg)
+		}
+		if line[0] == '[' {
+			return nil, bad("tables are not supported")
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, bad("expected key = value")
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+		rest := strings.TrimSpace(line[eq+1:])
+
+		// an array may span lines
+		for strings.HasPrefix(rest, "[") && !tomlArrayClosed(rest) && scanner.Scan() {
+			lineNo++
+			rest += " " + strings.TrimSpace(scanner.Text())
+		}
+
+		value, rest, err := tomlValue(rest)
+		if err != nil {
+			return nil, bad(err.Error())
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+			return nil, bad("unexpected " + rest)
+		}
+		if _, ok := values[key]; ok {
+			return nil, bad("duplicate key " + key)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+func tomlArrayClosed(s string) bool {
+	_, _, err := tomlValue(s)
+	return err == nil
+}
+
+// Parse the value at the start of s, return it and what follows
+func tomlValue(s string) (interface{}, string, error) {
+	switch {
+	case s == "":
+		return nil, "", errors.New("missing value")
+	case s[0] == '"':
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return nil, "", errors.New("unterminated string")
+		}
+		str, err := strconv.Unquote(s[:end+1])
+		return str, s[end+1:], err
+	case s[0] == '\'':
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return nil, "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case s[0] == '[':
+		var list []string
+		s = strings.TrimSpace(s[1:])
+		for {
+			if s == "" {
+				return nil, "", errors.New("unterminated array")
+			}
+			if s[0] == ']' {
+				return list, s[1:], nil
+			}
+			value, rest, err := tomlValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			str, ok := value.(string)
+			if !ok {
+				return nil, "", errors.New("only arrays of strings are supported")
+			}
+			list = append(list, str)
+			s = strings.TrimSpace(rest)
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	word := s[:end]
+	switch word {
+	case "true":
+		return true, s[end:], nil
+	case "false":
+		return false, s[end:], nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(word, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, "", errors.New("bad value " + word)
+	}
+	return n, s[end:], nil
+}
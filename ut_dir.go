@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func IsDirExist(path string) bool {
@@ -23,20 +25,175 @@ func IsFileExist(path string) bool {
 	return err == nil || os.IsExist(err)
 }
 
-func EncryptDir(srcDir string, rsaPubKey []byte, aesBits int, aesCtp string) error {
+func IsSameFile(path1, path2 string) bool {
+	fi1, err := os.Stat(path1)
+	if err != nil {
+		return false
+	}
+	fi2, err := os.Stat(path2)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi1, fi2)
+}
+
+func IsDirEmpty(path string) bool {
+	dir, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer dir.Close()
+
+	names, _ := dir.Readdirnames(1)
+	return len(names) == 0
+}
+
+// Report whether path is dir itself or somewhere below it, following
+// symlinks of the parts that exist
+func IsInsideDir(dir, path string) bool {
+	dir, path = realPath(dir), realPath(path)
+	relPath, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
+func realPath(path string) string {
+	path, _ = filepath.Abs(path)
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path
+	}
+	return filepath.Join(realPath(parent), filepath.Base(path))
+}
+
+// Options for EncryptDir and DecryptDir, nil means all defaults
+type DirOptions struct {
+	Checksum bool // rehash every file instead of trusting the index
+	Mirror   bool // remove outputs whose source no longer exists
+	Trash    bool // with Mirror, move such outputs to the trash directory
+	DryRun   bool // with Mirror, only list such outputs
+
+	OutDir string // output directory instead of the default next to the source
+	Force  bool   // allow decrypting into a non-empty directory
+	Remove bool   // remove each source file once its output is verified
+	Shred  bool   // with Remove, overwrite the source file first
+
+	Threshold int // shares of each data key needed to decrypt, see WrapAesInfo
+
+	InPlace   bool // replace files inside the source directory, see ut_inplace.go
+	KeepGoing bool // journal failed files and go on with the rest
+
+	FollowLinks bool // encrypt what symlinks point to instead of keeping them as symlinks
+
+	Includes          []string // only files matching one of these patterns
+	Excludes          []string // patterns to leave out, after IgnoreFileName
+	NoDefaultExcludes bool     // don't start from DefaultExcludes
+
+	Progress ProgressFunc // called as files are done, see ut_progress.go
+}
+
+// Rules for a run over srcDir: defaults, then srcDir's ignore file, then opts
+func DirIgnoreRules(srcDir string, opts *DirOptions) (*IgnoreRules, error) {
+	rules := NewIgnoreRules(opts.NoDefaultExcludes)
+
+	ignFile := filepath.Join(srcDir, IgnoreFileName)
+	if IsFileExist(ignFile) {
+		if err := rules.AddFile(ignFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range opts.Excludes {
+		rules.AddExclude(pattern)
+	}
+	for _, pattern := range opts.Includes {
+		rules.AddInclude(pattern)
+	}
+	return rules, nil
+}
+
+func EncryptDir(srcDir string, rsaPubKey []byte, aesBits int, aesCtp string, opts *DirOptions) error {
+	if opts == nil {
+		opts = new(DirOptions)
+	}
+	if opts.InPlace {
+		return EncryptDirInPlace(srcDir, rsaPubKey, aesBits, aesCtp, opts)
+	}
+
 	srcDir, err := filepath.Abs(srcDir)
 	if err != nil {
 		return err
 	}
 
 	dstDir := filepath.Join(filepath.Dir(srcDir), filepath.Base(srcDir)+"_enc")
+	if opts.OutDir != "" {
+		if dstDir, err = filepath.Abs(opts.OutDir); err != nil {
+			return err
+		}
+	}
+	if IsInsideDir(srcDir, dstDir) || IsInsideDir(dstDir, srcDir) {
+		return errors.New("output and source directories overlap")
+	}
+	if opts.Remove && opts.Mirror {
+		// the next mirror run would see every output as an orphan
+		return errors.New("removing sources and mirroring can't be combined")
+	}
 	//fmt.Println("srcDir:", srcDir)
 	//fmt.Println("dstDir:", dstDir)
 
-	err = filepath.Walk(srcDir, func(path string, f os.FileInfo, err error) error {
-		if f == nil {
+	rules, err := DirIgnoreRules(srcDir, opts)
+	if err != nil {
+		return err
+	}
+	CleanTempDir(dstDir)
+
+	encName := func(relPath string) string {
+		if !strings.HasSuffix(relPath, ".enc") {
+			return ""
+		}
+		return strings.TrimSuffix(relPath, ".enc")
+	}
+	if opts.Mirror && opts.DryRun {
+		_, err = MirrorOrphans(srcDir, dstDir, encName, rules, ReadDirIndex(dstDir), opts)
+		return err
+	}
+
+	keys, err := NewIndexKeys(rsaPubKey, aesBits, aesCtp, opts.Threshold)
+	if err != nil {
+		return err
+	}
+	j, err := openDirJournal(srcDir, dstDir, "enc")
+	if err != nil {
+		return err
+	}
+	start := opts.progressStart(srcDir, rules)
+
+	idx := ReadDirIndex(dstDir)
+	seen := make(map[string]bool)
+	links := make(HardLinks)
+	var dirs []string
+
+	failed := 0
+	fail := func(path string, err error) error {
+		log.Println("Error for encryption:", path)
+		log.Println(err.Error())
+		opts.progressFile(path, "", "failed", nil, time.Now(), err)
+		if !opts.KeepGoing {
 			return err
 		}
+		failed++
+		relPath, _ := filepath.Rel(srcDir, path)
+		return j.Fail(relPath, err)
+	}
+
+	err = filepath.Walk(srcDir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return fail(path, err)
+		}
 
 		relPath, err := filepath.Rel(srcDir, path)
 		if err != nil {
@@ -44,53 +201,199 @@ func EncryptDir(srcDir string, rsaPubKey []byte, aesBits int, aesCtp string) err
 		}
 
 		encPath := filepath.Join(dstDir, relPath)
-		if f.IsDir() {
-			if strings.Contains(encPath, ".git") || strings.Contains(encPath, ".svn") {
+		if relPath == IndexFileName || relPath == JournalFileName {
+			// left by decrypting into this directory
+			return nil
+		}
+		if relPath != "." && rules.Excluded(relPath, f.IsDir()) {
+			if f.IsDir() {
 				return filepath.SkipDir
 			}
+			return nil
+		}
+		if f.IsDir() {
+			if relPath != "." {
+				dirs = append(dirs, path)
+			}
 			if !IsDirExist(encPath) {
 				mode := f.Mode().Perm()
 				//fmt.Println("Mode:", mode)
 				//fmt.Println(path, " -> ", encPath)
 				err = os.Mkdir(encPath, mode)
 			}
+		} else if IsTempFile(path) {
+			return nil
+		} else if f, err = WalkFileInfo(path, f, opts.FollowLinks); f == nil {
+			if err != nil {
+				return fail(path, err)
+			}
+			return nil
+		} else if f.Mode()&os.ModeSymlink != 0 {
+			seen[filepath.ToSlash(relPath)] = true
+			if err = CopySymlink(path, encPath); err == nil {
+				idx.Set(relPath, f, nil, nil)
+			}
 		} else {
 			outPath := encPath + ".enc"
+			seen[filepath.ToSlash(relPath)] = true
+			fstart, action := time.Now(), "encrypted"
+			if j.Done[filepath.ToSlash(relPath)] {
+				// finished before an interruption, whose index wasn't saved
+				if hdrf, e := ReadHdrInfo(outPath); e == nil {
+					idx.Set(relPath, f, hdrf.Fchk[:], keys)
+				}
+				opts.progressFile(path, outPath, "skipped", f, fstart, nil)
+				return nil
+			}
 			//fmt.Println(path, " -> ", outPath)
-			err = EncryptFile(path, outPath, rsaPubKey, aesBits, aesCtp)
+			if first := links.Output(f); first != "" {
+				action = "linked"
+				err = LinkOutput(first, outPath)
+				if err == nil && opts.Remove {
+					err = RemoveFile(path, false)
+				}
+			} else if opts.Remove {
+				err = EncryptFileRemove(path, outPath, rsaPubKey, aesBits, aesCtp, opts.Threshold, opts.Shred)
+			} else if !idx.SameKeys(relPath, keys) && IsFileExist(outPath) {
+				// the same plaintext, but for other recipients or another cipher
+				_, err = encryptFile(path, outPath, rsaPubKey, aesBits, aesCtp, opts.Threshold, true)
+			} else if opts.Checksum || !idx.Unchanged(relPath, f) || !IsFileExist(outPath) {
+				err = EncryptFile(path, outPath, rsaPubKey, aesBits, aesCtp, opts.Threshold)
+			} else {
+				links.Add(f, outPath)
+				opts.progressFile(path, outPath, "skipped", f, fstart, nil)
+				return nil
+			}
+			if err == nil || strings.Contains(err.Error(), "not modified") {
+				if err != nil {
+					action = "skipped"
+				}
+				opts.progressFile(path, outPath, action, f, fstart, nil)
+				links.Add(f, outPath)
+				if hdrf, e := ReadHdrInfo(outPath); e == nil {
+					idx.Set(relPath, f, hdrf.Fchk[:], keys)
+				}
+				if e := j.Add(relPath); e != nil {
+					return e
+				}
+			}
 		}
 
 		if err != nil {
-			log.Println("Error for encryption:", path)
-			log.Println(err.Error())
-			if !strings.Contains(err.Error(), "not modified") {
-				return err
+			if strings.Contains(err.Error(), "not modified") {
+				log.Println("Error for encryption:", path)
+				log.Println(err.Error())
+				return nil
 			}
+			return fail(path, err)
 		}
 		return nil
 	})
 
-	return err
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d entries failed, run again to retry them", failed)
+	}
+	if err == nil && opts.Mirror {
+		_, err = MirrorOrphans(srcDir, dstDir, encName, rules, idx, opts)
+	}
+	if err == nil && opts.Remove {
+		// children come after their parents in walk order, excluded
+		// files keep their directories
+		for i := len(dirs) - 1; i >= 0; i-- {
+			os.Remove(dirs[i])
+		}
+	}
 
+	if err == nil && opts.Mirror {
+		// entries of gone sources are kept until mirror removes their outputs
+		idx.Prune(seen)
+	}
+	if e := idx.Save(); e != nil && err == nil {
+		err = e
+	}
+	err = closeDirJournal(j, err)
+	opts.progressEnd(start, err)
+	return err
 }
 
-func DecryptDir(srcDir string, rsaPriKey []byte) error {
+func DecryptDir(srcDir string, rsaPriKey []byte, opts *DirOptions) error {
+	if opts == nil {
+		opts = new(DirOptions)
+	}
+	if opts.InPlace {
+		return DecryptDirInPlace(srcDir, rsaPriKey, opts)
+	}
+
 	srcDir, err := filepath.Abs(srcDir)
 	if err != nil {
 		return err
 	}
 
-	dstDir := srcDir
-	if strings.HasSuffix(dstDir, "_enc") {
-		dstDir = strings.TrimSuffix(dstDir, "_enc")
+	dstDir := srcDir + "_dec"
+	if strings.HasSuffix(srcDir, "_enc") {
+		dstDir = strings.TrimSuffix(srcDir, "_enc")
+	}
+	if opts.OutDir != "" {
+		if dstDir, err = filepath.Abs(opts.OutDir); err != nil {
+			return err
+		}
+	}
+	if IsInsideDir(srcDir, dstDir) || IsInsideDir(dstDir, srcDir) {
+		return errors.New("output and source directories overlap")
+	}
+
+	decName := func(relPath string) string {
+		return relPath + ".enc"
+	}
+	// a dry run only lists, so it can look at any output directory
+	if opts.Mirror && opts.DryRun {
+		_, err = mirrorDecrypted(srcDir, dstDir, decName, ReadDirIndex(dstDir), opts)
+		return err
+	}
+
+	// an unfinished run is resumed without forcing
+	resume, err := ReadJournal(dstDir)
+	if err != nil {
+		return err
+	}
+	if !opts.Force && resume == nil && !IsDirEmpty(dstDir) {
+		return errors.New("output directory " + dstDir + " is not empty, force to decrypt into it")
 	}
 	//fmt.Println("srcDir:", srcDir)
 	//fmt.Println("dstDir:", dstDir)
 
-	err = filepath.Walk(srcDir, func(path string, f os.FileInfo, err error) error {
-		if f == nil {
+	rules, err := DirIgnoreRules(srcDir, opts)
+	if err != nil {
+		return err
+	}
+	CleanTempDir(dstDir)
+
+	j, err := openDirJournal(srcDir, dstDir, "dec")
+	if err != nil {
+		return err
+	}
+	start := opts.progressStart(srcDir, rules)
+
+	idx := ReadDirIndex(dstDir)
+	seen := make(map[string]bool)
+	links := make(HardLinks)
+	failed := 0
+	fail := func(path string, err error) error {
+		log.Println("Error for decryption:", path)
+		log.Println(err.Error())
+		opts.progressFile(path, "", "failed", nil, time.Now(), err)
+		if !opts.KeepGoing {
 			return err
 		}
+		failed++
+		relPath, _ := filepath.Rel(srcDir, path)
+		return j.Fail(relPath, err)
+	}
+
+	err = filepath.Walk(srcDir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return fail(path, err)
+		}
 
 		relPath, err := filepath.Rel(srcDir, path)
 		if err != nil {
@@ -98,39 +401,144 @@ func DecryptDir(srcDir string, rsaPriKey []byte) error {
 		}
 
 		decPath := filepath.Join(dstDir, relPath)
-		if f.IsDir() {
-			if strings.Contains(decPath, ".git") || strings.Contains(decPath, ".svn") {
+		if relPath == IndexFileName || relPath == JournalFileName {
+			return nil
+		}
+		if relPath == TrashDirName {
+			return filepath.SkipDir
+		}
+		if relPath != "." && rules.Excluded(strings.TrimSuffix(relPath, ".enc"), f.IsDir()) {
+			if f.IsDir() {
 				return filepath.SkipDir
 			}
+			return nil
+		}
+		if f.IsDir() {
 			if !IsDirExist(decPath) {
 				mode := f.Mode().Perm()
 				//fmt.Println("Mode:", mode)
 				//fmt.Println(path, " -> ", decPath)
 				err = os.Mkdir(decPath, mode)
 			}
+		} else if IsTempFile(path) {
+			return nil
+		} else if f, err = WalkFileInfo(path, f, opts.FollowLinks); f == nil {
+			if err != nil {
+				return fail(path, err)
+			}
+			return nil
+		} else if f.Mode()&os.ModeSymlink != 0 {
+			seen[filepath.ToSlash(relPath)] = true
+			if err = CopySymlink(path, decPath); err == nil {
+				idx.Set(relPath, f, nil, nil)
+			}
 		} else {
 			outPath := decPath
 			if strings.HasSuffix(outPath, ".enc") == true {
 				outPath = strings.TrimSuffix(outPath, ".enc")
 			}
+			fstart, action := time.Now(), "decrypted"
+			if j.Done[filepath.ToSlash(relPath)] {
+				// finished before an interruption, still a source mirror
+				// has to know about
+				seen[filepath.ToSlash(relPath)] = true
+				if hdrf, e := ReadHdrInfo(path); e == nil {
+					idx.Set(relPath, f, hdrf.Fchk[:], nil)
+				}
+				opts.progressFile(path, outPath, "skipped", f, fstart, nil)
+				return nil
+			}
 			//fmt.Println(path, " -> ", outPath)
-			err = DecryptFile(path, outPath, rsaPriKey)
+			if first := links.Output(f); first != "" {
+				action = "linked"
+				err = LinkOutput(first, outPath)
+			} else {
+				err = DecryptFile(path, outPath, rsaPriKey)
+			}
+			if err != nil && strings.Contains(err.Error(), "not an encrypted file") {
+				opts.progressFile(path, outPath, "not encrypted", f, fstart, nil)
+			}
+			if err == nil || strings.Contains(err.Error(), "not modified") {
+				if err != nil {
+					action = "skipped"
+				}
+				opts.progressFile(path, outPath, action, f, fstart, nil)
+				links.Add(f, outPath)
+				seen[filepath.ToSlash(relPath)] = true
+				if hdrf, e := ReadHdrInfo(path); e == nil {
+					idx.Set(relPath, f, hdrf.Fchk[:], nil)
+				}
+				if e := j.Add(relPath); e != nil {
+					return e
+				}
+			}
 		}
 
 		if err != nil {
-			log.Println("Error for decryption:", path)
-			log.Println(err.Error())
-			if !strings.Contains(err.Error(), "not modified") &&
-				!strings.Contains(err.Error(), "not an encrypted file") {
-				return err
+			if strings.Contains(err.Error(), "not modified") ||
+				strings.Contains(err.Error(), "not an encrypted file") {
+				log.Println("Error for decryption:", path)
+				log.Println(err.Error())
+				return nil
 			}
+			return fail(path, err)
 		}
 		return nil
 	})
 
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d entries failed, run again to retry them", failed)
+	}
+	if err == nil && opts.Mirror {
+		_, err = mirrorDecrypted(srcDir, dstDir, decName, idx, opts)
+		if err == nil {
+			idx.Prune(seen)
+		}
+	}
+	// only mirroring needs an index in the restored tree
+	if opts.Mirror {
+		if e := idx.Save(); e != nil && err == nil {
+			err = e
+		}
+	}
+	err = closeDirJournal(j, err)
+	opts.progressEnd(start, err)
 	return err
 }
 
+// Mirror a decrypted directory with the rules of its own ignore file, the
+// encrypted tree only holds the ignore file encrypted
+func mirrorDecrypted(srcDir, dstDir string, decName func(string) string, idx *DirIndex, opts *DirOptions) ([]string, error) {
+	rules, err := DirIgnoreRules(dstDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return MirrorOrphans(srcDir, dstDir, decName, rules, idx, opts)
+}
+
+// Open the journal of a run from srcDir into dstDir, creating dstDir
+func openDirJournal(srcDir, dstDir, mode string) (*Journal, error) {
+	if !IsDirExist(dstDir) {
+		fi, err := os.Stat(srcDir)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Mkdir(dstDir, fi.Mode().Perm()); err != nil {
+			return nil, err
+		}
+	}
+	return OpenJournal(dstDir, mode)
+}
+
+// Remove the journal of a run that ended without err, keep it otherwise
+func closeDirJournal(j *Journal, err error) error {
+	if err != nil {
+		j.Close()
+		return err
+	}
+	return j.Finish()
+}
+
 func test_dir(srcDir string) error {
 	var dstDir string
 
@@ -17,8 +17,8 @@ import (
 
 // 32 bytes
 type HdrInfo struct {
-	Rlen int32    // AesInfo size after RSA
-	Eflg uint32   // encrypted file flag 0x32571235
+	Rlen int32    // AesInfo size after RSA, or recipient block size
+	Eflg uint32   // encrypted file flag EncFlagV1 or EncFlagV2
 	Mdtm int64    // file modify time before encrypted
 	Fchk [16]byte // file md5 checksum before encrypted
 }
@@ -27,7 +27,7 @@ type HdrInfo struct {
 type AesInfo struct {
 	Rand [40]byte // security random data
 	Size uint32   // aes key size 16 24 32
-	Type uint32   // aes cipher type 1 - cfb, 2 - ctr, 4 - ofb
+	Type uint32   // aes cipher type 1 - cfb, 2 - ctr, 4 - ofb, 8 - gcm
 	Fchk [16]byte // file md5 checksum before encrypted
 
 	Aesv [32]byte // aes iv
@@ -130,7 +130,7 @@ func GenEncHdr(inFile *os.File, aesBits int, aesCtp string) (*HdrInfo, *AesInfo)
 	if err != nil {
 		return nil, nil
 	}
-	hdrf.Eflg = 0x32571235
+	hdrf.Eflg = EncFlagV2
 	hdrf.Mdtm = fileInfo.ModTime().Unix()
 	//fmt.Println("Mdtm:", fileInfo.ModTime().String())
 	//fmt.Println("Mdtm:", hdrf.Mdtm)
@@ -144,6 +144,8 @@ func GenEncHdr(inFile *os.File, aesBits int, aesCtp string) (*HdrInfo, *AesInfo)
 		info.Type = 1
 	case "ctr":
 		info.Type = 2
+	case "gcm":
+		info.Type = 8
 	default:
 		info.Type = 4
 	}
@@ -179,41 +181,22 @@ func ReadHdrInfo(inPath string) (*HdrInfo, error) {
 	}
 
 	hdrf := Bytes2HdrInfo(buf)
-	if hdrf.Eflg != 0x32571235 {
+	if hdrf.Eflg != EncFlagV1 && hdrf.Eflg != EncFlagV2 {
 		return nil, errors.New("not an encrypted file error")
 	}
 	return hdrf, nil
 }
 
 func ReadEncHdr(inPath string, rsaPriKey []byte) (*HdrInfo, *AesInfo, error) {
-	hdrf, err := ReadHdrInfo(inPath)
+	hdrf, rsaBin, err := readHdrBlock(inPath)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	inFile, err := os.Open(inPath)
+	info, err := UnwrapAesInfo(hdrf, rsaBin, rsaPriKey)
 	if err != nil {
 		return nil, nil, err
 	}
-	defer inFile.Close()
-
-	_, err = inFile.Seek(int64(binary.Size(HdrInfo{})), 0)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var rsaBin = make([]byte, hdrf.Rlen)
-	_, err = inFile.Read(rsaBin)
-	if err != nil {
-		return nil, nil, errors.New("read rsa bin failed")
-	}
-
-	binInfo, err := RsaDecrypt(rsaPriKey, rsaBin)
-	if binInfo == nil {
-		return nil, nil, errors.New("decrypt rsa bin failed")
-	}
-
-	info := Bytes2AesInfo(binInfo)
 	if CheckFchk(hdrf.Fchk[:], info.Fchk[:]) != true {
 		return nil, nil, errors.New("header checksum failed")
 	}
@@ -250,35 +233,54 @@ func IsNewDec(inPath string, info *HdrInfo) bool {
 	return !CheckFchk(info.Fchk[:], fchk[:])
 }
 
-func EncryptFile(inPath, outPath string, rsaPubKey []byte, aesBits int, aesCtp string) error {
+// Encrypt inPath for the keys in rsaPubKey, with a threshold above 0 the
+// data key is split among them, see WrapAesInfo
+func EncryptFile(inPath, outPath string, rsaPubKey []byte, aesBits int, aesCtp string, threshold int) error {
+	switch EncryptFormat {
+	case "age":
+		return encryptFileAge(inPath, outPath, rsaPubKey)
+	case "openpgp":
+		return encryptFilePgp(inPath, outPath, rsaPubKey)
+	}
+	_, err := encryptFile(inPath, outPath, rsaPubKey, aesBits, aesCtp, threshold, false)
+	return err
+}
+
+// Encrypt inPath, even over an unmodified outPath if force, and return the
+// AesInfo written to the header
+func encryptFile(inPath, outPath string, rsaPubKey []byte, aesBits int, aesCtp string, threshold int, force bool) (info *AesInfo, err error) {
+	if IsSameFile(inPath, outPath) {
+		return nil, errors.New("output file is the input file")
+	}
+
 	inFile, err := os.Open(inPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer inFile.Close()
 
 	hdrf, info := GenEncHdr(inFile, aesBits, aesCtp)
 	if info == nil {
-		return errors.New("gen file header failed")
+		return nil, errors.New("gen file header failed")
 	}
 
-	if IsFileExist(outPath) && !IsNewEnc(outPath, hdrf) {
-		return errors.New("file already encrypted and not modified")
+	if !force && IsFileExist(outPath) && !IsNewEnc(outPath, hdrf) {
+		return nil, errors.New("file already encrypted and not modified")
 	}
 
-	outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	outFile, err := CreateTempFile(outPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer outFile.Close()
-
-	binInfo := AesInfo2Bytes(info)
-	//fmt.Println("binInfo len:", len(binInfo))
-	//fmt.Println("binInfo:", hex.EncodeToString(binInfo))
+	defer func() {
+		if err != nil {
+			AbortTempFile(outFile)
+		}
+	}()
 
-	rsaBin, err := RsaEncrypt(rsaPubKey, binInfo)
+	rsaBin, err := WrapAesInfo(rsaPubKey, info, threshold)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	hdrf.Rlen = int32(len(rsaBin))
@@ -287,31 +289,41 @@ func EncryptFile(inPath, outPath string, rsaPubKey []byte, aesBits int, aesCtp s
 
 	_, err = outFile.Write(HdrInfo2Bytes(hdrf))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = outFile.Write(rsaBin)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	key := info.Aesk[:info.Size]
 	aiv := info.Aesv[:aes.BlockSize]
 	err = AesEncryptFd(inFile, outFile, key, aiv, int(info.Type))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	inInfo, err := inFile.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	outFile.Chmod(inInfo.Mode())
-	return nil
+	return info, CommitTempFile(outFile, outPath)
 }
 
-func DecryptFile(inPath, outPath string, rsaPriKey []byte) error {
+func DecryptFile(inPath, outPath string, rsaPriKey []byte) (err error) {
+	if IsSameFile(inPath, outPath) {
+		return errors.New("output file is the input file")
+	}
+	if IsAgeFile(inPath) {
+		return decryptFileAge(inPath, outPath, rsaPriKey)
+	}
+	if IsPgpFile(inPath) {
+		return DecryptFilePgp(inPath, outPath, IdentityWrappers(rsaPriKey))
+	}
+
 	hdrf, info, err := ReadEncHdr(inPath, rsaPriKey)
 	if err != nil {
 		return err
@@ -333,12 +345,15 @@ func DecryptFile(inPath, outPath string, rsaPriKey []byte) error {
 		return err
 	}
 
-	outPath2 := outPath + ".dec"
-	outFile, err := os.OpenFile(outPath2, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	outFile, err := CreateTempFile(outPath)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
+	defer func() {
+		if err != nil {
+			AbortTempFile(outFile)
+		}
+	}()
 
 	key := info.Aesk[:info.Size]
 	aiv := info.Aesv[:aes.BlockSize]
@@ -353,18 +368,11 @@ func DecryptFile(inPath, outPath string, rsaPriKey []byte) error {
 	}
 
 	outFile.Chmod(inInfo.Mode())
-	outFile.Close()
 
-	if IsNewDec(outPath2, hdrf) {
+	if IsNewDec(outFile.Name(), hdrf) {
 		return errors.New("decrypted file checksum not match")
-	} else {
-		os.Remove(outPath)
-		err = os.Rename(outPath2, outPath)
-		if err != nil {
-			return err
-		}
 	}
-	return nil
+	return CommitTempFile(outFile, outPath)
 }
 
 func EncryptFileTest() {
@@ -381,7 +389,7 @@ func EncryptFileTest() {
 		return
 	}
 
-	err := EncryptFile("big.dat", "big.dat.enc", publicKey, 16, "cfb")
+	err := EncryptFile("big.dat", "big.dat.enc", publicKey, 16, "cfb", 0)
 	if err != nil {
 		fmt.Println("EncryptFile failed")
 		return
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Per-directory rules file, read from the root of the source directory
+const IgnoreFileName = ".bitcryptignore"
+
+// Excluded unless overridden, e.g. by "!.git/" or NoDefaults
+var DefaultExcludes = []string{".git/", ".svn/"}
+
+type ignoreRule struct {
+	segs    []string // pattern split on "/", unanchored ones start with "**"
+	negate  bool     // "!pattern" re-includes what an earlier rule excluded
+	dirOnly bool     // "pattern/" only matches directories
+}
+
+// Gitignore-style include/exclude rules, matched against slash separated
+// paths relative to the source root
+type IgnoreRules struct {
+	includes []ignoreRule
+	excludes []ignoreRule
+}
+
+func NewIgnoreRules(noDefaults bool) *IgnoreRules {
+	rules := new(IgnoreRules)
+	if !noDefaults {
+		for _, pattern := range DefaultExcludes {
+			rules.AddExclude(pattern)
+		}
+	}
+	return rules
+}
+
+func (rules *IgnoreRules) AddExclude(pattern string) {
+	if rule, ok := parseIgnoreRule(pattern); ok {
+		rules.excludes = append(rules.excludes, rule)
+	}
+}
+
+func (rules *IgnoreRules) AddInclude(pattern string) {
+	if rule, ok := parseIgnoreRule(pattern); ok {
+		rules.includes = append(rules.includes, rule)
+	}
+}
+
+// Add the exclude patterns of an ignore file, one per line, "#" comments
+func (rules *IgnoreRules) AddFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rules.AddExclude(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// Report whether relPath is left out; the last matching exclude pattern
+// wins and nothing below an excluded directory comes back, and with
+// include patterns a file must match one of them or be below a directory
+// that does
+func (rules *IgnoreRules) Excluded(relPath string, isDir bool) bool {
+	if rules == nil {
+		return false
+	}
+
+	segs := strings.Split(filepath.ToSlash(relPath), "/")
+	for i := 1; i < len(segs); i++ {
+		if lastMatch(rules.excludes, segs[:i], true) {
+			return true
+		}
+	}
+	if lastMatch(rules.excludes, segs, isDir) {
+		return true
+	}
+	if isDir || len(rules.includes) == 0 {
+		return false
+	}
+
+	included := false
+	for _, rule := range rules.includes {
+		matched := rule.match(segs, isDir)
+		for i := 1; i < len(segs) && !matched; i++ {
+			matched = rule.match(segs[:i], true)
+		}
+		if matched {
+			included = !rule.negate
+		}
+	}
+	return !included
+}
+
+// Whether the last of rules matching segs is not a negated one
+func lastMatch(rules []ignoreRule, segs []string, isDir bool) bool {
+	matched := false
+	for _, rule := range rules {
+		if rule.match(segs, isDir) {
+			matched = !rule.negate
+		}
+	}
+	return matched
+}
+
+func parseIgnoreRule(pattern string) (ignoreRule, bool) {
+	var rule ignoreRule
+
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\") {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return rule, false
+	}
+
+	// a slash at the start or in the middle anchors to the root
+	anchored := strings.Contains(pattern, "/")
+	rule.segs = strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	if !anchored {
+		rule.segs = append([]string{"**"}, rule.segs...)
+	}
+	return rule, true
+}
+
+func (rule ignoreRule) match(segs []string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	return matchSegs(rule.segs, segs)
+}
+
+func matchSegs(pattern, segs []string) bool {
+	if len(pattern) == 0 {
+		return len(segs) == 0
+	}
+	if pattern[0] == "**" {
+		// a trailing "**" matches what is inside, not the directory itself
+		start := 0
+		if len(pattern) == 1 {
+			start = 1
+		}
+		for i := start; i <= len(segs); i++ {
+			if matchSegs(pattern[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segs[0])
+	return ok && matchSegs(pattern[1:], segs[1:])
+}
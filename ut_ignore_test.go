@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestIgnoreRules(t *testing.T) {
+	tests := []struct {
+		includes, excludes []string
+		path               string
+		isDir              bool
+		want               bool
+	}{
+		// defaults
+		{nil, nil, ".git", true, true},
+		{nil, nil, ".git/config", false, true},
+		{nil, nil, "sub/.svn/entries", false, true},
+		{nil, []string{"!.git/"}, ".git/config", false, false},
+
+		// unanchored, anchored and directory patterns
+		{nil, []string{"*.log"}, "a/b/x.log", false, true},
+		{nil, []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{nil, []string{"/build"}, "build", true, true},
+		{nil, []string{"/build"}, "src/build", true, false},
+		{nil, []string{"tmp/"}, "tmp", false, false},
+		{nil, []string{"tmp/"}, "a/tmp/x", false, true},
+		{nil, []string{"logs/"}, "logs/keep.log", false, true},
+		{nil, []string{"logs/", "!logs/keep.log"}, "logs/keep.log", false, true},
+
+		// "**"
+		{nil, []string{"foo/**"}, "foo", true, false},
+		{nil, []string{"foo/**"}, "foo/x", false, true},
+		{nil, []string{"foo/**"}, "foo/a/b", false, true},
+		{nil, []string{"a/**/b"}, "a/b", false, true},
+		{nil, []string{"a/**/b"}, "a/x/y/b", false, true},
+		{nil, []string{"**/cache"}, "x/cache", true, true},
+
+		// includes
+		{[]string{"*.txt"}, nil, "a/b.txt", false, false},
+		{[]string{"*.txt"}, nil, "a/b.bin", false, true},
+		{[]string{"*.txt"}, nil, "a", true, false},
+		{[]string{"dir/"}, nil, "dir/x", false, false},
+		{[]string{"dir/"}, nil, "dir/sub/x", false, false},
+		{[]string{"dir/"}, nil, "other/x", false, true},
+		{[]string{"dir/"}, nil, "dir", false, true},
+		{[]string{"/docs"}, nil, "docs/a.md", false, false},
+		{[]string{"docs/**"}, nil, "docs/a/b.md", false, false},
+		{[]string{"dir/", "!*.bak"}, nil, "dir/x.bak", false, true},
+		{[]string{"*.txt"}, []string{"secret/"}, "secret/a.txt", false, true},
+	}
+	for _, tt := range tests {
+		rules := NewIgnoreRules(false)
+		for _, p := range tt.excludes {
+			rules.AddExclude(p)
+		}
+		for _, p := range tt.includes {
+			rules.AddInclude(p)
+		}
+		if got := rules.Excluded(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("-i %v -x %v: %s excluded %v, want %v", tt.includes, tt.excludes, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// Index file kept in the root of an output directory, keyed by the
+// source paths its outputs were made from
+const IndexFileName = ".bitcrypt.idx"
+
+// Source file state at the time it was last encrypted
+type IndexEntry struct {
+	Size  int64  `json:"size"`
+	Mdtm  int64  `json:"mtime"` // modify time in nanoseconds
+	Inode uint64 `json:"inode"`
+	Fchk  string `json:"fchk"` // md5 checksum, hex
+	IndexKeys
+}
+
+// What a file was encrypted for and with, empty in the index of a
+// decrypted directory
+type IndexKeys struct {
+	Recipients []string `json:"recipients,omitempty"` // fingerprints, hex and sorted
+	Cipher     string   `json:"cipher,omitempty"`     // -t
+	KeyLen     int      `json:"keylen,omitempty"`     // -l
+	Threshold  int      `json:"threshold,omitempty"`
+}
+
+// Settings of an encrypt run for the keys in rsaPubKey
+func NewIndexKeys(rsaPubKey []byte, aesBits int, aesCtp string, threshold int) (*IndexKeys, error) {
+	wrappers, err := RecipientWrappers(rsaPubKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := &IndexKeys{Cipher: aesCtp, KeyLen: aesBits, Threshold: threshold}
+	for _, w := range wrappers {
+		keys.Recipients = append(keys.Recipients, FingerprintString(w.Fingerprint()))
+	}
+	sort.Strings(keys.Recipients)
+	return keys, nil
+}
+
+type DirIndex struct {
+	path  string
+	Files map[string]*IndexEntry `json:"files"`
+}
+
+// Read the index in dstDir, a missing or broken index reads as empty
+func ReadDirIndex(dstDir string) *DirIndex {
+	idx := &DirIndex{
+		path:  filepath.Join(dstDir, IndexFileName),
+		Files: make(map[string]*IndexEntry),
+	}
+
+	b, err := ioutil.ReadFile(idx.path)
+	if err != nil {
+		return idx
+	}
+	if err = json.Unmarshal(b, idx); err != nil || idx.Files == nil {
+		idx.Files = make(map[string]*IndexEntry)
+	}
+	return idx
+}
+
+// Report whether the source file is unchanged since relPath was indexed
+func (idx *DirIndex) Unchanged(relPath string, fi os.FileInfo) bool {
+	ent, ok := idx.Files[filepath.ToSlash(relPath)]
+	if !ok {
+		return false
+	}
+	return ent.Size == fi.Size() &&
+		ent.Mdtm == fi.ModTime().UnixNano() &&
+		ent.Inode == FileInode(fi)
+}
+
+// Report whether relPath was last encrypted with keys; entries of older
+// indexes, which didn't record them, never were
+func (idx *DirIndex) SameKeys(relPath string, keys *IndexKeys) bool {
+	ent, ok := idx.Files[filepath.ToSlash(relPath)]
+	return ok && reflect.DeepEqual(ent.IndexKeys, *keys)
+}
+
+// Report whether relPath was indexed, i.e. an output was made from it
+func (idx *DirIndex) Has(relPath string) bool {
+	_, ok := idx.Files[filepath.ToSlash(relPath)]
+	return ok
+}
+
+// Record relPath, with the keys it was encrypted with unless nil
+func (idx *DirIndex) Set(relPath string, fi os.FileInfo, fchk []byte, keys *IndexKeys) {
+	ent := &IndexEntry{
+		Size:  fi.Size(),
+		Mdtm:  fi.ModTime().UnixNano(),
+		Inode: FileInode(fi),
+		Fchk:  hex.EncodeToString(fchk), // empty for symlinks
+	}
+	if keys != nil {
+		ent.IndexKeys = *keys
+	}
+	idx.Files[filepath.ToSlash(relPath)] = ent
+}
+
+// Drop entries for sources not in keep
+func (idx *DirIndex) Prune(keep map[string]bool) {
+	for relPath := range idx.Files {
+		if !keep[relPath] {
+			delete(idx.Files, relPath)
+		}
+	}
+}
+
+func (idx *DirIndex) Save() error {
+	b, err := json.MarshalIndent(idx, "", "\t")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(idx.path, b, 0600)
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// Inode number of a file, always 0 since os.FileInfo has none on windows
+func FileInode(fi os.FileInfo) uint64 {
+	return 0
+}
+
+// Identity of a file and its number of hard links, hard links are not
+// detected on windows
+func FileLinkID(fi os.FileInfo) (FileID, uint64) {
+	return FileID{}, 1
+}
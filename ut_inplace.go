@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Replace each file below dir by its .enc counterpart, one at a time and
+// journaled, so the run can be resumed or rolled back after a crash
+func EncryptDirInPlace(dir string, rsaPubKey []byte, aesBits int, aesCtp string, opts *DirOptions) error {
+	dir, rules, err := inPlaceStart(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	j, err := OpenJournal(dir, "inplace-enc")
+	if err != nil {
+		return err
+	}
+	start := opts.progressStart(dir, rules)
+
+	links := make(HardLinks)
+	failed := 0
+	fail := func(path string, err error) error {
+		log.Println("Error for encryption:", path)
+		log.Println(err.Error())
+		opts.progressFile(path, "", "failed", nil, time.Now(), err)
+		if !opts.KeepGoing {
+			return err
+		}
+		failed++
+		relPath, _ := filepath.Rel(dir, path)
+		return j.Fail(relPath, err)
+	}
+
+	err = filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		relPath, skip, err := inPlaceEntry(dir, path, f, err, rules)
+		if err != nil && err != filepath.SkipDir {
+			return fail(path, err)
+		}
+		if skip {
+			return err
+		}
+		if strings.HasSuffix(path, ".enc") {
+			if _, e := ReadHdrInfo(path); e == nil {
+				return nil
+			}
+		}
+
+		// journaled before the source goes, so a rollback finds the entry
+		if err = j.Begin(relPath); err != nil {
+			return fail(path, err)
+		}
+		fstart, action := time.Now(), "encrypted"
+		if first := links.Output(f); first != "" {
+			action = "linked"
+			err = LinkOutput(first, path+".enc")
+			if err == nil {
+				err = RemoveFile(path, false)
+			}
+		} else {
+			err = EncryptFileRemove(path, path+".enc", rsaPubKey, aesBits, aesCtp, opts.Threshold, opts.Shred)
+		}
+		if err == nil {
+			opts.progressFile(path, path+".enc", action, f, fstart, nil)
+			links.Add(f, path+".enc")
+			err = j.Add(relPath)
+		}
+		if err != nil {
+			return fail(path, err)
+		}
+		return nil
+	})
+
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d entries failed, run again to retry them", failed)
+	}
+	err = closeDirJournal(j, err)
+	opts.progressEnd(start, err)
+	return err
+}
+
+// Replace each .enc file below dir by its decrypted counterpart, the
+// inverse of EncryptDirInPlace
+func DecryptDirInPlace(dir string, rsaPriKey []byte, opts *DirOptions) error {
+	dir, rules, err := inPlaceStart(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	j, err := OpenJournal(dir, "inplace-dec")
+	if err != nil {
+		return err
+	}
+	start := opts.progressStart(dir, rules)
+
+	links := make(HardLinks)
+	failed := 0
+	fail := func(path string, err error) error {
+		log.Println("Error for decryption:", path)
+		log.Println(err.Error())
+		opts.progressFile(path, "", "failed", nil, time.Now(), err)
+		if !opts.KeepGoing {
+			return err
+		}
+		failed++
+		relPath, _ := filepath.Rel(dir, path)
+		return j.Fail(relPath, err)
+	}
+
+	err = filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		relPath, skip, err := inPlaceEntry(dir, path, f, err, rules)
+		if err != nil && err != filepath.SkipDir {
+			return fail(path, err)
+		}
+		if skip || !strings.HasSuffix(path, ".enc") {
+			return err
+		}
+		hdrf, err := ReadHdrInfo(path)
+		if err != nil {
+			// a plaintext file that happens to end in .enc
+			return nil
+		}
+
+		outPath := strings.TrimSuffix(path, ".enc")
+		if err = j.Begin(strings.TrimSuffix(relPath, ".enc")); err != nil {
+			return fail(path, err)
+		}
+		fstart, action := time.Now(), "decrypted"
+		if first := links.Output(f); first != "" {
+			action = "linked"
+			err = LinkOutput(first, outPath)
+		} else if IsFileExist(outPath) {
+			if IsNewDec(outPath, hdrf) {
+				err = errors.New(outPath + " exists and differs")
+			}
+			// else decrypted before a crash, only the .enc is left to remove
+		} else {
+			err = DecryptFile(path, outPath, rsaPriKey)
+		}
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err == nil {
+			opts.progressFile(path, outPath, action, f, fstart, nil)
+			links.Add(f, outPath)
+			err = j.Add(strings.TrimSuffix(relPath, ".enc"))
+		}
+		if err != nil {
+			return fail(path, err)
+		}
+		return nil
+	})
+
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d entries failed, run again to retry them", failed)
+	}
+	err = closeDirJournal(j, err)
+	opts.progressEnd(start, err)
+	return err
+}
+
+// Undo the files an interrupted in-place run below dir has finished; key
+// is the private key for an encrypt run and the public key for a decrypt run
+func RollbackDir(dir string, key []byte, aesBits int, aesCtp string) error {
+	j, err := ReadJournal(dir)
+	if err != nil {
+		return err
+	}
+	if j == nil || !strings.HasPrefix(j.Mode, "inplace-") {
+		return errors.New("no unfinished in-place run in " + dir)
+	}
+
+	var relPaths []string
+	for relPath := range j.Done {
+		relPaths = append(relPaths, relPath)
+	}
+	for relPath := range j.Pending {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	for _, relPath := range relPaths {
+		path := filepath.Join(dir, filepath.FromSlash(relPath))
+		encPath := path + ".enc"
+
+		err = nil
+		if j.Pending[relPath] && IsFileExist(path) && IsFileExist(encPath) {
+			// cut short before the input went, which is still whole
+			err = rollbackPending(j.Mode, path, encPath)
+		} else if j.Mode == "inplace-enc" && IsFileExist(encPath) {
+			err = DecryptFile(encPath, path, key)
+			if err == nil || strings.Contains(err.Error(), "not modified") {
+				err = os.Remove(encPath)
+			}
+		} else if j.Mode == "inplace-dec" && IsFileExist(path) {
+			err = EncryptFileRemove(path, encPath, key, aesBits, aesCtp, 0, false)
+		}
+		if err != nil {
+			log.Println("Error for rollback:", path)
+			return err
+		}
+	}
+
+	if err = os.Remove(j.path); err != nil {
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// Remove the output of an entry an in-place run began but didn't finish,
+// unless it differs from what its input gives
+func rollbackPending(mode, path, encPath string) error {
+	if mode == "inplace-enc" {
+		return os.Remove(encPath)
+	}
+	hdrf, err := ReadHdrInfo(encPath)
+	if err != nil {
+		return err
+	}
+	if IsNewDec(path, hdrf) {
+		return errors.New(path + " exists and differs from " + encPath)
+	}
+	return os.Remove(path)
+}
+
+func inPlaceStart(dir string, opts *DirOptions) (string, *IgnoreRules, error) {
+	if opts.OutDir != "" || opts.Mirror {
+		return "", nil, errors.New("in-place can't be combined with an output directory or mirroring")
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rules, err := DirIgnoreRules(dir, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	CleanTempDir(dir)
+	return dir, rules, nil
+}
+
+// Walk step shared by the in-place runs, reports the regular files to work on
+func inPlaceEntry(dir, path string, f os.FileInfo, err error, rules *IgnoreRules) (string, bool, error) {
+	if err != nil {
+		// an unreadable entry, journaled under -keep-going as EncryptDir does
+		return "", true, err
+	}
+
+	relPath, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", true, err
+	}
+	if relPath == "." {
+		return relPath, true, nil
+	}
+	if relPath == JournalFileName || relPath == IgnoreFileName || IsTempFile(path) {
+		return relPath, true, nil
+	}
+	if rules.Excluded(strings.TrimSuffix(relPath, ".enc"), f.IsDir()) {
+		if f.IsDir() {
+			return relPath, true, filepath.SkipDir
+		}
+		return relPath, true, nil
+	}
+	if f.IsDir() || f.Mode()&os.ModeSymlink != 0 {
+		// symlinks are left as they are
+		return relPath, true, nil
+	}
+	if !f.Mode().IsRegular() {
+		log.Println("Skip special file:", path)
+		return relPath, true, nil
+	}
+	return relPath, false, nil
+}
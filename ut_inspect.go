@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What the header of an encrypted file tells, the cipher only with the
+// private key
+type FileHeader struct {
+	Path       string     `json:"path"`
+	Version    int        `json:"version"`
+	Recipients [][32]byte `json:"-"`
+	KeyIDs     []string   `json:"recipients,omitempty"` // fingerprints in hex
+	Shared     bool       `json:"shared,omitempty"`     // data key split into shares among them
+	VaultKeys  []string   `json:"vault_keys,omitempty"` // mount/key of Vault recipients
+	Modified   time.Time  `json:"modified"`
+	Checksum   string     `json:"checksum"` // md5 of the plaintext
+	EncSize    int64      `json:"encrypted_size"`
+	Size       int64      `json:"size,omitempty"` // plaintext, known with the key
+	Cipher     string     `json:"cipher,omitempty"`
+	KeyBits    int        `json:"key_bits,omitempty"`
+}
+
+func AesTypeName(ctp uint32) string {
+	switch ctp {
+	case 1:
+		return "cfb"
+	case 2:
+		return "ctr"
+	case 4:
+		return "ofb"
+	case 8:
+		return "gcm"
+	}
+	return "unknown"
+}
+
+// Read the header of inPath, also its cipher part if rsaPriKey holds a key
+// for it
+func InspectFile(inPath string, rsaPriKey []byte) (*FileHeader, error) {
+	hdrf, err := ReadHdrInfo(inPath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(inPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fh := &FileHeader{
+		Path:     inPath,
+		Modified: time.Unix(hdrf.Mdtm, 0),
+		Checksum: hex.EncodeToString(hdrf.Fchk[:]),
+		EncSize:  fi.Size(),
+		Version:  1,
+	}
+	if hdrf.Eflg == EncFlagV2 {
+		fh.Version = 2
+		list, err := ReadRecipients(inPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, rcp := range list {
+			fh.Recipients = append(fh.Recipients, rcp.Fprt)
+			fh.KeyIDs = append(fh.KeyIDs, FingerprintString(rcp.Fprt))
+			fh.Shared = fh.Shared || rcp.Type&WrapShare != 0
+			if rcp.Type&^WrapShare == WrapVault {
+				ref, _, _ := strings.Cut(string(rcp.Wrapped), "\n")
+				fh.VaultKeys = append(fh.VaultKeys, ref)
+			}
+		}
+	}
+	if len(rsaPriKey) == 0 {
+		return fh, nil
+	}
+
+	_, info, err := ReadEncHdr(inPath, rsaPriKey)
+	if err != nil && (strings.HasPrefix(err.Error(), "no private key") || strings.HasPrefix(err.Error(), "not enough key shares")) {
+		return fh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fh.Cipher = AesTypeName(info.Type)
+	fh.KeyBits = int(info.Size) * 8
+	fh.Size = fi.Size() - int64(hdrf.Rlen+int32(binary.Size(HdrInfo{})))
+	if info.Type == 8 {
+		fh.Size, err = AesGcmPlainSize(fh.Size)
+	}
+	return fh, err
+}
+
+// Decrypt inPath without writing the plaintext and check it against the
+// checksum in its header
+func VerifyFile(inPath string, rsaPriKey []byte) error {
+	_, info, err := ReadEncHdr(inPath, rsaPriKey)
+	if err != nil {
+		return err
+	}
+	return VerifyEncFile(inPath, info)
+}
+
+// Call fn for inPath, or for each encrypted file below it if a directory
+func WalkEncFiles(inPath string, fn func(path string) error) error {
+	if !IsDirExist(inPath) {
+		return fn(inPath)
+	}
+	return filepath.Walk(inPath, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			if f.Name() == TrashDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !f.Mode().IsRegular() || IsTempFile(path) {
+			return nil
+		}
+		if _, err = ReadHdrInfo(path); err != nil {
+			return nil
+		}
+		return fn(path)
+	})
+}
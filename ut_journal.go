@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Journal file kept in the root of the directory being changed
+const JournalFileName = ".bitcrypt.journal"
+
+// Append-only record of the files a directory run has finished or failed,
+// so an interrupted run can be resumed, or rolled back if in place. The
+// first line holds the mode, each following line "done\t<quoted path>",
+// "pending\t<quoted path>" or "fail\t<quoted path>\t<quoted error>".
+type Journal struct {
+	path    string
+	file    *os.File
+	Mode    string            // "enc", "dec", "inplace-enc" or "inplace-dec"
+	Done    map[string]bool   // slash separated paths finished so far
+	Pending map[string]bool   // slash separated paths begun but not finished
+	Failed  map[string]string // slash separated paths and their last error
+}
+
+// Read the journal in dir, nil if there is none
+func ReadJournal(dir string) (*Journal, error) {
+	path := filepath.Join(dir, JournalFileName)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	j := newJournal(path, "")
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) < 2 {
+			// a torn last line from a crash
+			continue
+		}
+		if fields[0] == "mode" {
+			j.Mode = fields[1]
+			continue
+		}
+
+		relPath, err := strconv.Unquote(fields[1])
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "done":
+			j.Done[relPath] = true
+			delete(j.Pending, relPath)
+			delete(j.Failed, relPath)
+		case "pending":
+			j.Pending[relPath] = true
+		case "fail":
+			j.Failed[relPath] = ""
+			if len(fields) == 3 {
+				j.Failed[relPath], _ = strconv.Unquote(fields[2])
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if j.Mode == "" {
+		return nil, errors.New("broken journal " + path)
+	}
+	return j, nil
+}
+
+// Open the journal in dir for a run in mode, continuing an unfinished run
+// of the same mode
+func OpenJournal(dir, mode string) (*Journal, error) {
+	j, err := ReadJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+	if j != nil && j.Mode != mode {
+		return nil, errors.New("unfinished " + j.Mode + " run in " + dir + ", resume or roll it back first")
+	}
+
+	isNew := j == nil
+	if isNew {
+		j = newJournal(filepath.Join(dir, JournalFileName), mode)
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if isNew {
+		if err = j.write("mode", mode); err != nil {
+			j.file.Close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+func newJournal(path, mode string) *Journal {
+	return &Journal{
+		path:    path,
+		Mode:    mode,
+		Done:    make(map[string]bool),
+		Pending: make(map[string]bool),
+		Failed:  make(map[string]string),
+	}
+}
+
+func (j *Journal) write(kind, value string) error {
+	if _, err := j.file.WriteString(kind + "\t" + value + "\n"); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Record relPath as begun, before a change a rollback has to know about
+func (j *Journal) Begin(relPath string) error {
+	relPath = filepath.ToSlash(relPath)
+	j.Pending[relPath] = true
+	return j.write("pending", strconv.Quote(relPath))
+}
+
+// Record relPath as finished
+func (j *Journal) Add(relPath string) error {
+	relPath = filepath.ToSlash(relPath)
+	j.Done[relPath] = true
+	delete(j.Pending, relPath)
+	return j.write("done", strconv.Quote(relPath))
+}
+
+// Record relPath as failed with err
+func (j *Journal) Fail(relPath string, err error) error {
+	relPath = filepath.ToSlash(relPath)
+	j.Failed[relPath] = err.Error()
+	return j.write("fail", strconv.Quote(relPath)+"\t"+strconv.Quote(err.Error()))
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// Close and remove the journal after a completed run
+func (j *Journal) Finish() error {
+	j.file.Close()
+	if err := os.Remove(j.path); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(j.path))
+}
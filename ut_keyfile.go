@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encodings a key can be read and written in, with "-der" for DER instead
+// of PEM, or binary packets instead of armor for openpgp; pkcs1 and openpgp
+// are RSA only and sec1 ECDSA only
+var KeyEncodings = []string{"pkcs1", "pkcs8", "sec1", "spki", "pkcs1-public", "openpgp", "openpgp-secret"}
+
+// Encoding of each PEM block type; openssh keys of ssh-keygen are read only
+var pemEncodings = map[string]string{
+	"RSA PRIVATE KEY":     "pkcs1",
+	"PRIVATE KEY":         "pkcs8",
+	"EC PRIVATE KEY":      "sec1",
+	"PUBLIC KEY":          "spki",
+	"RSA PUBLIC KEY":      "pkcs1-public",
+	"OPENSSH PRIVATE KEY": "openssh",
+}
+
+// Whether enc is an encoding of private keys
+func PrivateEncoding(enc string) bool {
+	enc = strings.TrimSuffix(enc, "-der")
+	return enc == "pkcs1" || enc == "pkcs8" || enc == "sec1" || enc == "openssh" || enc == "openpgp-secret"
+}
+
+// A key read from a file, Private is nil for a public key. Keys are RSA,
+// X25519 (*ecdh), Ed25519 or ECDSA
+type KeyFile struct {
+	Encoding string
+	Private  crypto.PrivateKey
+	Public   crypto.PublicKey
+}
+
+// Parse the first key in data, PEM or DER in any of KeyEncodings
+func ParseKeyFile(data []byte) (*KeyFile, error) {
+	if blocks := pgpArmorBlocks(data); len(blocks) > 0 {
+		enc, ok := pgpArmorEncodings[blocks[0].Type]
+		if !ok {
+			return nil, errors.New("unsupported armor type " + blocks[0].Type)
+		}
+		return parseKeyDer(blocks[0].Bytes, enc)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		enc, ok := pemEncodings[block.Type]
+		if !ok {
+			return nil, errors.New("unsupported PEM type " + block.Type)
+		}
+		return parseKeyDer(block.Bytes, enc)
+	}
+
+	// DER, try each encoding
+	for _, enc := range KeyEncodings {
+		if kf, err := parseKeyDer(data, enc); err == nil {
+			kf.Encoding += "-der"
+			return kf, nil
+		}
+	}
+	return nil, errors.New("no key found")
+}
+
+func parseKeyDer(der []byte, enc string) (*KeyFile, error) {
+	kf := &KeyFile{Encoding: enc}
+	var key interface{}
+	var err error
+	switch enc {
+	case "pkcs1":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "pkcs8":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "sec1":
+		key, err = x509.ParseECPrivateKey(der)
+	case "spki":
+		key, err = x509.ParsePKIXPublicKey(der)
+	case "pkcs1-public":
+		key, err = x509.ParsePKCS1PublicKey(der)
+	case "openssh":
+		key, err = ParseOpenSshPrivateKey(der)
+	case "openpgp", "openpgp-secret":
+		var k *pgpKey
+		if k, err = parsePgpKey(der, enc == "openpgp-secret"); err == nil {
+			key = k.Public
+			if k.Private != nil {
+				key = k.Private
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, *ecdh.PrivateKey:
+		kf.Private, kf.Public = k, PublicOf(k)
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey, *ecdh.PublicKey:
+		kf.Public = k
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	if KeyType(kf.Public) == "" {
+		return nil, errors.New("unsupported curve")
+	}
+	return kf, nil
+}
+
+// Public key of priv
+func PublicOf(priv crypto.PrivateKey) crypto.PublicKey {
+	if k, ok := priv.(interface{ Public() crypto.PublicKey }); ok {
+		return k.Public()
+	}
+	return nil
+}
+
+// Name of the algorithm of pub: rsa, x25519, ed25519 or ecdsa-p256 and so
+// on, "" for keys this program can't use
+func KeyType(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return "rsa"
+	case *ecdh.PublicKey:
+		if k.Curve() == ecdh.X25519() {
+			return "x25519"
+		}
+	case ed25519.PublicKey:
+		return "ed25519"
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(strings.Replace(k.Curve.Params().Name, "-", "", 1))
+	}
+	return ""
+}
+
+// Key size in bits, of the modulus for RSA
+func KeyBits(pub crypto.PublicKey) int {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	}
+	return 256
+}
+
+func (kf *KeyFile) Kind() string {
+	if kf.Private != nil {
+		return "private"
+	}
+	return "public"
+}
+
+func (kf *KeyFile) Type() string {
+	return KeyType(kf.Public)
+}
+
+func (kf *KeyFile) Bits() int {
+	return KeyBits(kf.Public)
+}
+
+func (kf *KeyFile) Fingerprint() [32]byte {
+	return KeyFingerprint(kf.Public)
+}
+
+// Write the key in enc, one of KeyEncodings with an optional "-der" or
+// "age" for the age1... recipient of an x25519 key; a public encoding of a
+// private key gives its public key
+func (kf *KeyFile) Encode(enc string) ([]byte, error) {
+	if enc == "age" {
+		pub, ok := kf.Public.(*ecdh.PublicKey)
+		if !ok || KeyType(pub) != "x25519" {
+			return nil, errors.New("age only valid for x25519 keys")
+		}
+		return []byte(AgeRecipientString(pub) + "\n"), nil
+	}
+	der := strings.HasSuffix(enc, "-der")
+	enc = strings.TrimSuffix(enc, "-der")
+	if PrivateEncoding(enc) && kf.Private == nil {
+		return nil, errors.New(enc + " needs a private key")
+	}
+	if enc == "openpgp" || enc == "openpgp-secret" {
+		return pgpEncodeKey(kf, enc == "openpgp-secret", der)
+	}
+
+	var block pem.Block
+	var err error
+	switch enc {
+	case "pkcs1":
+		priv, ok := kf.Private.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("pkcs1 only valid for rsa keys")
+		}
+		block.Type, block.Bytes = "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv)
+	case "pkcs8":
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(kf.Private)
+	case "sec1":
+		priv, ok := kf.Private.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("sec1 only valid for ecdsa keys")
+		}
+		block.Type = "EC PRIVATE KEY"
+		block.Bytes, err = x509.MarshalECPrivateKey(priv)
+	case "spki":
+		block.Type = "PUBLIC KEY"
+		block.Bytes, err = x509.MarshalPKIXPublicKey(kf.Public)
+	case "pkcs1-public":
+		pub, ok := kf.Public.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("pkcs1-public only valid for rsa keys")
+		}
+		block.Type, block.Bytes = "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(pub)
+	default:
+		return nil, errors.New("unknown key encoding " + enc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if der {
+		return block.Bytes, nil
+	}
+	return pem.EncodeToMemory(&block), nil
+}
+
+// All keys in pemData, which may hold several PEM blocks and armored
+// OpenPGP keys, private ones if private is set and public ones otherwise
+func pemKeys(pemData []byte, private bool) ([]*KeyFile, error) {
+	var keys []*KeyFile
+	for rest := pemData; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		enc, ok := pemEncodings[block.Type]
+		if !ok || PrivateEncoding(enc) != private {
+			continue
+		}
+
+		kf, err := parseKeyDer(block.Bytes, enc)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, kf)
+	}
+	pgpKeys, err := pgpBundleKeys(pemData, private)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, pgpKeys...), nil
+}
+
+// All public keys in pemData
+func PublicKeys(pemData []byte) ([]crypto.PublicKey, error) {
+	keys, err := pemKeys(pemData, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("public key error")
+	}
+
+	var pubs []crypto.PublicKey
+	for _, kf := range keys {
+		pubs = append(pubs, kf.Public)
+	}
+	return pubs, nil
+}
+
+// All private keys in pemData
+func PrivateKeys(pemData []byte) ([]crypto.PrivateKey, error) {
+	keys, err := pemKeys(pemData, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("private key error!")
+	}
+
+	var privs []crypto.PrivateKey
+	for _, kf := range keys {
+		privs = append(privs, kf.Private)
+	}
+	return privs, nil
+}
+
+// SHA-256 of the PKIX encoding of pub, as recorded in file headers
+func KeyFingerprint(pub crypto.PublicKey) [32]byte {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	return sha256.Sum256(der)
+}
+
+// Short key ID of a fingerprint, its first 8 bytes in hex
+func KeyID(fprt [32]byte) string {
+	return hex.EncodeToString(fprt[:8])
+}
+
+// Short form of a fingerprint for comparing by eye, its key ID in groups
+// of four
+func FingerprintHuman(fprt [32]byte) string {
+	id := KeyID(fprt)
+	var groups []string
+	for i := 0; i < len(id); i += 4 {
+		groups = append(groups, id[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// Fingerprint in the base64 form ssh-keygen -l uses
+func FingerprintSSH(fprt [32]byte) string {
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(fprt[:])
+}
+
+// A key file as shown by key list and key fingerprint
+type KeyInfo struct {
+	Path        string `json:"path"`
+	Kind        string `json:"kind"` // "private" or "public"
+	Type        string `json:"type"`
+	Bits        int    `json:"bits"`
+	Encoding    string `json:"encoding"`
+	Fingerprint string `json:"fingerprint"`
+	Short       string `json:"short"`
+	SSH         string `json:"ssh,omitempty"` // as ssh-keygen -l shows it
+}
+
+func ReadKeyInfo(path string) (*KeyInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kf, err := ParseKeyFile(data)
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+
+	fprt := kf.Fingerprint()
+	ki := &KeyInfo{
+		Path:        path,
+		Kind:        kf.Kind(),
+		Type:        kf.Type(),
+		Bits:        kf.Bits(),
+		Encoding:    kf.Encoding,
+		Fingerprint: FingerprintString(fprt),
+		Short:       FingerprintHuman(fprt),
+	}
+	if blob, err := SshPublicKeyBlob(kf.Public); err == nil {
+		ki.SSH = SshFingerprint(blob)
+	}
+	return ki, nil
+}
+
+// Keys among the files of dir, other files are left out
+func ListKeys(dir string) ([]*KeyInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*KeyInfo
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || fi.Size() > 1<<20 {
+			continue
+		}
+		if ki, err := ReadKeyInfo(filepath.Join(dir, fi.Name())); err == nil {
+			list = append(list, ki)
+		}
+	}
+	return list, nil
+}
+
+// Key types keygen can generate
+var KeyGenTypes = []string{"rsa", "x25519", "ed25519", "ecdsa"}
+
+// Names of the key files GenKey writes for keyType, private.pem and
+// public.pem for RSA and prefixed by the type otherwise
+func KeyFileNames(keyType string) (string, string) {
+	if keyType == "rsa" {
+		return "private.pem", "public.pem"
+	}
+	return keyType + "-private.pem", keyType + "-public.pem"
+}
+
+// Gen a key pair of keyType in filePath, bits is only used for RSA; ecdsa
+// is on P-256
+func GenKey(filePath, keyType string, bits int) error {
+	if keyType == "rsa" {
+		return RsaGenKey(filePath, bits)
+	}
+
+	var priv crypto.PrivateKey
+	var err error
+	switch keyType {
+	case "x25519":
+		priv, err = ecdh.X25519().GenerateKey(rand.Reader)
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return errors.New("unknown key type " + keyType)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !IsDirExist(filePath) {
+		os.Mkdir(filePath, 0700)
+	}
+	privName, pubName := KeyFileNames(keyType)
+	privPath := filepath.Join(filePath, privName)
+	pubPath := filepath.Join(filePath, pubName)
+	if IsFileExist(privPath) || IsFileExist(pubPath) {
+		return errors.New(keyType + " key files already exist at " + filePath)
+	}
+
+	kf := &KeyFile{Private: priv, Public: PublicOf(priv)}
+	for _, f := range []struct{ path, enc string }{{privPath, "pkcs8"}, {pubPath, "spki"}} {
+		data, err := kf.Encode(f.enc)
+		if err != nil {
+			return err
+		}
+		if err = WriteFileAtomic(f.path, data, 0400); err != nil {
+			return err
+		}
+	}
+	return nil
+}
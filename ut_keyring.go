@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directory of private keys in identities/<alias>.pem, tried in turn when
+// decrypting, and public keys in recipients/<alias>.pem to encrypt for
+type Keyring struct {
+	Dir string
+}
+
+type KeyringEntry struct {
+	Alias       string `json:"alias"`
+	Kind        string `json:"kind"` // "identity" or "recipient"
+	Path        string `json:"path"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func OpenKeyring(dir string) *Keyring {
+	return &Keyring{Dir: dir}
+}
+
+func validAlias(alias string) bool {
+	if alias == "" || alias[0] == '.' {
+		return false
+	}
+	for _, c := range alias {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-' || c == '@') {
+			return false
+		}
+	}
+	return true
+}
+
+func (kr *Keyring) path(kind, alias string) string {
+	dir := "recipients"
+	if kind == "identity" {
+		dir = "identities"
+	}
+	return filepath.Join(kr.Dir, dir, alias+".pem")
+}
+
+// Add the key in pemData under alias; a private key is added as identity
+// and its public key as recipient
+func (kr *Keyring) Add(alias string, pemData []byte) error {
+	if !validAlias(alias) {
+		return errors.New("invalid alias " + alias)
+	}
+	if IsFileExist(kr.path("identity", alias)) || IsFileExist(kr.path("recipient", alias)) {
+		return errors.New("alias " + alias + " already exist")
+	}
+
+	pubData := pemData
+	if privs, err := PrivateKeys(pemData); err == nil {
+		if len(privs) != 1 {
+			return errors.New("one key per alias")
+		}
+		der, err := x509.MarshalPKIXPublicKey(PublicOf(privs[0]))
+		if err != nil {
+			return err
+		}
+		pubData = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+		if err = kr.write("identity", alias, pemData, 0600); err != nil {
+			return err
+		}
+	} else if pubs, err := PublicKeys(pemData); err != nil {
+		return errors.New("no key found")
+	} else if len(pubs) != 1 {
+		return errors.New("one key per alias")
+	}
+	return kr.write("recipient", alias, pubData, 0644)
+}
+
+func (kr *Keyring) write(kind, alias string, data []byte, perm os.FileMode) error {
+	path := kr.path(kind, alias)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, perm)
+}
+
+// Remove the identity and recipient of alias
+func (kr *Keyring) Remove(alias string) error {
+	found := false
+	for _, kind := range []string{"identity", "recipient"} {
+		err := os.Remove(kr.path(kind, alias))
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !found {
+		return errors.New("alias " + alias + " isn't exist")
+	}
+	return nil
+}
+
+// All keys, identities first, each by alias; keys that don't parse are
+// left out with a warning
+func (kr *Keyring) List() ([]*KeyringEntry, error) {
+	var list []*KeyringEntry
+	for _, kind := range []string{"identity", "recipient"} {
+		paths, _ := filepath.Glob(kr.path(kind, "*"))
+		sort.Strings(paths)
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			fprt, err := pemFingerprint(data)
+			if err != nil {
+				log.Println("Skip keyring "+kind, path+":", err.Error())
+				continue
+			}
+			list = append(list, &KeyringEntry{
+				Alias:       strings.TrimSuffix(filepath.Base(path), ".pem"),
+				Kind:        kind,
+				Path:        path,
+				Fingerprint: FingerprintString(fprt),
+			})
+		}
+	}
+	return list, nil
+}
+
+// Fingerprint of the first key in pemData, public or private
+func pemFingerprint(pemData []byte) ([32]byte, error) {
+	if privs, err := PrivateKeys(pemData); err == nil {
+		return KeyFingerprint(PublicOf(privs[0])), nil
+	}
+	pubs, err := PublicKeys(pemData)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return KeyFingerprint(pubs[0]), nil
+}
+
+// Public key of a recipient by alias or by a fingerprint prefix of at
+// least 8 hex digits
+func (kr *Keyring) Recipient(name string) ([]byte, error) {
+	list, err := kr.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *KeyringEntry
+	for _, ent := range list {
+		if ent.Kind != "recipient" {
+			continue
+		}
+		if ent.Alias == name || len(name) >= 8 && strings.HasPrefix(ent.Fingerprint, strings.ToLower(name)) {
+			if found != nil && found.Fingerprint != ent.Fingerprint {
+				return nil, errors.New("recipient " + name + " is ambiguous")
+			}
+			found = ent
+		}
+	}
+	if found == nil {
+		return nil, errors.New("recipient " + name + " isn't exist in keyring " + kr.Dir)
+	}
+	return ioutil.ReadFile(found.Path)
+}
+
+// All identities as one PEM bundle, for UnwrapAesInfo to choose from; an
+// identity that doesn't parse is left out with a warning rather than
+// spoiling the bundle for the others
+func (kr *Keyring) Identities() ([]byte, error) {
+	paths, _ := filepath.Glob(kr.path("identity", "*"))
+	sort.Strings(paths)
+
+	var bundle []byte
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = PrivateKeys(data); err != nil {
+			log.Println("Skip keyring identity", path+":", err.Error())
+			continue
+		}
+		bundle = append(bundle, data...)
+		bundle = append(bundle, '\n')
+	}
+	return bundle, nil
+}
+
+// Alias of the key with fingerprint fprt, "" if unknown
+func (kr *Keyring) Alias(fprt [32]byte) string {
+	list, _ := kr.List()
+	for _, ent := range list {
+		if ent.Fingerprint == FingerprintString(fprt) {
+			return ent.Alias
+		}
+	}
+	return ""
+}
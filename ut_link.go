@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// Device and inode of a file
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// Outputs written for files with more than one hard link, so the other
+// names are linked to the same output instead of encrypted again
+type HardLinks map[FileID]string
+
+// Output already written for another name of fi, "" if none; the link count
+// isn't checked as it drops when sources are removed during the run
+func (links HardLinks) Output(fi os.FileInfo) string {
+	id, _ := FileLinkID(fi)
+	if id == (FileID{}) {
+		return ""
+	}
+	return links[id]
+}
+
+func (links HardLinks) Add(fi os.FileInfo, outPath string) {
+	if id, nlink := FileLinkID(fi); nlink > 1 {
+		links[id] = outPath
+	}
+}
+
+// Make outPath a hard link to the output firstPath
+func LinkOutput(firstPath, outPath string) error {
+	if IsSameFile(firstPath, outPath) {
+		return nil
+	}
+	if err := os.Remove(outPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(firstPath, outPath)
+}
+
+// Recreate the symlink path at outPath with the same target; the target is
+// stored as is, not encrypted
+func CopySymlink(path, outPath string) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(outPath); err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return errors.New("output exists and is not a symlink")
+		}
+		if old, _ := os.Readlink(outPath); old == target {
+			return nil
+		}
+		if err = os.Remove(outPath); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, outPath)
+}
+
+// What a walked entry that isn't a directory is to be handled as: the
+// symlink itself if symlinks are kept, else the regular file, followed if a
+// symlink; nil for directory symlinks and special files, which are skipped
+func WalkFileInfo(path string, f os.FileInfo, follow bool) (os.FileInfo, error) {
+	if f.Mode()&os.ModeSymlink != 0 {
+		if !follow {
+			return f, nil
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			log.Println("Skip symlink to directory:", path)
+			return nil, nil
+		}
+		f = fi
+	}
+	if !f.Mode().IsRegular() {
+		log.Println("Skip special file:", path)
+		return nil, nil
+	}
+	return f, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Trash directory kept in the root of a mirrored output directory
+const TrashDirName = ".bitcrypt.trash"
+
+// Find outputs in dstDir without a corresponding source in srcDir and
+// remove them, or move them to the trash directory. srcName maps a file
+// path relative to dstDir back to its source name, "" means not ours.
+// Only files that idx records as made from srcDir are orphans, paths
+// excluded by rules (read from the plaintext side) are left alone, and
+// directories are only removed once emptied. With opts.DryRun the orphans
+// are only listed.
+func MirrorOrphans(srcDir, dstDir string, srcName func(relPath string) string, rules *IgnoreRules, idx *DirIndex, opts *DirOptions) ([]string, error) {
+	if srcDir == dstDir {
+		return nil, errors.New("mirror needs an output directory apart from the source")
+	}
+	if !IsDirExist(dstDir) {
+		return nil, nil
+	}
+
+	var orphans []string
+	err := filepath.Walk(dstDir, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dstDir, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." || relPath == IndexFileName || relPath == JournalFileName {
+			return nil
+		}
+		if relPath == TrashDirName {
+			return filepath.SkipDir
+		}
+
+		if rules.Excluded(strings.TrimSuffix(relPath, ".enc"), f.IsDir()) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if f.IsDir() {
+			return nil
+		}
+
+		name := srcName(relPath)
+		if f.Mode()&os.ModeSymlink != 0 {
+			// kept symlinks have the same name on both sides
+			name = relPath
+		}
+		if name != "" && idx.Has(name) {
+			if _, err := os.Lstat(filepath.Join(srcDir, name)); os.IsNotExist(err) {
+				orphans = append(orphans, relPath)
+			}
+		}
+		return nil
+	})
+	if err != nil || opts.DryRun {
+		for _, relPath := range orphans {
+			log.Println("Orphan:", filepath.Join(dstDir, relPath))
+		}
+		return orphans, err
+	}
+
+	trashDir := filepath.Join(dstDir, TrashDirName, time.Now().Format("20060102-150405"))
+	for _, relPath := range orphans {
+		path := filepath.Join(dstDir, relPath)
+		if opts.Trash {
+			log.Println("Trash orphan:", path)
+			trashPath := filepath.Join(trashDir, relPath)
+			err = os.MkdirAll(filepath.Dir(trashPath), 0700)
+			if err == nil {
+				err = os.Rename(path, trashPath)
+			}
+		} else {
+			log.Println("Remove orphan:", path)
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return orphans, err
+		}
+		removeOrphanDirs(srcDir, dstDir, filepath.Dir(relPath))
+	}
+	return orphans, nil
+}
+
+// Remove the directories of relDir that are left empty and have no source
+// directory any more, deepest first
+func removeOrphanDirs(srcDir, dstDir, relDir string) {
+	for relDir != "." && relDir != string(filepath.Separator) {
+		if IsDirExist(filepath.Join(srcDir, relDir)) {
+			return
+		}
+		if os.Remove(filepath.Join(dstDir, relDir)) != nil {
+			return
+		}
+		relDir = filepath.Dir(relDir)
+	}
+}
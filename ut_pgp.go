@@ -0,0 +1,1286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/zlib"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenPGP messages (RFC 4880) as GnuPG writes them for RSA keys: a session
+// key encrypted to each recipient, then the data in a symmetrically
+// encrypted integrity protected packet (SEIPD version 1, AES in CFB mode
+// checked by a SHA-1 modification detection code), maybe compressed
+
+const (
+	pgpTagPKESK        = 1
+	pgpTagSignature    = 2
+	pgpTagSKESK        = 3
+	pgpTagOnePassSig   = 4
+	pgpTagSecretKey    = 5
+	pgpTagPublicKey    = 6
+	pgpTagSecretSubkey = 7
+	pgpTagCompressed   = 8
+	pgpTagSED          = 9
+	pgpTagMarker       = 10
+	pgpTagLiteral      = 11
+	pgpTagTrust        = 12
+	pgpTagUserID       = 13
+	pgpTagPublicSubkey = 14
+	pgpTagUserAttr     = 17
+	pgpTagSEIPD        = 18
+	pgpTagMDC          = 19
+	pgpTagAEAD         = 20
+	pgpTagPadding      = 21
+
+	pgpAlgoRSA        = 1
+	pgpAlgoRSAEncrypt = 2
+	pgpAlgoRSASign    = 3
+	pgpCipherAES256   = 9
+	pgpHashSHA256     = 8
+
+	pgpPartSize  = 1 << 16
+	pgpMdcSize   = 22
+	pgpCrc24Init = 0xb704ce
+
+	pgpArmorMessage = "PGP MESSAGE"
+	pgpArmorPublic  = "PGP PUBLIC KEY BLOCK"
+	pgpArmorSecret  = "PGP PRIVATE KEY BLOCK"
+)
+
+// User ID of exported OpenPGP keys, "bitcrypt <key ID>" if empty
+var PgpUserID = ""
+
+// Encoding of each armored OpenPGP key block type
+var pgpArmorEncodings = map[string]string{
+	pgpArmorPublic: "openpgp",
+	pgpArmorSecret: "openpgp-secret",
+}
+
+// Key size of the AES cipher algorithms, 0 for others
+func pgpCipherKeySize(algo byte) int {
+	switch algo {
+	case 7:
+		return 16
+	case 8:
+		return 24
+	case pgpCipherAES256:
+		return 32
+	}
+	return 0
+}
+
+// Body of a packet, across the partial lengths of a new format header; n
+// is -1 for an old format packet that runs to the end of r
+type pgpBodyReader struct {
+	r       *bufio.Reader
+	n       int64
+	partial bool
+}
+
+func (b *pgpBodyReader) Read(p []byte) (int, error) {
+	for b.n == 0 {
+		if !b.partial {
+			return 0, io.EOF
+		}
+		var err error
+		if b.n, b.partial, err = readPgpLength(b.r); err != nil {
+			return 0, err
+		}
+	}
+	if b.n < 0 {
+		return b.r.Read(p)
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.r.Read(p)
+	b.n -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Length of a new format packet, and whether it is a partial one
+func readPgpLength(r *bufio.Reader) (int64, bool, error) {
+	o1, err := r.ReadByte()
+	if err != nil {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+	switch {
+	case o1 < 192:
+		return int64(o1), false, nil
+	case o1 < 224:
+		o2, err := r.ReadByte()
+		if err != nil {
+			return 0, false, io.ErrUnexpectedEOF
+		}
+		return int64(o1-192)<<8 + int64(o2) + 192, false, nil
+	case o1 < 255:
+		return 1 << (o1 & 0x1f), true, nil
+	}
+	var b [4]byte
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+	return int64(binary.BigEndian.Uint32(b[:])), false, nil
+}
+
+// Tag and body of the next packet at r, io.EOF after the last one
+func readPgpPacket(r *bufio.Reader) (int, io.Reader, error) {
+	ctb, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if ctb&0x80 == 0 {
+		return 0, nil, errors.New("invalid openpgp packet")
+	}
+	body := &pgpBodyReader{r: r}
+	if ctb&0x40 != 0 {
+		body.n, body.partial, err = readPgpLength(r)
+		return int(ctb & 0x3f), body, err
+	}
+
+	if ctb&3 == 3 {
+		body.n = -1
+	} else {
+		var b [4]byte
+		size := 1 << (ctb & 3)
+		if _, err = io.ReadFull(r, b[4-size:]); err != nil {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		body.n = int64(binary.BigEndian.Uint32(b[:]))
+	}
+	return int(ctb>>2) & 0xf, body, nil
+}
+
+// New format length of n
+func pgpLength(n int) []byte {
+	switch {
+	case n < 192:
+		return []byte{byte(n)}
+	case n < 8384:
+		n -= 192
+		return []byte{byte(n>>8) + 192, byte(n)}
+	}
+	return []byte{255, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func pgpPacket(tag int, body []byte) []byte {
+	return append(append([]byte{0xc0 | byte(tag)}, pgpLength(len(body))...), body...)
+}
+
+// Writes a packet of unknown length in partial lengths of pgpPartSize
+type pgpPartialWriter struct {
+	w       io.Writer
+	tag     int
+	buf     []byte
+	started bool
+}
+
+func (pw *pgpPartialWriter) head() []byte {
+	if pw.started {
+		return nil
+	}
+	pw.started = true
+	return []byte{0xc0 | byte(pw.tag)}
+}
+
+func (pw *pgpPartialWriter) flush(hdr []byte, n int) error {
+	if _, err := pw.w.Write(append(hdr, pw.buf[:n]...)); err != nil {
+		return err
+	}
+	pw.buf = append(pw.buf[:0], pw.buf[n:]...)
+	return nil
+}
+
+func (pw *pgpPartialWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	// the last part has a plain length, so one full part is kept back
+	for len(pw.buf) > pgpPartSize {
+		if err := pw.flush(append(pw.head(), 0xe0|16), pgpPartSize); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (pw *pgpPartialWriter) Close() error {
+	return pw.flush(append(pw.head(), pgpLength(len(pw.buf))...), len(pw.buf))
+}
+
+func pgpMPI(n *big.Int) []byte {
+	bits := n.BitLen()
+	return append([]byte{byte(bits >> 8), byte(bits)}, n.Bytes()...)
+}
+
+// MPI at the front of b, and the rest of b
+func readPgpMPI(b []byte) (*big.Int, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("invalid openpgp mpi")
+	}
+	n := (int(b[0])<<8 | int(b[1]) + 7) / 8
+	if len(b) < 2+n {
+		return nil, nil, errors.New("invalid openpgp mpi")
+	}
+	return new(big.Int).SetBytes(b[2 : 2+n]), b[2+n:], nil
+}
+
+func pgpCrc24(crc uint32, p []byte) uint32 {
+	for _, c := range p {
+		crc ^= uint32(c) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+// Writes an armored block: base64 lines of 64 columns, then the CRC-24
+type pgpArmorWriter struct {
+	w   io.Writer
+	typ string
+	enc io.WriteCloser
+	crc uint32
+	col int
+}
+
+func newPgpArmorWriter(w io.Writer, typ string) (*pgpArmorWriter, error) {
+	if _, err := io.WriteString(w, "-----BEGIN "+typ+"-----\n\n"); err != nil {
+		return nil, err
+	}
+	a := &pgpArmorWriter{w: w, typ: typ, crc: pgpCrc24Init}
+	a.enc = base64.NewEncoder(base64.StdEncoding, pgpLineWriter{a})
+	return a, nil
+}
+
+type pgpLineWriter struct {
+	a *pgpArmorWriter
+}
+
+func (l pgpLineWriter) Write(p []byte) (int, error) {
+	a, n := l.a, 0
+	for len(p) > 0 {
+		if a.col == 64 {
+			if _, err := a.w.Write([]byte{'\n'}); err != nil {
+				return n, err
+			}
+			a.col = 0
+		}
+		k := min(64-a.col, len(p))
+		if _, err := a.w.Write(p[:k]); err != nil {
+			return n, err
+		}
+		a.col += k
+		n += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (a *pgpArmorWriter) Write(p []byte) (int, error) {
+	a.crc = pgpCrc24(a.crc, p)
+	return a.enc.Write(p)
+}
+
+func (a *pgpArmorWriter) Close() error {
+	if err := a.enc.Close(); err != nil {
+		return err
+	}
+	sum := []byte{byte(a.crc >> 16), byte(a.crc >> 8), byte(a.crc)}
+	end := "=" + base64.StdEncoding.EncodeToString(sum) + "\n-----END " + a.typ + "-----\n"
+	if a.col > 0 {
+		end = "\n" + end
+	}
+	_, err := io.WriteString(a.w, end)
+	return err
+}
+
+// Armor of a whole block
+func pgpArmor(typ string, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	a, _ := newPgpArmorWriter(buf, typ)
+	a.Write(data)
+	a.Close()
+	return buf.Bytes()
+}
+
+// Reads the data of an armored block, checking its CRC-24 if it has one
+type pgpArmorReader struct {
+	r       *bufio.Reader
+	end     string
+	pending string
+	unread  []byte
+	crc     uint32
+	done    bool
+}
+
+// Reader of the first armored block at r, and its type
+func newPgpArmorReader(r *bufio.Reader) (*pgpArmorReader, string, error) {
+	a := &pgpArmorReader{r: r, crc: pgpCrc24Init}
+	for {
+		line, err := a.line()
+		if err != nil {
+			return nil, "", errors.New("no openpgp armor found")
+		}
+		if !strings.HasPrefix(line, "-----BEGIN PGP ") || !strings.HasSuffix(line, "-----") {
+			continue
+		}
+		typ := strings.TrimSuffix(strings.TrimPrefix(line, "-----BEGIN "), "-----")
+		a.end = "-----END " + typ + "-----"
+
+		// headers up to a blank line, which some writers leave out
+		for {
+			if line, err = a.line(); err != nil {
+				return nil, "", err
+			}
+			if line == "" {
+				return a, typ, nil
+			}
+			if !strings.Contains(line, ": ") {
+				return a, typ, a.data(line)
+			}
+		}
+	}
+}
+
+func (a *pgpArmorReader) line() (string, error) {
+	line, err := a.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("openpgp armor truncated")
+	}
+	return strings.TrimRight(line, " \t\r\n"), nil
+}
+
+// Take one line of the block
+func (a *pgpArmorReader) data(line string) error {
+	invalid := errors.New("invalid openpgp armor")
+	switch {
+	case line == a.end:
+		return a.finish(nil)
+	case len(line) == 5 && line[0] == '=':
+		sum, err := base64.StdEncoding.DecodeString(line[1:])
+		if err != nil {
+			return invalid
+		}
+		if line, err = a.line(); err != nil || line != a.end {
+			return invalid
+		}
+		return a.finish(sum)
+	}
+	s := a.pending + line
+	cut := len(s) - len(s)%4
+	b, err := base64.StdEncoding.DecodeString(s[:cut])
+	if err != nil {
+		return invalid
+	}
+	a.pending = s[cut:]
+	a.crc = pgpCrc24(a.crc, b)
+	a.unread = b
+	return nil
+}
+
+func (a *pgpArmorReader) finish(sum []byte) error {
+	if a.pending != "" {
+		return errors.New("invalid openpgp armor")
+	}
+	if sum != nil && uint32(sum[0])<<16|uint32(sum[1])<<8|uint32(sum[2]) != a.crc {
+		return errors.New("openpgp armor checksum mismatch")
+	}
+	a.done = true
+	return nil
+}
+
+func (a *pgpArmorReader) Read(p []byte) (int, error) {
+	for len(a.unread) == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		line, err := a.line()
+		if err != nil {
+			return 0, err
+		}
+		if err = a.data(line); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, a.unread)
+	a.unread = a.unread[n:]
+	return n, nil
+}
+
+// Armored OpenPGP blocks in data, decoded; broken ones are left out
+func pgpArmorBlocks(data []byte) []*pem.Block {
+	var blocks []*pem.Block
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		a, typ, err := newPgpArmorReader(r)
+		if err != nil {
+			return blocks
+		}
+		if b, err := io.ReadAll(a); err == nil {
+			blocks = append(blocks, &pem.Block{Type: typ, Bytes: b})
+		}
+	}
+}
+
+// An RSA key of an OpenPGP key, Private nil for a public one; keys of other
+// algorithms only have Algo
+type pgpKey struct {
+	Algo    byte
+	KeyID   [8]byte
+	Public  *rsa.PublicKey
+	Private *rsa.PrivateKey
+	flags   byte  // key flags of its self-signature, 0 if it has none
+	revoked bool  // by a revocation signature
+	err     error // why a secret key has no Private
+}
+
+// Version 4 fingerprint of a public key packet body
+func pgpFingerprint(pub []byte) [20]byte {
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(len(pub) >> 8), byte(len(pub))})
+	h.Write(pub)
+	var fp [20]byte
+	copy(fp[:], h.Sum(nil))
+	return fp
+}
+
+func pgpKeyID(pub []byte) [8]byte {
+	fp := pgpFingerprint(pub)
+	var id [8]byte
+	copy(id[:], fp[12:])
+	return id
+}
+
+// Public key packet body of pub. The creation time is fixed so that the
+// key of a PEM file always converts to the same fingerprint
+func pgpPublicKeyBody(pub *rsa.PublicKey) []byte {
+	body := []byte{4, 0, 0, 0, 0, pgpAlgoRSA}
+	body = append(body, pgpMPI(pub.N)...)
+	return append(body, pgpMPI(big.NewInt(int64(pub.E)))...)
+}
+
+// OpenPGP key of a PEM RSA public key
+func pgpRsaKey(pub *rsa.PublicKey) *pgpKey {
+	return &pgpKey{Algo: pgpAlgoRSA, KeyID: pgpKeyID(pgpPublicKeyBody(pub)), Public: pub}
+}
+
+// Parse a version 4 key packet, of a secret key if secret
+func parsePgpKeyPacket(b []byte, secret bool) (*pgpKey, error) {
+	if len(b) < 6 || b[0] != 4 {
+		return nil, errors.New("unsupported openpgp key version")
+	}
+	k := &pgpKey{Algo: b[5]}
+	if k.Algo != pgpAlgoRSA && k.Algo != pgpAlgoRSAEncrypt && k.Algo != pgpAlgoRSASign {
+		return k, nil
+	}
+	invalid := errors.New("invalid openpgp rsa key")
+	n, rest, err := readPgpMPI(b[6:])
+	if err != nil {
+		return nil, invalid
+	}
+	e, rest, err := readPgpMPI(rest)
+	if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, invalid
+	}
+	k.Public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	k.KeyID = pgpKeyID(b[:len(b)-len(rest)])
+	if !secret {
+		return k, nil
+	}
+
+	if len(rest) == 0 {
+		return nil, invalid
+	}
+	if rest[0] != 0 {
+		k.err = errors.New("openpgp secret key has a passphrase, remove it with gpg --change-passphrase")
+		return k, nil
+	}
+	rest = rest[1:]
+	mpis, sum := rest, 0
+	var x [4]*big.Int // d, p, q and u
+	for i := range x {
+		if x[i], rest, err = readPgpMPI(rest); err != nil {
+			return nil, invalid
+		}
+	}
+	if len(rest) != 2 {
+		return nil, invalid
+	}
+	for _, c := range mpis[:len(mpis)-2] {
+		sum += int(c)
+	}
+	if uint16(sum) != binary.BigEndian.Uint16(rest) {
+		return nil, errors.New("openpgp secret key checksum mismatch")
+	}
+	priv := &rsa.PrivateKey{PublicKey: *k.Public, D: x[0], Primes: []*big.Int{x[1], x[2]}}
+	if err = priv.Validate(); err != nil {
+		return nil, err
+	}
+	priv.Precompute()
+	k.Private = priv
+	return k, nil
+}
+
+// Type and key flags of a version 4 signature, flags 0 if it has none
+func pgpSigFlags(b []byte) (byte, byte) {
+	if len(b) < 6 || b[0] != 4 {
+		return 0, 0
+	}
+	n := int(b[4])<<8 | int(b[5])
+	if len(b) < 6+n {
+		return b[1], 0
+	}
+	for sub := b[6 : 6+n]; len(sub) > 0; {
+		size, hdr := int(sub[0]), 1
+		switch {
+		case sub[0] >= 255 && len(sub) >= 5:
+			size, hdr = int(binary.BigEndian.Uint32(sub[1:5])), 5
+		case sub[0] >= 192 && len(sub) >= 2:
+			size, hdr = (int(sub[0])-192)<<8+int(sub[1])+192, 2
+		}
+		if size < 0 || len(sub) < hdr+size {
+			break
+		}
+		if body := sub[hdr : hdr+size]; len(body) >= 2 && body[0]&0x7f == 27 {
+			return b[1], body[1]
+		}
+		sub = sub[hdr+size:]
+	}
+	return b[1], 0
+}
+
+// The key of the OpenPGP key in data that encrypts, the first encryption
+// subkey or else the primary key, secret if secret. Signatures aren't
+// verified: the key is as trusted as the file it came from
+func parsePgpKey(data []byte, secret bool) (*pgpKey, error) {
+	keyTag, subTag := pgpTagPublicKey, pgpTagPublicSubkey
+	if secret {
+		keyTag, subTag = pgpTagSecretKey, pgpTagSecretSubkey
+	}
+
+	var keys []*pgpKey
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		tag, body, err := readPgpPacket(r)
+		if err == io.EOF || tag == keyTag && len(keys) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 && tag != keyTag {
+			return nil, errors.New("no openpgp key found")
+		}
+		switch tag {
+		case keyTag, subTag:
+			k, err := parsePgpKeyPacket(b, secret)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		case pgpTagSignature:
+			k := keys[len(keys)-1]
+			switch typ, flags := pgpSigFlags(b); {
+			case typ == 0x20 || typ == 0x28:
+				k.revoked = true
+			case flags != 0:
+				k.flags = flags
+			}
+		case pgpTagUserID, pgpTagUserAttr, pgpTagTrust, pgpTagMarker, pgpTagPadding:
+		default:
+			return nil, errors.New("unexpected openpgp packet " + strconv.Itoa(tag) + " in a key")
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no openpgp key found")
+	}
+	if keys[0].revoked {
+		return nil, errors.New("openpgp key is revoked")
+	}
+
+	var k *pgpKey
+	for _, sub := range keys[1:] {
+		if !sub.revoked && sub.flags&0x0c != 0 {
+			k = sub
+			break
+		}
+	}
+	if k == nil && (keys[0].flags == 0 || keys[0].flags&0x0c != 0) {
+		k = keys[0]
+	}
+	if k == nil {
+		return nil, errors.New("openpgp key has no encryption key")
+	}
+	if k.Public == nil || k.Algo == pgpAlgoRSASign {
+		return nil, errors.New("openpgp key of algorithm " + strconv.Itoa(int(k.Algo)) + " can't be used, only rsa keys can")
+	}
+	if k.err != nil {
+		return nil, k.err
+	}
+	return k, nil
+}
+
+func pgpSubpacket(typ byte, data []byte) []byte {
+	return append([]byte{byte(1 + len(data)), typ}, data...)
+}
+
+func pgpUint32(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// Secret part of a secret key packet of priv: unprotected d, p, q and u
+func pgpSecretRsa(priv *rsa.PrivateKey) ([]byte, error) {
+	if len(priv.Primes) != 2 {
+		return nil, errors.New("openpgp only valid for two prime rsa keys")
+	}
+	p, q := priv.Primes[0], priv.Primes[1]
+	if p.Cmp(q) > 0 {
+		p, q = q, p
+	}
+	u := new(big.Int).ModInverse(p, q)
+	var mpis []byte
+	for _, x := range []*big.Int{priv.D, p, q, u} {
+		mpis = append(mpis, pgpMPI(x)...)
+	}
+	sum := 0
+	for _, c := range mpis {
+		sum += int(c)
+	}
+	return append(append([]byte{0}, mpis...), byte(sum>>8), byte(sum)), nil
+}
+
+// Transferable OpenPGP key of priv, with the secret key if secret: one
+// primary key to certify, sign and encrypt, and a user ID it certifies
+func pgpKeyPackets(priv *rsa.PrivateKey, secret bool) ([]byte, error) {
+	pub := pgpPublicKeyBody(&priv.PublicKey)
+	fp := pgpFingerprint(pub)
+	uid := PgpUserID
+	if uid == "" {
+		uid = "bitcrypt " + KeyID(KeyFingerprint(&priv.PublicKey))
+	}
+
+	var hashed []byte
+	hashed = append(hashed, pgpSubpacket(2, pgpUint32(uint32(time.Now().Unix())))...)
+	hashed = append(hashed, pgpSubpacket(27, []byte{0x0f})...)
+	hashed = append(hashed, pgpSubpacket(11, []byte{pgpCipherAES256, 8, 7})...)
+	hashed = append(hashed, pgpSubpacket(21, []byte{pgpHashSHA256, 10, 9})...)
+	hashed = append(hashed, pgpSubpacket(22, []byte{2, 1, 0})...)
+	hashed = append(hashed, pgpSubpacket(30, []byte{1})...)
+	hashed = append(hashed, pgpSubpacket(33, append([]byte{4}, fp[:]...))...)
+	sig := append([]byte{4, 0x13, pgpAlgoRSA, pgpHashSHA256, byte(len(hashed) >> 8), byte(len(hashed))}, hashed...)
+
+	h := sha256.New()
+	h.Write([]byte{0x99, byte(len(pub) >> 8), byte(len(pub))})
+	h.Write(pub)
+	h.Write(append([]byte{0xb4}, pgpUint32(uint32(len(uid)))...))
+	h.Write([]byte(uid))
+	h.Write(sig)
+	h.Write(append([]byte{4, 0xff}, pgpUint32(uint32(len(sig)))...))
+	digest := h.Sum(nil)
+	s, err := rsa.SignPKCS1v15(nil, priv, crypto.SHA256, digest)
+	if err != nil {
+		return nil, err
+	}
+	unhashed := pgpSubpacket(16, fp[12:])
+	sig = append(sig, byte(len(unhashed)>>8), byte(len(unhashed)))
+	sig = append(append(sig, unhashed...), digest[:2]...)
+	sig = append(sig, pgpMPI(new(big.Int).SetBytes(s))...)
+
+	key := pgpPacket(pgpTagPublicKey, pub)
+	if secret {
+		sec, err := pgpSecretRsa(priv)
+		if err != nil {
+			return nil, err
+		}
+		key = pgpPacket(pgpTagSecretKey, append(pub, sec...))
+	}
+	key = append(key, pgpPacket(pgpTagUserID, []byte(uid))...)
+	return append(key, pgpPacket(pgpTagSignature, sig)...), nil
+}
+
+// OpenPGP key of kf for KeyFile.Encode, armored unless der
+func pgpEncodeKey(kf *KeyFile, secret, der bool) ([]byte, error) {
+	priv, ok := kf.Private.(*rsa.PrivateKey)
+	if !ok {
+		if kf.Private == nil {
+			return nil, errors.New("openpgp needs the private key to certify the key")
+		}
+		return nil, errors.New("openpgp only valid for rsa keys")
+	}
+	data, err := pgpKeyPackets(priv, secret)
+	if err != nil || der {
+		return data, err
+	}
+	if secret {
+		return pgpArmor(pgpArmorSecret, data), nil
+	}
+	return pgpArmor(pgpArmorPublic, data), nil
+}
+
+// Keys of the armored OpenPGP key blocks in bundle, secret ones if private
+func pgpBundleKeys(bundle []byte, private bool) ([]*KeyFile, error) {
+	var keys []*KeyFile
+	for _, block := range pgpArmorBlocks(bundle) {
+		enc, ok := pgpArmorEncodings[block.Type]
+		if !ok || PrivateEncoding(enc) != private {
+			continue
+		}
+		kf, err := parseKeyDer(block.Bytes, enc)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, kf)
+	}
+	return keys, nil
+}
+
+// Recipients in bundle: armored OpenPGP public keys and PEM RSA public
+// keys, the latter by the key ID key export -to openpgp gives them
+func PgpRecipients(bundle []byte) ([]*pgpKey, error) {
+	var list []*pgpKey
+	for rest := bundle; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if _, ok := pgpArmorEncodings[block.Type]; ok {
+			continue
+		}
+		enc, ok := pemEncodings[block.Type]
+		if !ok {
+			return nil, errors.New(strings.ToLower(block.Type) + " can't be an openpgp recipient")
+		}
+		if PrivateEncoding(enc) {
+			continue
+		}
+		kf, err := parseKeyDer(block.Bytes, enc)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := kf.Public.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New(KeyType(kf.Public) + " key can't be an openpgp recipient, only rsa keys can")
+		}
+		list = append(list, pgpRsaKey(pub))
+	}
+	for _, block := range pgpArmorBlocks(bundle) {
+		if block.Type != pgpArmorPublic {
+			continue
+		}
+		k, err := parsePgpKey(block.Bytes, false)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, k)
+	}
+	if lines := bundleTextLines(bundle); len(lines) > 0 {
+		return nil, errors.New(lines[0] + " can't be an openpgp recipient")
+	}
+	if len(list) == 0 {
+		return nil, errors.New("public key error")
+	}
+	return list, nil
+}
+
+// RSA public key of a wrapper of a local or PKCS#11 RSA key, nil for others
+func rsaWrapperPublic(w KeyWrapper) *rsa.PublicKey {
+	switch w := w.(type) {
+	case *rsaWrapper:
+		return w.pub
+	case *pkcs11Wrapper:
+		return w.sess.Public()
+	}
+	return nil
+}
+
+// Cipher algorithm and key of a decrypted session key, checking its sum
+func pgpSessionData(m []byte) (byte, []byte, bool) {
+	if len(m) < 3 || pgpCipherKeySize(m[0]) != len(m)-3 {
+		return 0, nil, false
+	}
+	key, sum := m[1:len(m)-2], 0
+	for _, c := range key {
+		sum += int(c)
+	}
+	return m[0], key, uint16(sum) == binary.BigEndian.Uint16(m[len(m)-2:])
+}
+
+// Session key of a PKESK packet for one of wrappers, and the key ID it is
+// for; the key is nil if none of wrappers is its recipient. Key IDs aren't
+// matched, as a PEM key doesn't know the creation time in the key ID
+func pgpUnwrapSession(b []byte, wrappers []KeyWrapper) (byte, []byte, string) {
+	if len(b) < 10 || b[0] != 3 {
+		return 0, nil, "?"
+	}
+	id := strings.ToUpper(hex.EncodeToString(b[1:9]))
+	if b[9] != pgpAlgoRSA && b[9] != pgpAlgoRSAEncrypt {
+		return 0, nil, id
+	}
+	c, _, err := readPgpMPI(b[10:])
+	if err != nil {
+		return 0, nil, id
+	}
+	for _, w := range wrappers {
+		pub := rsaWrapperPublic(w)
+		if pub == nil || len(c.Bytes()) > pub.Size() {
+			continue
+		}
+		m, err := w.Unwrap(c.FillBytes(make([]byte, pub.Size())))
+		if err != nil {
+			continue
+		}
+		if algo, key, ok := pgpSessionData(m); ok {
+			return algo, key, id
+		}
+	}
+	return 0, nil, id
+}
+
+// Hashes what is read but the last pgpMdcSize bytes, the MDC packet
+type pgpMdcReader struct {
+	r   io.Reader
+	h   hash.Hash
+	buf []byte
+	eof bool
+}
+
+func (m *pgpMdcReader) Read(p []byte) (int, error) {
+	for len(m.buf) <= pgpMdcSize {
+		if m.eof {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, pgpPartSize)
+		n, err := m.r.Read(chunk)
+		m.buf = append(m.buf, chunk[:n]...)
+		if err == io.EOF {
+			m.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, m.buf[:len(m.buf)-pgpMdcSize])
+	m.h.Write(p[:n])
+	m.buf = append(m.buf[:0], m.buf[n:]...)
+	return n, nil
+}
+
+// Check the MDC packet after the rest is read
+func (m *pgpMdcReader) check() error {
+	if _, err := io.Copy(io.Discard, m); err != nil {
+		return err
+	}
+	if len(m.buf) != pgpMdcSize || m.buf[0] != 0xc0|pgpTagMDC || m.buf[1] != sha1.Size {
+		return errors.New("openpgp message has no modification detection code")
+	}
+	m.h.Write(m.buf[:2])
+	if subtle.ConstantTimeCompare(m.h.Sum(nil), m.buf[2:]) != 1 {
+		return errors.New("openpgp message was modified, its MDC check failed")
+	}
+	return nil
+}
+
+// Copy the literal data among the packets at r to w, through compressed
+// packets; signatures are left out, not verified
+func pgpCopyLiteral(r *bufio.Reader, w io.Writer, depth int, found *bool) error {
+	for {
+		tag, body, err := readPgpPacket(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case pgpTagLiteral:
+			if *found {
+				return errors.New("openpgp message has more than one literal data packet")
+			}
+			*found = true
+			var hdr [2]byte
+			if _, err = io.ReadFull(body, hdr[:]); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			// file name and date
+			if _, err = io.CopyN(io.Discard, body, int64(hdr[1])+4); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			if _, err = io.Copy(w, body); err != nil {
+				return err
+			}
+		case pgpTagCompressed:
+			var algo [1]byte
+			if _, err = io.ReadFull(body, algo[:]); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			if depth >= 8 {
+				return errors.New("openpgp message nests too many compressed packets")
+			}
+			var dr io.Reader
+			switch algo[0] {
+			case 0:
+				dr = body
+			case 1:
+				dr = flate.NewReader(body)
+			case 2:
+				if dr, err = zlib.NewReader(body); err != nil {
+					return err
+				}
+			case 3:
+				dr = bzip2.NewReader(body)
+			default:
+				return errors.New("unsupported openpgp compression " + strconv.Itoa(int(algo[0])))
+			}
+			if err = pgpCopyLiteral(bufio.NewReaderSize(dr, pgpPartSize), w, depth+1, found); err != nil {
+				return err
+			}
+		case pgpTagOnePassSig, pgpTagSignature, pgpTagMarker, pgpTagPadding:
+		default:
+			return errors.New("unexpected openpgp packet " + strconv.Itoa(tag) + " in a message")
+		}
+		if _, err = io.Copy(io.Discard, body); err != nil {
+			return err
+		}
+	}
+}
+
+// Decrypt the SEIPD packet body to w
+func pgpDecryptData(body io.Reader, algo byte, key []byte, w io.Writer) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(body, ver[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if ver[0] != 1 {
+		return errors.New("unsupported openpgp encrypted data version " + strconv.Itoa(int(ver[0])))
+	}
+	if pgpCipherKeySize(algo) == 0 {
+		return errors.New("unsupported openpgp cipher " + strconv.Itoa(int(algo)))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	bs := block.BlockSize()
+	stream := cipher.NewCFBDecrypter(block, make([]byte, bs))
+	mdc := &pgpMdcReader{r: cipher.StreamReader{S: stream, R: body}, h: sha1.New()}
+
+	// random prefix, its last two bytes repeated
+	prefix := make([]byte, bs+2)
+	if _, err = io.ReadFull(mdc, prefix); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if prefix[bs-2] != prefix[bs] || prefix[bs-1] != prefix[bs+1] {
+		return errors.New("openpgp decryption failed")
+	}
+	found := false
+	if err = pgpCopyLiteral(bufio.NewReaderSize(mdc, pgpPartSize), w, 0, &found); err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("openpgp message has no literal data")
+	}
+	return mdc.check()
+}
+
+// Whether inPath is an OpenPGP message, armored or not
+func IsPgpFile(inPath string) bool {
+	if _, err := ReadHdrInfo(inPath); err == nil {
+		return false
+	}
+	f, err := os.Open(inPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(f, head)
+	if strings.HasPrefix(strings.TrimSpace(string(head[:n])), "-----BEGIN "+pgpArmorMessage+"-----") {
+		return true
+	}
+	if n == 0 || head[0]&0x80 == 0 {
+		return false
+	}
+	tag := int(head[0]>>2) & 0xf
+	if head[0]&0x40 != 0 {
+		tag = int(head[0] & 0x3f)
+	}
+	return tag == pgpTagPKESK || tag == pgpTagSKESK || tag == pgpTagMarker
+}
+
+// Decrypt the OpenPGP message inPath, armored or not, with the first of
+// the RSA keys of wrappers that a session key is for
+func DecryptFilePgp(inPath, outPath string, wrappers []KeyWrapper) (err error) {
+	if IsSameFile(inPath, outPath) {
+		return errors.New("output file is the input file")
+	}
+
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	r := bufio.NewReaderSize(inFile, pgpPartSize)
+	if head, _ := r.Peek(1); len(head) == 1 && head[0]&0x80 == 0 {
+		a, typ, err := newPgpArmorReader(r)
+		if err != nil {
+			return err
+		}
+		if typ != pgpArmorMessage {
+			return errors.New("not an openpgp message but a " + strings.ToLower(typ))
+		}
+		r = bufio.NewReaderSize(a, pgpPartSize)
+	}
+
+	var algo byte
+	var key []byte
+	var ids []string
+	passphrase := false
+	for {
+		tag, body, err := readPgpPacket(r)
+		if err == io.EOF {
+			return errors.New("openpgp message has no encrypted data")
+		}
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case pgpTagPKESK:
+			b, err := io.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			if key == nil {
+				var id string
+				algo, key, id = pgpUnwrapSession(b, wrappers)
+				ids = append(ids, id)
+			}
+			continue
+		case pgpTagSKESK:
+			passphrase = true
+		case pgpTagMarker, pgpTagPadding:
+		case pgpTagSED:
+			return errors.New("openpgp message has no integrity protection")
+		case pgpTagAEAD:
+			return errors.New("unsupported openpgp aead encrypted data")
+		case pgpTagSEIPD:
+			if key == nil && len(ids) == 0 && passphrase {
+				return errors.New("unsupported openpgp message for a passphrase")
+			}
+			if key == nil {
+				return errors.New("no private key for the openpgp message, it is for key ID " + strings.Join(ids, ", "))
+			}
+			return pgpDecryptFile(inFile, r, body, algo, key, outPath)
+		default:
+			return errors.New("unexpected openpgp packet " + strconv.Itoa(tag) + " in a message")
+		}
+		if _, err = io.Copy(io.Discard, body); err != nil {
+			return err
+		}
+	}
+}
+
+// Decrypt the SEIPD body of inFile to outPath; what follows it in r is read
+// through before the output is kept, for the armor checksum
+func pgpDecryptFile(inFile *os.File, r io.Reader, body io.Reader, algo byte, key []byte, outPath string) (err error) {
+	outFile, err := CreateTempFile(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			AbortTempFile(outFile)
+		}
+	}()
+
+	bw := bufio.NewWriterSize(outFile, pgpPartSize)
+	if err = pgpDecryptData(body, algo, key, bw); err != nil {
+		return err
+	}
+	if _, err = io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	outFile.Chmod(inInfo.Mode())
+	return CommitTempFile(outFile, outPath)
+}
+
+// PKESK packet body of the session key of cipher algo for k
+func pgpWrapSession(k *pgpKey, algo byte, key []byte) ([]byte, error) {
+	m, sum := append([]byte{algo}, key...), 0
+	for _, c := range key {
+		sum += int(c)
+	}
+	m = append(m, byte(sum>>8), byte(sum))
+	c, err := rsa.EncryptPKCS1v15(rand.Reader, k.Public, m)
+	if err != nil {
+		return nil, err
+	}
+	algoRsa := k.Algo
+	if algoRsa != pgpAlgoRSAEncrypt {
+		algoRsa = pgpAlgoRSA
+	}
+	b := append(append([]byte{3}, k.KeyID[:]...), algoRsa)
+	return append(b, pgpMPI(new(big.Int).SetBytes(c))...), nil
+}
+
+// Encrypt inPath into the OpenPGP message outPath for recipients, ASCII
+// armored if armor: AES-256 in a SEIPD packet, its key under each RSA key
+func EncryptFilePgp(inPath, outPath string, recipients []*pgpKey, armor bool) (err error) {
+	if IsSameFile(inPath, outPath) {
+		return errors.New("output file is the input file")
+	}
+	if len(recipients) == 0 {
+		return errors.New("public key error")
+	}
+
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, pgpCipherKeySize(pgpCipherAES256))
+	if _, err = rand.Read(key); err != nil {
+		return err
+	}
+	var hdr []byte
+	for _, k := range recipients {
+		b, err := pgpWrapSession(k, pgpCipherAES256, key)
+		if err != nil {
+			return err
+		}
+		hdr = append(hdr, pgpPacket(pgpTagPKESK, b)...)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	bs := block.BlockSize()
+	prefix := make([]byte, bs+2)
+	if _, err = rand.Read(prefix[:bs]); err != nil {
+		return err
+	}
+	prefix[bs], prefix[bs+1] = prefix[bs-2], prefix[bs-1]
+
+	outFile, err := CreateTempFile(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			AbortTempFile(outFile)
+		}
+	}()
+
+	bw := bufio.NewWriterSize(outFile, pgpPartSize)
+	var w io.Writer = bw
+	var aw *pgpArmorWriter
+	if armor {
+		if aw, err = newPgpArmorWriter(bw, pgpArmorMessage); err != nil {
+			return err
+		}
+		w = aw
+	}
+	if _, err = w.Write(hdr); err != nil {
+		return err
+	}
+
+	seipd := &pgpPartialWriter{w: w, tag: pgpTagSEIPD}
+	if _, err = seipd.Write([]byte{1}); err != nil {
+		return err
+	}
+	enc := cipher.StreamWriter{S: cipher.NewCFBEncrypter(block, make([]byte, bs)), W: seipd}
+	mdc := sha1.New()
+	plain := io.MultiWriter(enc, mdc)
+	if _, err = plain.Write(prefix); err != nil {
+		return err
+	}
+
+	lit := &pgpPartialWriter{w: plain, tag: pgpTagLiteral}
+	name := filepath.Base(inPath)
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	litHdr := append(append([]byte{'b', byte(len(name))}, name...), pgpUint32(uint32(inInfo.ModTime().Unix()))...)
+	if _, err = lit.Write(litHdr); err != nil {
+		return err
+	}
+	if _, err = io.Copy(lit, inFile); err != nil {
+		return err
+	}
+	if err = lit.Close(); err != nil {
+		return err
+	}
+	if _, err = plain.Write([]byte{0xc0 | pgpTagMDC, sha1.Size}); err != nil {
+		return err
+	}
+	if _, err = enc.Write(mdc.Sum(nil)); err != nil {
+		return err
+	}
+	if err = seipd.Close(); err != nil {
+		return err
+	}
+	if aw != nil {
+		if err = aw.Close(); err != nil {
+			return err
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	outFile.Chmod(inInfo.Mode())
+	return CommitTempFile(outFile, outPath)
+}
+
+// EncryptFile in the OpenPGP format, for the keys in bundle
+func encryptFilePgp(inPath, outPath string, bundle []byte) error {
+	recipients, err := PgpRecipients(bundle)
+	if err != nil {
+		return err
+	}
+	return EncryptFilePgp(inPath, outPath, recipients, ArmorOutput)
+}
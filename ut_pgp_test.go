@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Messages in testdata/pgp were made by GnuPG 2.2 for the encryption
+// subkey of secret.asc, all of plain.txt:
+//
+//	gpg -e -r 565B522EF397E8D0 --compress-algo none|zip|zlib|bzip2 [-a] plain.txt
+//	cat plain.txt | gpg -e -r 565B522EF397E8D0 --compress-algo none
+//
+// the last one with partial body lengths, as the input size is unknown
+func pgpTestKeys(t *testing.T) ([]KeyWrapper, []*pgpKey) {
+	t.Helper()
+	secret, err := os.ReadFile(filepath.Join("testdata", "pgp", "secret.asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappers := IdentityWrappers(secret)
+	if len(wrappers) != 1 {
+		t.Fatalf("%d wrappers of the secret key", len(wrappers))
+	}
+	public, err := os.ReadFile(filepath.Join("testdata", "pgp", "public.asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients, err := PgpRecipients(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrappers, recipients
+}
+
+// Decrypt data as an OpenPGP message, checking no output is left on error
+func decryptPgpData(t *testing.T, data []byte, wrappers []KeyWrapper) ([]byte, error) {
+	t.Helper()
+	dir := t.TempDir()
+	inPath, outPath := filepath.Join(dir, "in.gpg"), filepath.Join(dir, "out")
+	if err := os.WriteFile(inPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptFilePgp(inPath, outPath, wrappers); err != nil {
+		if IsFileExist(outPath) {
+			t.Errorf("output left after %v", err)
+		}
+		return nil, err
+	}
+	return os.ReadFile(outPath)
+}
+
+func TestPgpGnupgMessages(t *testing.T) {
+	wrappers, _ := pgpTestKeys(t)
+	plain, err := os.ReadFile(filepath.Join("testdata", "pgp", "plain.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"uncompressed.gpg", "zip.gpg", "zlib.gpg", "bzip2.gpg", "armored.asc", "partial.gpg"} {
+		path := filepath.Join("testdata", "pgp", name)
+		if !IsPgpFile(path) {
+			t.Errorf("%s: not an openpgp message", name)
+		}
+		data, _ := os.ReadFile(path)
+		got, err := decryptPgpData(t, data, wrappers)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(got, plain) {
+			t.Errorf("%s: plaintext differs", name)
+		}
+	}
+
+	// for another key
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := NewKeyWrapper(other)
+	data, _ := os.ReadFile(filepath.Join("testdata", "pgp", "uncompressed.gpg"))
+	if _, err = decryptPgpData(t, data, []KeyWrapper{w}); err == nil || !strings.Contains(err.Error(), "565B522EF397E8D0") {
+		t.Errorf("other key: %v", err)
+	}
+}
+
+func TestPgpBrokenMessages(t *testing.T) {
+	wrappers, _ := pgpTestKeys(t)
+
+	tests := []struct {
+		file string
+		edit func([]byte) []byte
+		want string
+	}{
+		// the SHA-1 of the MDC packet, and a byte of the literal data
+		{"uncompressed.gpg", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, "MDC"},
+		{"uncompressed.gpg", func(b []byte) []byte { b[len(b)/2] ^= 0x80; return b }, "MDC"},
+		{"partial.gpg", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, "MDC"},
+		{"zlib.gpg", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, "MDC"},
+		{"uncompressed.gpg", func(b []byte) []byte { return b[:len(b)-10] }, ""},
+		{"uncompressed.gpg", func(b []byte) []byte { return b[:len(b)-pgpMdcSize] }, ""},
+		{"partial.gpg", func(b []byte) []byte { return b[:len(b)-1] }, ""},
+		{"partial.gpg", func(b []byte) []byte { return b[:300] }, ""},
+		{"zip.gpg", func(b []byte) []byte { return b[:len(b)/2] }, ""},
+		{"uncompressed.gpg", func(b []byte) []byte { return b[:200] }, ""},
+		// the armor checksum, "=" and four base64 characters, and a
+		// character of the armored data
+		{"armored.asc", func(b []byte) []byte {
+			i := bytes.LastIndex(b, []byte("\n=")) + 2
+			b[i] ^= 1
+			return b
+		}, "checksum"},
+		{"armored.asc", func(b []byte) []byte {
+			i := bytes.Index(b, []byte("\n\n")) + 10
+			b[i] = 'A' + ('B'-b[i])&1
+			return b
+		}, ""},
+	}
+	for i, tt := range tests {
+		data, err := os.ReadFile(filepath.Join("testdata", "pgp", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = decryptPgpData(t, tt.edit(data), wrappers)
+		if err == nil {
+			t.Errorf("%d %s: decrypted", i, tt.file)
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%d %s: %v, want %s", i, tt.file, err, tt.want)
+		}
+	}
+}
+
+func TestPgpRoundTrip(t *testing.T) {
+	wrappers, recipients := pgpTestKeys(t)
+	dir := t.TempDir()
+	for _, size := range []int{0, 1, 2*pgpPartSize + 100} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		plainPath := filepath.Join(dir, "plain")
+		if err := os.WriteFile(plainPath, plain, 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, armor := range []bool{false, true} {
+			encPath, outPath := filepath.Join(dir, "plain.gpg"), filepath.Join(dir, "out")
+			os.Remove(encPath)
+			os.Remove(outPath)
+			if err := EncryptFilePgp(plainPath, encPath, recipients, armor); err != nil {
+				t.Fatalf("size %d armor %v: %v", size, armor, err)
+			}
+			if !IsPgpFile(encPath) {
+				t.Errorf("size %d armor %v: not an openpgp message", size, armor)
+			}
+			if err := DecryptFilePgp(encPath, outPath, wrappers); err != nil {
+				t.Fatalf("size %d armor %v: %v", size, armor, err)
+			}
+			if got, _ := os.ReadFile(outPath); !bytes.Equal(got, plain) {
+				t.Errorf("size %d armor %v: plaintext differs", size, armor)
+			}
+		}
+	}
+}
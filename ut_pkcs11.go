@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const pkcs11PemType = "PKCS11 KEY"
+
+// Private RSA key in a PKCS#11 token such as an HSM or smartcard, found by
+// slot and key label; the data key is unwrapped by the token and the key
+// never leaves it. The user PIN is taken from BITCRYPT_PKCS11_PIN
+type Pkcs11Key struct {
+	Module string // path of the PKCS#11 module library
+	Slot   int    // slot ID, -1 for the first slot with a token
+	Label  string // CKA_LABEL of the key, "" if the token holds only one
+}
+
+// An open, logged in session with a token's private key
+type pkcs11Session interface {
+	Public() *rsa.PublicKey
+	Decrypt(block []byte) ([]byte, error) // CKM_RSA_PKCS of one block
+}
+
+func (k *Pkcs11Key) String() string {
+	s := k.Module + " slot " + strconv.Itoa(k.Slot)
+	if k.Slot < 0 {
+		s = k.Module + " first token"
+	}
+	if k.Label != "" {
+		s += " key " + k.Label
+	}
+	return s
+}
+
+// PEM block naming the key, to go in an identity bundle
+func (k *Pkcs11Key) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: pkcs11PemType, Headers: map[string]string{
+		"Module": k.Module,
+		"Slot":   strconv.Itoa(k.Slot),
+		"Label":  k.Label,
+	}})
+}
+
+func ParsePkcs11Pem(block *pem.Block) (*Pkcs11Key, error) {
+	slot, err := strconv.Atoi(block.Headers["Slot"])
+	if err != nil || block.Headers["Module"] == "" {
+		return nil, errors.New("invalid " + pkcs11PemType + " block")
+	}
+	return &Pkcs11Key{Module: block.Headers["Module"], Slot: slot, Label: block.Headers["Label"]}, nil
+}
+
+// Sessions are opened once a run and shared by its workers
+var pkcs11Sessions = struct {
+	sync.Mutex
+	m map[Pkcs11Key]pkcs11Session
+}{m: make(map[Pkcs11Key]pkcs11Session)}
+
+// Wrapper unwrapping with the token's key, logging in at the first use
+func OpenPkcs11Key(k *Pkcs11Key) (KeyWrapper, error) {
+	pkcs11Sessions.Lock()
+	defer pkcs11Sessions.Unlock()
+	sess, ok := pkcs11Sessions.m[*k]
+	if !ok {
+		var err error
+		if sess, err = openPkcs11(k, os.Getenv("BITCRYPT_PKCS11_PIN")); err != nil {
+			return nil, errors.New("pkcs11 " + k.String() + ": " + err.Error())
+		}
+		pkcs11Sessions.m[*k] = sess
+	}
+	return &pkcs11Wrapper{sess: sess}, nil
+}
+
+type pkcs11Wrapper struct {
+	sess pkcs11Session
+}
+
+func (w *pkcs11Wrapper) Type() uint32          { return WrapRsa }
+func (w *pkcs11Wrapper) Fingerprint() [32]byte { return KeyFingerprint(w.sess.Public()) }
+
+func (w *pkcs11Wrapper) Wrap(data []byte) ([]byte, error) {
+	return RsaEncryptKey(w.sess.Public(), data)
+}
+
+// The inverse of RsaEncryptKey, as RsaDecryptKey
+func (w *pkcs11Wrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	k := (w.sess.Public().N.BitLen() + 7) / 8
+	if len(wrapped) <= k {
+		return w.sess.Decrypt(wrapped)
+	}
+	o1, e1 := w.sess.Decrypt(wrapped[:k])
+	o2, e2 := w.sess.Decrypt(wrapped[k:])
+	if e1 != nil || e2 != nil {
+		return nil, errors.New("RSA decrypt error")
+	}
+	return append(o1, o2...), nil
+}
@@ -0,0 +1,324 @@
+//go:build pkcs11 && cgo && !windows
+
+package main
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+// The parts of the PKCS#11 v2.40 ABI used here, as in its pkcs11t.h and
+// pkcs11f.h for unix: no packing, CK_ULONG an unsigned long
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+
+typedef struct { unsigned char major, minor; } CK_VERSION;
+typedef struct { CK_ULONG type; void *pValue; CK_ULONG ulValueLen; } CK_ATTRIBUTE;
+typedef struct { CK_ULONG mechanism; void *pParameter; CK_ULONG ulParameterLen; } CK_MECHANISM;
+
+typedef struct {
+	void *CreateMutex, *DestroyMutex, *LockMutex, *UnlockMutex;
+	CK_ULONG flags;
+	void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+
+typedef struct {
+	unsigned char label[32], manufacturerID[32], model[16], serialNumber[16];
+	CK_ULONG flags, ulMaxSessionCount, ulSessionCount, ulMaxRwSessionCount, ulRwSessionCount;
+	CK_ULONG ulMaxPinLen, ulMinPinLen, ulTotalPublicMemory, ulFreePublicMemory;
+	CK_ULONG ulTotalPrivateMemory, ulFreePrivateMemory;
+	CK_VERSION hardwareVersion, firmwareVersion;
+	unsigned char utcTime[16];
+} CK_TOKEN_INFO;
+
+// CK_FUNCTION_LIST up to C_Decrypt, unused entries as plain pointers
+typedef struct {
+	CK_VERSION version;
+	CK_RV (*C_Initialize)(void *);
+	void *C_Finalize, *C_GetInfo, *C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(unsigned char, CK_ULONG *, CK_ULONG *);
+	void *C_GetSlotInfo;
+	CK_RV (*C_GetTokenInfo)(CK_ULONG, CK_TOKEN_INFO *);
+	void *C_GetMechanismList, *C_GetMechanismInfo, *C_InitToken, *C_InitPIN, *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_ULONG, CK_ULONG, void *, void *, CK_ULONG *);
+	void *C_CloseSession, *C_CloseAllSessions, *C_GetSessionInfo, *C_GetOperationState, *C_SetOperationState;
+	CK_RV (*C_Login)(CK_ULONG, CK_ULONG, unsigned char *, CK_ULONG);
+	void *C_Logout, *C_CreateObject, *C_CopyObject, *C_DestroyObject, *C_GetObjectSize;
+	CK_RV (*C_GetAttributeValue)(CK_ULONG, CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	void *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_ULONG, CK_ULONG *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_ULONG);
+	void *C_EncryptInit, *C_Encrypt, *C_EncryptUpdate, *C_EncryptFinal;
+	CK_RV (*C_DecryptInit)(CK_ULONG, CK_MECHANISM *, CK_ULONG);
+	CK_RV (*C_Decrypt)(CK_ULONG, unsigned char *, CK_ULONG, unsigned char *, CK_ULONG *);
+} CK_FUNCTION_LIST;
+
+#define CKR_OK                           0x0UL
+#define CKR_USER_ALREADY_LOGGED_IN       0x100UL
+#define CKR_CRYPTOKI_ALREADY_INITIALIZED 0x191UL
+#define CKF_OS_LOCKING_OK                0x2UL
+#define CKF_SERIAL_SESSION               0x4UL
+#define CKF_LOGIN_REQUIRED               0x4UL
+#define CKU_USER                         1UL
+#define CKA_CLASS                        0x0UL
+#define CKA_LABEL                        0x3UL
+#define CKA_KEY_TYPE                     0x100UL
+#define CKO_PUBLIC_KEY                   2UL
+#define CKO_PRIVATE_KEY                  3UL
+#define CKK_RSA                          0UL
+#define CKM_RSA_PKCS                     1UL
+
+// Load a module and initialize it for use from several threads; a
+// failed dlopen gives NULL with the reason in *err
+static CK_FUNCTION_LIST *p11_load(const char *path, const char **err, CK_RV *rv) {
+	void *lib = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (lib == NULL) {
+		*err = dlerror();
+		return NULL;
+	}
+	CK_RV (*getList)(CK_FUNCTION_LIST **) = (CK_RV (*)(CK_FUNCTION_LIST **))dlsym(lib, "C_GetFunctionList");
+	CK_FUNCTION_LIST *fl = NULL;
+	if (getList == NULL || getList(&fl) != CKR_OK || fl == NULL) {
+		*err = "no C_GetFunctionList";
+		return NULL;
+	}
+	CK_C_INITIALIZE_ARGS args;
+	memset(&args, 0, sizeof(args));
+	args.flags = CKF_OS_LOCKING_OK;
+	*rv = fl->C_Initialize(&args);
+	if (*rv == CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		*rv = CKR_OK;
+	}
+	return fl;
+}
+
+static CK_RV p11_slots(CK_FUNCTION_LIST *fl, CK_ULONG *slots, CK_ULONG *n) {
+	return fl->C_GetSlotList(1, slots, n);
+}
+
+static CK_RV p11_token_flags(CK_FUNCTION_LIST *fl, CK_ULONG slot, CK_ULONG *flags) {
+	CK_TOKEN_INFO info;
+	CK_RV rv = fl->C_GetTokenInfo(slot, &info);
+	*flags = info.flags;
+	return rv;
+}
+
+static CK_RV p11_open(CK_FUNCTION_LIST *fl, CK_ULONG slot, CK_ULONG *sess) {
+	return fl->C_OpenSession(slot, CKF_SERIAL_SESSION, NULL, NULL, sess);
+}
+
+static CK_RV p11_login(CK_FUNCTION_LIST *fl, CK_ULONG sess, char *pin, CK_ULONG n) {
+	CK_RV rv = fl->C_Login(sess, CKU_USER, (unsigned char *)pin, n);
+	return rv == CKR_USER_ALREADY_LOGGED_IN ? CKR_OK : rv;
+}
+
+// RSA keys of class cls, with label unless it is empty
+static CK_RV p11_find(CK_FUNCTION_LIST *fl, CK_ULONG sess, CK_ULONG cls, char *label, CK_ULONG n,
+                      CK_ULONG *objs, CK_ULONG max, CK_ULONG *found) {
+	CK_ULONG typ = CKK_RSA;
+	CK_ATTRIBUTE tmpl[3] = {
+		{CKA_CLASS, &cls, sizeof(cls)},
+		{CKA_KEY_TYPE, &typ, sizeof(typ)},
+		{CKA_LABEL, label, n},
+	};
+	CK_RV rv = fl->C_FindObjectsInit(sess, tmpl, n > 0 ? 3 : 2);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	rv = fl->C_FindObjects(sess, objs, max, found);
+	CK_RV rv2 = fl->C_FindObjectsFinal(sess);
+	return rv != CKR_OK ? rv : rv2;
+}
+
+// Attribute typ of obj into buf, *n is its size in and the value's out
+static CK_RV p11_attr(CK_FUNCTION_LIST *fl, CK_ULONG sess, CK_ULONG obj, CK_ULONG typ, void *buf, CK_ULONG *n) {
+	CK_ATTRIBUTE a = {typ, buf, *n};
+	CK_RV rv = fl->C_GetAttributeValue(sess, obj, &a, 1);
+	*n = a.ulValueLen;
+	return rv;
+}
+
+static CK_RV p11_decrypt(CK_FUNCTION_LIST *fl, CK_ULONG sess, CK_ULONG key,
+                         unsigned char *in, CK_ULONG inLen, unsigned char *out, CK_ULONG *outLen) {
+	CK_MECHANISM mech = {CKM_RSA_PKCS, NULL, 0};
+	CK_RV rv = fl->C_DecryptInit(sess, &mech, key);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	return fl->C_Decrypt(sess, in, inLen, out, outLen);
+}
+*/
+import "C"
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"unsafe"
+)
+
+// Names of the return values a user can do something about
+var pkcs11Errors = map[C.CK_RV]string{
+	0x03:  "no such slot",
+	0x05:  "general error",
+	0x30:  "device error",
+	0x32:  "device removed",
+	0x40:  "encrypted data invalid",
+	0xa0:  "incorrect PIN",
+	0xa4:  "PIN locked",
+	0xe0:  "token not present",
+	0x101: "user not logged in",
+}
+
+func pkcs11Error(op string, rv C.CK_RV) error {
+	if name, ok := pkcs11Errors[rv]; ok {
+		return errors.New(op + ": " + name)
+	}
+	return fmt.Errorf("%s: CKR 0x%x", op, uint64(rv))
+}
+
+// Modules are loaded and initialized once
+var pkcs11Modules = make(map[string]*C.CK_FUNCTION_LIST)
+
+// One session serves every worker, an operation at a time
+type cgoPkcs11Session struct {
+	mu   sync.Mutex
+	fl   *C.CK_FUNCTION_LIST
+	sess C.CK_ULONG
+	key  C.CK_ULONG
+	pub  *rsa.PublicKey
+}
+
+// Called with pkcs11Sessions locked
+func openPkcs11(k *Pkcs11Key, pin string) (pkcs11Session, error) {
+	fl := pkcs11Modules[k.Module]
+	if fl == nil {
+		path := C.CString(k.Module)
+		defer C.free(unsafe.Pointer(path))
+		var cerr *C.char
+		var rv C.CK_RV
+		if fl = C.p11_load(path, &cerr, &rv); fl == nil {
+			return nil, errors.New("load module: " + C.GoString(cerr))
+		}
+		if rv != C.CKR_OK {
+			return nil, pkcs11Error("initialize", rv)
+		}
+		pkcs11Modules[k.Module] = fl
+	}
+
+	slot := C.CK_ULONG(k.Slot)
+	if k.Slot < 0 {
+		slots := make([]C.CK_ULONG, 64)
+		n := C.CK_ULONG(len(slots))
+		if rv := C.p11_slots(fl, &slots[0], &n); rv != C.CKR_OK {
+			return nil, pkcs11Error("list slots", rv)
+		}
+		if n == 0 {
+			return nil, errors.New("no token present")
+		}
+		slot = slots[0]
+	}
+
+	s := &cgoPkcs11Session{fl: fl}
+	if rv := C.p11_open(fl, slot, &s.sess); rv != C.CKR_OK {
+		return nil, pkcs11Error("open session", rv)
+	}
+	var flags C.CK_ULONG
+	if rv := C.p11_token_flags(fl, slot, &flags); rv != C.CKR_OK {
+		return nil, pkcs11Error("token info", rv)
+	}
+	if flags&C.CKF_LOGIN_REQUIRED != 0 {
+		if pin == "" {
+			return nil, errors.New("the token needs a PIN, set BITCRYPT_PKCS11_PIN")
+		}
+		cpin := C.CString(pin)
+		defer C.free(unsafe.Pointer(cpin))
+		if rv := C.p11_login(fl, s.sess, cpin, C.CK_ULONG(len(pin))); rv != C.CKR_OK {
+			return nil, pkcs11Error("login", rv)
+		}
+	}
+
+	keys, err := s.find(C.CKO_PRIVATE_KEY, k.Label)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no rsa private key found")
+	}
+	if len(keys) > 1 {
+		return nil, errors.New("several rsa private keys found, set pkcs11_label")
+	}
+	s.key = keys[0]
+
+	// tokens may keep the modulus to the public key object only
+	if s.pub, err = s.publicOf(s.key); err != nil {
+		if pubs, _ := s.find(C.CKO_PUBLIC_KEY, k.Label); len(pubs) == 1 {
+			s.pub, err = s.publicOf(pubs[0])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *cgoPkcs11Session) find(class C.CK_ULONG, label string) ([]C.CK_ULONG, error) {
+	clabel := C.CString(label)
+	defer C.free(unsafe.Pointer(clabel))
+	objs := make([]C.CK_ULONG, 2)
+	var n C.CK_ULONG
+	if rv := C.p11_find(s.fl, s.sess, class, clabel, C.CK_ULONG(len(label)), &objs[0], C.CK_ULONG(len(objs)), &n); rv != C.CKR_OK {
+		return nil, pkcs11Error("find key", rv)
+	}
+	return objs[:n], nil
+}
+
+func (s *cgoPkcs11Session) attr(obj, typ C.CK_ULONG) ([]byte, error) {
+	buf := make([]byte, 1024)
+	n := C.CK_ULONG(len(buf))
+	if rv := C.p11_attr(s.fl, s.sess, obj, typ, unsafe.Pointer(&buf[0]), &n); rv != C.CKR_OK {
+		return nil, pkcs11Error("read key", rv)
+	}
+	return buf[:n], nil
+}
+
+func (s *cgoPkcs11Session) publicOf(obj C.CK_ULONG) (*rsa.PublicKey, error) {
+	const ckaModulus, ckaPublicExponent = 0x120, 0x122
+	n, err := s.attr(obj, ckaModulus)
+	if err != nil {
+		return nil, err
+	}
+	e, err := s.attr(obj, ckaPublicExponent)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !exp.IsInt64() {
+		return nil, errors.New("invalid rsa public key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+func (s *cgoPkcs11Session) Public() *rsa.PublicKey {
+	return s.pub
+}
+
+func (s *cgoPkcs11Session) Decrypt(block []byte) ([]byte, error) {
+	if len(block) == 0 {
+		return nil, errors.New("RSA decrypt error")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]byte, s.pub.Size())
+	n := C.CK_ULONG(len(out))
+	rv := C.p11_decrypt(s.fl, s.sess, s.key, (*C.uchar)(unsafe.Pointer(&block[0])), C.CK_ULONG(len(block)),
+		(*C.uchar)(unsafe.Pointer(&out[0])), &n)
+	if rv != C.CKR_OK {
+		return nil, pkcs11Error("decrypt", rv)
+	}
+	return out[:n], nil
+}
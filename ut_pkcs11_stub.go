@@ -0,0 +1,12 @@
+//go:build !pkcs11 || !cgo || windows
+
+package main
+
+import (
+	"errors"
+)
+
+// PKCS#11 needs cgo, builds for it take -tags pkcs11
+func openPkcs11(k *Pkcs11Key, pin string) (pkcs11Session, error) {
+	return nil, errors.New("built without PKCS#11 support, rebuild with go build -tags pkcs11")
+}
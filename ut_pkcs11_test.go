@@ -0,0 +1,170 @@
+//go:build pkcs11 && cgo && !windows
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	testPkcs11Pin   = "1234"
+	testPkcs11Label = "bitcrypt-test"
+)
+
+// SoftHSM module, from SOFTHSM2_MODULE or where distributions put it
+func softhsmModule() string {
+	if m := os.Getenv("SOFTHSM2_MODULE"); m != "" {
+		return m
+	}
+	for _, m := range []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib64/pkcs11/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+	} {
+		if IsFileExist(m) {
+			return m
+		}
+	}
+	return ""
+}
+
+// A fresh SoftHSM token holding key under testPkcs11Label, and its slot
+func newSofthsmToken(t *testing.T, key *rsa.PrivateKey) (string, int) {
+	if _, err := exec.LookPath("softhsm2-util"); err != nil {
+		t.Skip("softhsm2-util not found")
+	}
+	module := softhsmModule()
+	if module == "" {
+		t.Skip("libsofthsm2.so not found, set SOFTHSM2_MODULE")
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	os.Mkdir(filepath.Join(dir, "tokens"), 0700)
+	err := os.WriteFile(conf, []byte("directories.tokendir = "+filepath.Join(dir, "tokens")+"\nobjectstore.backend = file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	softhsm := func(args ...string) string {
+		out, err := exec.Command("softhsm2-util", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("softhsm2-util %s: %v\n%s", args[0], err, out)
+		}
+		return string(out)
+	}
+	out := softhsm("--init-token", "--free", "--label", "bitcrypt", "--pin", testPkcs11Pin, "--so-pin", "5678")
+	m := regexp.MustCompile(`slot (\d+)`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatalf("no slot in %q", out)
+	}
+	slot, _ := strconv.Atoi(m[1])
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	softhsm("--import", keyPath, "--token", "bitcrypt", "--label", testPkcs11Label, "--id", "01", "--pin", testPkcs11Pin)
+	return module, slot
+}
+
+func TestPkcs11Softhsm(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, slot := newSofthsmToken(t, priv)
+
+	// a wrong PIN or label opens nothing
+	t.Setenv("BITCRYPT_PKCS11_PIN", "0000")
+	if _, err = OpenPkcs11Key(&Pkcs11Key{Module: module, Slot: slot, Label: testPkcs11Label}); err == nil {
+		t.Error("opened with a wrong PIN")
+	}
+	t.Setenv("BITCRYPT_PKCS11_PIN", testPkcs11Pin)
+	if _, err = OpenPkcs11Key(&Pkcs11Key{Module: module, Slot: slot, Label: "missing"}); err == nil {
+		t.Error("opened a missing label")
+	}
+
+	// by slot and label, and as the only key of the first token
+	for _, k := range []*Pkcs11Key{
+		{Module: module, Slot: slot, Label: testPkcs11Label},
+		{Module: module, Slot: -1},
+	} {
+		w, err := OpenPkcs11Key(k)
+		if err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+		if w.Fingerprint() != KeyFingerprint(&priv.PublicKey) {
+			t.Errorf("%s: fingerprint of another key", k)
+		}
+		data := make([]byte, 256) // split over two RSA blocks
+		rand.Read(data)
+		wrapped, err := RsaEncryptKey(&priv.PublicKey, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := w.Unwrap(wrapped)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: unwrap: %v", k, err)
+		}
+	}
+
+	// v1 and v2 headers of files for the key
+	k := &Pkcs11Key{Module: module, Slot: slot, Label: testPkcs11Label}
+	info := &AesInfo{Size: 32, Type: 1}
+	rand.Read(info.Aesk[:])
+	rand.Read(info.Fchk[:])
+	hdrf := &HdrInfo{Eflg: EncFlagV1, Fchk: info.Fchk}
+	v1, err := RsaEncryptKey(&priv.PublicKey, AesInfo2Bytes(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := UnwrapAesInfo(hdrf, v1, k.PEM()); err != nil || got.Aesk != info.Aesk {
+		t.Errorf("v1 header: %v", err)
+	}
+
+	pubDer, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	pubPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})
+	v2, err := WrapAesInfo(pubPem, info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrf.Eflg = EncFlagV2
+	if got, err := UnwrapAesInfo(hdrf, v2, k.PEM()); err != nil || got.Aesk != info.Aesk {
+		t.Errorf("v2 header: %v", err)
+	}
+
+	// and a whole file
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	os.WriteFile(plain, []byte(strings.Repeat("token ", 1000)), 0600)
+	if err = EncryptFile(plain, plain+".enc", pubPem, 32, "gcm", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = DecryptFile(plain+".enc", plain+".dec", k.PEM()); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(plain)
+	if got, _ := os.ReadFile(plain + ".dec"); !bytes.Equal(got, want) {
+		t.Error("decrypted file differs")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Progress of a directory run, passed to DirOptions.Progress
+type ProgressEvent struct {
+	Kind     string        // "start", "file" or "end"
+	Path     string        // source file, for "file"
+	Output   string        // output file, for "file"
+	Action   string        // "encrypted", "decrypted", "linked", "skipped", "not encrypted" or "failed", for "file"
+	Files    int64         // files to process, for "start"
+	Bytes    int64         // bytes to process for "start", file size for "file"
+	Duration time.Duration // time spent on the file or the whole run
+	Err      error
+}
+
+type ProgressFunc func(ev *ProgressEvent)
+
+func (opts *DirOptions) progressStart(srcDir string, rules *IgnoreRules) time.Time {
+	if opts.Progress != nil {
+		files, bytes := CountDir(srcDir, rules, opts.FollowLinks)
+		opts.Progress(&ProgressEvent{Kind: "start", Path: srcDir, Files: files, Bytes: bytes})
+	}
+	return time.Now()
+}
+
+func (opts *DirOptions) progressFile(path, outPath, action string, f os.FileInfo, start time.Time, err error) {
+	if opts.Progress != nil {
+		ev := &ProgressEvent{Kind: "file", Path: path, Output: outPath, Action: action, Duration: time.Since(start), Err: err}
+		if f != nil {
+			ev.Bytes = f.Size()
+		}
+		opts.Progress(ev)
+	}
+}
+
+func (opts *DirOptions) progressEnd(start time.Time, err error) {
+	if opts.Progress != nil {
+		opts.Progress(&ProgressEvent{Kind: "end", Duration: time.Since(start), Err: err})
+	}
+}
+
+// Count the files and bytes a directory run over srcDir will look at
+func CountDir(srcDir string, rules *IgnoreRules, follow bool) (int64, int64) {
+	var files, bytes int64
+	filepath.Walk(srcDir, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(srcDir, path)
+		if relPath == "." {
+			return nil
+		}
+		if relPath == TrashDirName || rules.Excluded(strings.TrimSuffix(relPath, ".enc"), f.IsDir()) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if relPath == IndexFileName || relPath == JournalFileName || IsTempFile(path) || f.IsDir() {
+			return nil
+		}
+
+		if follow && f.Mode()&os.ModeSymlink != 0 {
+			if fi, err := os.Stat(path); err == nil {
+				f = fi
+			}
+		}
+		if f.Mode().IsRegular() {
+			files++
+			bytes += f.Size()
+		}
+		return nil
+	})
+	return files, bytes
+}
+
+// Totals of a run, fed by its progress events
+type ProgressStats struct {
+	Files     int64 // from the start event
+	Bytes     int64
+	DoneFiles int64
+	DoneBytes int64
+	Counts    map[string]int64 // files by action
+	Start     time.Time
+	Duration  time.Duration // from the end event
+}
+
+func NewProgressStats() *ProgressStats {
+	return &ProgressStats{Counts: make(map[string]int64), Start: time.Now()}
+}
+
+func (st *ProgressStats) Update(ev *ProgressEvent) {
+	switch ev.Kind {
+	case "start":
+		st.Files, st.Bytes = ev.Files, ev.Bytes
+		st.Start = time.Now()
+	case "file":
+		st.DoneFiles++
+		st.DoneBytes += ev.Bytes
+		st.Counts[ev.Action]++
+	case "end":
+		st.Duration = ev.Duration
+	}
+}
+
+// Bytes per second so far
+func (st *ProgressStats) Rate() float64 {
+	secs := time.Since(st.Start).Seconds()
+	if st.Duration > 0 {
+		secs = st.Duration.Seconds()
+	}
+	if secs <= 0 {
+		return 0
+	}
+	return float64(st.DoneBytes) / secs
+}
+
+// Estimated time left, -1 if unknown
+func (st *ProgressStats) Eta() time.Duration {
+	rate := st.Rate()
+	if rate <= 0 || st.Bytes < st.DoneBytes {
+		return -1
+	}
+	return time.Duration(float64(st.Bytes-st.DoneBytes) / rate * float64(time.Second))
+}
+
+func (st *ProgressStats) Summary() string {
+	return fmt.Sprintf("%d encrypted, %d decrypted, %d linked, %d skipped unchanged, %d not encrypted, %d failed, %s in %s",
+		st.Counts["encrypted"], st.Counts["decrypted"], st.Counts["linked"], st.Counts["skipped"],
+		st.Counts["not encrypted"], st.Counts["failed"], FormatBytes(st.DoneBytes), st.Duration.Round(time.Millisecond))
+}
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Progress line on a terminal, redrawn at most every 200ms
+func TtyProgress(w io.Writer, st *ProgressStats) ProgressFunc {
+	var last time.Time
+	return func(ev *ProgressEvent) {
+		st.Update(ev)
+		if ev.Kind == "file" && time.Since(last) < 200*time.Millisecond {
+			return
+		}
+		last = time.Now()
+
+		eta := "--:--"
+		if d := st.Eta(); d >= 0 {
+			d = d.Round(time.Second)
+			eta = fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+		}
+		fmt.Fprintf(w, "\r\033[K%d/%d files  %s/%s  %s/s  ETA %s",
+			st.DoneFiles, st.Files, FormatBytes(st.DoneBytes), FormatBytes(st.Bytes),
+			FormatBytes(int64(st.Rate())), eta)
+		if ev.Kind == "end" {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// Progress as one JSON object per line, for use without a terminal
+func JSONProgress(w io.Writer, st *ProgressStats) ProgressFunc {
+	enc := json.NewEncoder(w)
+	return func(ev *ProgressEvent) {
+		st.Update(ev)
+
+		rec := map[string]interface{}{
+			"event":       ev.Kind,
+			"done_files":  st.DoneFiles,
+			"total_files": st.Files,
+			"done_bytes":  st.DoneBytes,
+			"total_bytes": st.Bytes,
+		}
+		switch ev.Kind {
+		case "file":
+			rec["path"] = ev.Path
+			rec["action"] = ev.Action
+			rec["bytes"] = ev.Bytes
+		case "end":
+			rec["counts"] = st.Counts
+			rec["seconds"] = ev.Duration.Seconds()
+		}
+		if ev.Err != nil {
+			rec["error"] = ev.Err.Error()
+		}
+		enc.Encode(rec)
+	}
+}
+
+// Progress display on stderr for mode "auto", "tty", "json" or "none"; auto
+// is tty on a terminal and none otherwise, none only keeps st for the
+// summary line
+func StderrProgress(mode string, st *ProgressStats) (ProgressFunc, error) {
+	if mode == "auto" {
+		mode = "none"
+		if IsTerminal(os.Stderr) {
+			mode = "tty"
+		}
+	}
+
+	switch mode {
+	case "tty":
+		log.SetOutput(TtyLogWriter{os.Stderr})
+		return TtyProgress(os.Stderr, st), nil
+	case "json":
+		return JSONProgress(os.Stderr, st), nil
+	case "none":
+		return st.Update, nil
+	}
+	return nil, errors.New("unknown progress mode " + mode)
+}
+
+// Writer for the log while a TtyProgress line is shown, clears the line first
+type TtyLogWriter struct {
+	W io.Writer
+}
+
+func (tw TtyLogWriter) Write(p []byte) (int, error) {
+	io.WriteString(tw.W, "\r\033[K")
+	return tw.W.Write(p)
+}
+
+func IsTerminal(file *os.File) bool {
+	fi, err := file.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Random access reader over the plaintext of a ctr or gcm encrypted file,
+// implements io.ReaderAt and io.ReadSeeker
+type DecryptReader struct {
+	file *os.File
+	gcm  cipher.AEAD
+	blk  cipher.Block
+	iv   []byte
+	ctp  int
+	base int64 // payload offset in the encrypted file
+	size int64 // plaintext size
+	off  int64 // Read/Seek position
+
+	mu    sync.Mutex
+	chunk int64 // index of the cached gcm chunk, -1 if none
+	plain []byte
+}
+
+func OpenDecryptReader(inPath string, rsaPriKey []byte) (*DecryptReader, error) {
+	hdrf, info, err := ReadEncHdr(inPath, rsaPriKey)
+	if err != nil {
+		return nil, err
+	}
+	return NewDecryptReader(inPath, hdrf, info)
+}
+
+// Reader for an encrypted file whose header is already decrypted
+func NewDecryptReader(inPath string, hdrf *HdrInfo, info *AesInfo) (*DecryptReader, error) {
+	if info.Type != 2 && info.Type != 8 {
+		return nil, errors.New("aes cipher type not seekable, only ctr and gcm")
+	}
+
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return nil, err
+	}
+
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		inFile.Close()
+		return nil, err
+	}
+
+	r := &DecryptReader{
+		file:  inFile,
+		iv:    info.Aesv[:aes.BlockSize],
+		ctp:   int(info.Type),
+		base:  int64(hdrf.Rlen + int32(binary.Size(HdrInfo{}))),
+		chunk: -1,
+	}
+	r.size = inInfo.Size() - r.base
+
+	r.blk, err = aes.NewCipher(info.Aesk[:info.Size])
+	if err == nil && r.ctp == 8 {
+		r.gcm, err = cipher.NewGCM(r.blk)
+		if err == nil {
+			r.size, err = AesGcmPlainSize(r.size)
+		}
+	}
+	if err == nil && r.size < 0 {
+		err = errors.New("not an encrypted file error")
+	}
+	if err != nil {
+		inFile.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Plaintext size
+func (r *DecryptReader) Size() int64 {
+	return r.size
+}
+
+func (r *DecryptReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	l := len(p)
+	if int64(l) > r.size-off {
+		l = int(r.size - off)
+	}
+
+	var n int
+	var err error
+	if r.ctp == 2 {
+		n, err = r.readCtr(p[:l], off)
+	} else {
+		n, err = r.readGcm(p[:l], off)
+	}
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *DecryptReader) readCtr(p []byte, off int64) (int, error) {
+	n, err := r.file.ReadAt(p, r.base+off)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	stream := cipher.NewCTR(r.blk, AesCtrIv(r.iv, uint64(off/aes.BlockSize)))
+	skip := make([]byte, off%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	stream.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (r *DecryptReader) readGcm(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last := (r.size+AesChunkSize-1)/AesChunkSize - 1
+	if last < 0 {
+		last = 0
+	}
+
+	n := 0
+	for n < len(p) {
+		i := (off + int64(n)) / AesChunkSize
+		if i != r.chunk {
+			l := int64(AesChunkSize)
+			if r.size-i*AesChunkSize < l {
+				l = r.size - i*AesChunkSize
+			}
+			buf := make([]byte, l+16)
+			if _, err := r.file.ReadAt(buf, r.base+i*(AesChunkSize+16)); err != nil {
+				return n, err
+			}
+			plain, err := r.gcm.Open(buf[:0], AesGcmNonce(r.iv, i), buf, AesGcmAad(i == last))
+			if err != nil {
+				r.chunk = -1
+				return n, errors.New("gcm chunk authentication failed")
+			}
+			r.chunk, r.plain = i, plain
+		}
+		n += copy(p[n:], r.plain[off+int64(n)-i*AesChunkSize:])
+	}
+	return n, nil
+}
+
+func (r *DecryptReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *DecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *DecryptReader) Close() error {
+	return r.file.Close()
+}
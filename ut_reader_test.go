@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Encrypt size random bytes with ctp for a new key, the plaintext, the
+// encrypted file and the private key
+func testEncrypted(t *testing.T, size int, ctp string) ([]byte, string, []byte) {
+	t.Helper()
+	pubs, privs := testRecipientKeys(t, 1)
+	dir := t.TempDir()
+	plain := make([]byte, size)
+	rand.Read(plain)
+	plainPath, encPath := filepath.Join(dir, "plain"), filepath.Join(dir, "plain.enc")
+	if err := os.WriteFile(plainPath, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptFile(plainPath, encPath, pubs[0], 256, ctp, 0); err != nil {
+		t.Fatal(err)
+	}
+	return plain, encPath, privs[0]
+}
+
+func TestDecryptReaderReadAt(t *testing.T) {
+	for _, ctp := range []string{"ctr", "gcm"} {
+		for _, size := range []int{0, 1, AesChunkSize, 3*AesChunkSize + 100} {
+			plain, encPath, priv := testEncrypted(t, size, ctp)
+			r, err := OpenDecryptReader(encPath, priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != int64(size) {
+				t.Errorf("%s %d: size %d", ctp, size, r.Size())
+			}
+
+			// the same as DecryptFile
+			outPath := filepath.Join(t.TempDir(), "out")
+			if err = DecryptFile(encPath, outPath, priv); err != nil {
+				t.Fatal(err)
+			}
+			want, _ := os.ReadFile(outPath)
+			got, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			if err != nil || !bytes.Equal(got, want) || !bytes.Equal(got, plain) {
+				t.Errorf("%s %d: differs from DecryptFile, %v", ctp, size, err)
+			}
+
+			for _, tt := range []struct{ off, len int }{
+				{0, 10},
+				{AesChunkSize - 10, 20},
+				{AesChunkSize - 1, AesChunkSize + 2},
+				{AesChunkSize + 7, 2 * AesChunkSize},
+				{size - 5, 5},
+				{size - 5, 10},
+				{size, 1},
+				{size + 100, 1},
+			} {
+				if tt.off < 0 {
+					continue
+				}
+				p := make([]byte, tt.len)
+				n, err := r.ReadAt(p, int64(tt.off))
+				wantN := 0
+				if tt.off < size {
+					wantN = min(tt.len, size-tt.off)
+				}
+				if n != wantN || (n > 0 && !bytes.Equal(p[:n], plain[tt.off:tt.off+n])) {
+					t.Errorf("%s %d: ReadAt %d len %d: %d bytes, want %d", ctp, size, tt.off, tt.len, n, wantN)
+				}
+				if n < tt.len && err != io.EOF {
+					t.Errorf("%s %d: ReadAt %d len %d: %v, want EOF", ctp, size, tt.off, tt.len, err)
+				} else if n == tt.len && err != nil && err != io.EOF {
+					t.Errorf("%s %d: ReadAt %d len %d: %v", ctp, size, tt.off, tt.len, err)
+				}
+			}
+			if _, err = r.ReadAt(make([]byte, 1), -1); err == nil {
+				t.Errorf("%s %d: negative offset read", ctp, size)
+			}
+			r.Close()
+		}
+	}
+}
+
+func TestDecryptReaderSeek(t *testing.T) {
+	for _, ctp := range []string{"ctr", "gcm"} {
+		size := 2*AesChunkSize + 50
+		plain, encPath, priv := testEncrypted(t, size, ctp)
+		r, err := OpenDecryptReader(encPath, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			offset int64
+			whence int
+			want   int // position after Seek
+		}{
+			{AesChunkSize - 3, io.SeekStart, AesChunkSize - 3},
+			{AesChunkSize, io.SeekCurrent, 2*AesChunkSize + 7},
+			{-AesChunkSize - 20, io.SeekCurrent, AesChunkSize - 3}, // after the 10 bytes read
+			{-7, io.SeekEnd, size - 7},
+			{0, io.SeekStart, 0},
+			{10, io.SeekEnd, size + 10},
+		} {
+			got, err := r.Seek(tt.offset, tt.whence)
+			if err != nil || got != int64(tt.want) {
+				t.Errorf("%s: Seek %d %d: %d, %v, want %d", ctp, tt.offset, tt.whence, got, err, tt.want)
+			}
+			pos := tt.want
+
+			p := make([]byte, 10)
+			n, err := r.Read(p)
+			wantN := max(0, min(10, size-pos))
+			if n != wantN || (n > 0 && !bytes.Equal(p[:n], plain[pos:pos+n])) {
+				t.Errorf("%s: Read at %d: %d bytes, want %d", ctp, pos, n, wantN)
+			}
+			if (n == 0) != (err == io.EOF) {
+				t.Errorf("%s: Read at %d: %v", ctp, pos, err)
+			}
+		}
+
+		if _, err = r.Seek(-1, io.SeekStart); err == nil {
+			t.Errorf("%s: seeked before the start", ctp)
+		}
+		if _, err = r.Seek(0, 3); err == nil {
+			t.Errorf("%s: seeked with an invalid whence", ctp)
+		}
+		r.Close()
+	}
+}
+
+func TestDecryptReaderGcmTampered(t *testing.T) {
+	size := 3*AesChunkSize + 100
+	plain, encPath, priv := testEncrypted(t, size, "gcm")
+	data, err := os.ReadFile(encPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a bit in the middle of the second chunk
+	payload := 3*(AesChunkSize+16) + 100 + 16
+	data[len(data)-payload+AesChunkSize+16+AesChunkSize/2] ^= 1
+	if err = os.WriteFile(encPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenDecryptReader(encPath, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	p := make([]byte, 100)
+	if n, err := r.ReadAt(p, 10); err != nil || !bytes.Equal(p[:n], plain[10:110]) {
+		t.Errorf("first chunk: %v", err)
+	}
+	if n, err := r.ReadAt(p, AesChunkSize+10); err == nil || n != 0 {
+		t.Errorf("flipped chunk: %d bytes, %v", n, err)
+	}
+	// up to the flipped chunk only
+	if n, err := r.ReadAt(p, AesChunkSize-40); err == nil || n != 40 {
+		t.Errorf("across the flipped chunk: %d bytes, %v", n, err)
+	}
+	if n, err := r.ReadAt(p, 2*AesChunkSize+10); err != nil || !bytes.Equal(p[:n], plain[2*AesChunkSize+10:2*AesChunkSize+110]) {
+		t.Errorf("third chunk: %v", err)
+	}
+
+	r.Seek(AesChunkSize, io.SeekStart)
+	if n, err := r.Read(p); err == nil || n != 0 {
+		t.Errorf("Read of the flipped chunk: %d bytes, %v", n, err)
+	}
+	if err = DecryptFile(encPath, filepath.Join(t.TempDir(), "out"), priv); err == nil {
+		t.Error("DecryptFile decrypted the flipped chunk")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	EncFlagV1 = 0x32571235 // header followed by one RSA encrypted AesInfo
+	EncFlagV2 = 0x32571236 // header followed by a recipient block
+)
+
+// The recipient block of a v2 file is a uint32 count and per recipient a
+// RecipientHdr followed by Wlen bytes of its wrapped AesInfo; HdrInfo.Rlen
+// is the size of the whole block
+type RecipientHdr struct {
+	Type uint32   // wrapping, WrapRsa or WrapX25519 maybe with WrapShare
+	Fprt [32]byte // KeyFingerprint of the recipient key
+	Wlen uint32   // wrapped AesInfo size
+}
+
+const (
+	WrapRsa      = 1 // rsa pkcs1v15
+	WrapX25519   = 2 // hpke dhkem-x25519 hkdf-sha256 aes-256-gcm, enc || ciphertext
+	WrapVault    = 3 // vault transit, mount/key "\n" vault ciphertext
+	WrapSshAgent = 4 // ssh-agent signature derived aes-256-gcm, see sshAgentWrapper
+
+	WrapShare = 0x100 // or'ed in, the recipient holds a Share of the AesInfo
+)
+
+type Recipient struct {
+	RecipientHdr
+	Wrapped []byte
+}
+
+func (r *Recipient) KeyID() string {
+	return KeyID(r.Fprt)
+}
+
+// Build the recipient block wrapping info for every RSA or X25519 public
+// key and Vault key in rsaPubKey, which may hold several PEM blocks. With
+// a threshold above 0 the data key is split into a share per recipient,
+// that many of which are needed to decrypt, instead of wrapped whole for each
+func WrapAesInfo(rsaPubKey []byte, info *AesInfo, threshold int) ([]byte, error) {
+	wrappers, err := RecipientWrappers(rsaPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var shares []*Share
+	if threshold < 0 {
+		return nil, errors.New("threshold can't be negative")
+	}
+	if threshold > 0 {
+		if len(wrappers) < threshold || threshold < 2 {
+			return nil, fmt.Errorf("a threshold of %d needs at least as many recipients and at least 2, %d given", threshold, len(wrappers))
+		}
+		// one key holding two shares would count twice
+		seen := make(map[[32]byte]bool)
+		for _, w := range wrappers {
+			if seen[w.Fingerprint()] {
+				return nil, errors.New("recipient " + KeyID(w.Fingerprint()) + " is given twice, a threshold needs distinct keys")
+			}
+			seen[w.Fingerprint()] = true
+		}
+		if shares, err = ShamirSplit(AesInfo2Bytes(info), len(wrappers), threshold); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(wrappers)))
+	for i, w := range wrappers {
+		rh := RecipientHdr{Type: w.Type(), Fprt: w.Fingerprint()}
+		data := AesInfo2Bytes(info)
+		if shares != nil {
+			rh.Type |= WrapShare
+			data = shares[i].Bytes()
+		}
+
+		wrapped, err := w.Wrap(data)
+		if err != nil {
+			return nil, err
+		}
+		rh.Wlen = uint32(len(wrapped))
+		binary.Write(buf, binary.LittleEndian, &rh)
+		buf.Write(wrapped)
+	}
+	return buf.Bytes(), nil
+}
+
+func ParseRecipients(block []byte) ([]*Recipient, error) {
+	r := bytes.NewReader(block)
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, errors.New("recipient block truncated")
+	}
+
+	var list []*Recipient
+	for i := uint32(0); i < count; i++ {
+		rcp := new(Recipient)
+		if err := binary.Read(r, binary.LittleEndian, &rcp.RecipientHdr); err != nil {
+			return nil, errors.New("recipient block truncated")
+		}
+		if int64(rcp.Wlen) > int64(r.Len()) {
+			return nil, errors.New("recipient block truncated")
+		}
+		rcp.Wrapped = make([]byte, rcp.Wlen)
+		r.Read(rcp.Wrapped)
+		list = append(list, rcp)
+	}
+	return list, nil
+}
+
+// Recover the AesInfo from the block after hdrf using whichever private key
+// in rsaPriKey it is meant for, the Vault key it names if VAULT_ADDR is set
+// or a key of the ssh-agent; for a data key split into shares rsaPriKey may also hold armored
+// shares unwrapped elsewhere, see UnwrapShares
+func UnwrapAesInfo(hdrf *HdrInfo, block []byte, rsaPriKey []byte) (*AesInfo, error) {
+	given, err := BundleShares(rsaPriKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdrf.Eflg == EncFlagV1 {
+		wrappers := IdentityWrappers(rsaPriKey)
+		if len(wrappers) == 0 {
+			return nil, errors.New("private key error!")
+		}
+		// no key IDs, try each RSA key, in a token too, against the
+		// header checksum
+		for _, w := range wrappers {
+			if w.Type() != WrapRsa {
+				continue
+			}
+			binInfo, err := w.Unwrap(block)
+			if err != nil {
+				continue
+			}
+			if info := Bytes2AesInfo(binInfo); info != nil && CheckFchk(hdrf.Fchk[:], info.Fchk[:]) {
+				return info, nil
+			}
+		}
+		return nil, errors.New("decrypt rsa bin failed")
+	}
+
+	list, err := ParseRecipients(block)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	shared := false
+	for _, rcp := range list {
+		ids = append(ids, rcp.KeyID())
+		shared = shared || rcp.Type&WrapShare != 0
+	}
+
+	binInfo, shares, err := unwrapRecipients(list, IdentityWrappers(rsaPriKey))
+	if binInfo == nil && shared && (len(shares) > 0 || len(given) > 0 || err == nil) {
+		binInfo, err = combineShares(append(shares, given...), ids)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if binInfo == nil {
+		return nil, errors.New("no private key for recipients " + strings.Join(ids, ", "))
+	}
+
+	info := Bytes2AesInfo(binInfo)
+	if info == nil {
+		return nil, errors.New("decrypt rsa bin failed")
+	}
+	return info, nil
+}
+
+// Unwrap what the wrappers can of list: the whole AesInfo, or else the
+// shares of it; the error is that of the first failed unwrap, after the
+// rest are tried
+func unwrapRecipients(list []*Recipient, wrappers []KeyWrapper) ([]byte, []*Share, error) {
+	var shares []*Share
+	var firstErr error
+	for _, rcp := range list {
+		var w KeyWrapper
+		for _, iw := range wrappers {
+			if iw.Type() == rcp.Type&^WrapShare && iw.Fingerprint() == rcp.Fprt {
+				w = iw
+			}
+		}
+		if w == nil && rcp.Type&^WrapShare == WrapVault {
+			w = vaultWrapperFor(rcp)
+		}
+		if w == nil && rcp.Type&^WrapShare == WrapSshAgent {
+			w = sshAgentWrapperFor(rcp.Fprt)
+		}
+		if w == nil {
+			continue
+		}
+
+		data, err := w.Unwrap(rcp.Wrapped)
+		if err == nil && rcp.Type&WrapShare == 0 {
+			return data, nil, nil
+		}
+		var sh *Share
+		if err == nil {
+			sh, err = ParseShareBytes(data)
+		}
+		if err != nil {
+			if w.Type() == WrapRsa || w.Type() == WrapX25519 {
+				err = errors.New("decrypt rsa bin failed")
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		shares = append(shares, sh)
+	}
+	return nil, shares, firstErr
+}
+
+// Combine the shares of one data key; shares of other files are left out,
+// so that the shares given for one file don't get in the way of the rest
+func combineShares(shares []*Share, ids []string) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no private key for recipients " + strings.Join(ids, ", "))
+	}
+
+	// the set of the first share, which is an unwrapped one if there are any
+	set := shares[0].Set
+	var use []*Share
+	seen := make(map[int]bool)
+	for _, sh := range shares {
+		if bytes.Equal(sh.Set, set) && !seen[sh.Index] {
+			seen[sh.Index] = true
+			use = append(use, sh)
+		}
+	}
+	if len(use) < use[0].Threshold {
+		return nil, fmt.Errorf("not enough key shares, %d of %d for recipients %s; give the partial unwraps of the others with -part",
+			len(use), use[0].Threshold, strings.Join(ids, ", "))
+	}
+	return ShamirCombine(use)
+}
+
+// Shares of the data key of inPath that the private keys in priKey unwrap,
+// to hand to whoever decrypts it
+func UnwrapShares(inPath string, priKey []byte) ([]*Share, error) {
+	hdrf, block, err := readHdrBlock(inPath)
+	if err != nil {
+		return nil, err
+	}
+	if hdrf.Eflg == EncFlagV1 {
+		return nil, errors.New("data key of " + inPath + " isn't split into shares")
+	}
+	list, err := ParseRecipients(block)
+	if err != nil {
+		return nil, err
+	}
+	binInfo, shares, err := unwrapRecipients(list, IdentityWrappers(priKey))
+	if binInfo == nil && len(shares) == 0 && err != nil {
+		return nil, err
+	}
+	if binInfo != nil {
+		return nil, errors.New("data key of " + inPath + " isn't split into shares")
+	}
+	if len(shares) == 0 {
+		var ids []string
+		for _, rcp := range list {
+			ids = append(ids, rcp.KeyID())
+		}
+		return nil, errors.New("no private key for recipients " + strings.Join(ids, ", "))
+	}
+	return shares, nil
+}
+
+// Recipients recorded in the header of inPath, nil for a v1 file
+func ReadRecipients(inPath string) ([]*Recipient, error) {
+	hdrf, block, err := readHdrBlock(inPath)
+	if err != nil || hdrf.Eflg == EncFlagV1 {
+		return nil, err
+	}
+	return ParseRecipients(block)
+}
+
+// Header of inPath and the block after it
+func readHdrBlock(inPath string) (*HdrInfo, []byte, error) {
+	hdrf, err := ReadHdrInfo(inPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer inFile.Close()
+
+	if hdrf.Rlen <= 0 || hdrf.Rlen > 1<<20 {
+		return nil, nil, errors.New("not an encrypted file error")
+	}
+	block := make([]byte, hdrf.Rlen)
+	if _, err = inFile.ReadAt(block, int64(binary.Size(HdrInfo{}))); err != nil {
+		return nil, nil, errors.New("read rsa bin failed")
+	}
+	return hdrf, block, nil
+}
+
+// Fingerprint in hex
+func FingerprintString(fprt [32]byte) string {
+	return hex.EncodeToString(fprt[:])
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// PEM public and private keys of n new X25519 key pairs
+func testRecipientKeys(t *testing.T, n int) (pubs, privs [][]byte) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kf := &KeyFile{Private: priv, Public: PublicOf(priv)}
+		pub, err := kf.Encode("spki")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pri, err := kf.Encode("pkcs8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs, privs = append(pubs, pub), append(privs, pri)
+	}
+	return pubs, privs
+}
+
+func testAesInfo() *AesInfo {
+	info := &AesInfo{Size: 32, Type: 1}
+	rand.Read(info.Aesk[:])
+	rand.Read(info.Aesv[:])
+	rand.Read(info.Fchk[:])
+	return info
+}
+
+func TestWrapAesInfoThreshold(t *testing.T) {
+	pubs, privs := testRecipientKeys(t, 4)
+	info := testAesInfo()
+	block, err := WrapAesInfo(bytes.Join(pubs, nil), info, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrf := &HdrInfo{Eflg: EncFlagV2, Fchk: info.Fchk}
+
+	// every 3 of the 4 keys, and all of them
+	subsets := [][]int{{0, 1, 2}, {0, 1, 3}, {0, 2, 3}, {1, 2, 3}, {0, 1, 2, 3}}
+	for _, sub := range subsets {
+		var bundle []byte
+		for _, i := range sub {
+			bundle = append(bundle, privs[i]...)
+		}
+		got, err := UnwrapAesInfo(hdrf, block, bundle)
+		if err != nil {
+			t.Errorf("keys %v: %v", sub, err)
+		} else if *got != *info {
+			t.Errorf("keys %v: wrong data key", sub)
+		}
+	}
+
+	_, err = UnwrapAesInfo(hdrf, block, bytes.Join(privs[:2], nil))
+	if err == nil || !strings.Contains(err.Error(), "not enough key shares, 2 of 3") {
+		t.Errorf("2 keys: %v", err)
+	}
+}
+
+func TestWrapAesInfoRejects(t *testing.T) {
+	pubs, _ := testRecipientKeys(t, 3)
+	tests := []struct {
+		bundle    []byte
+		threshold int
+		want      string
+	}{
+		{bytes.Join(pubs, nil), 1, "threshold of 1"},
+		{bytes.Join(pubs, nil), 4, "threshold of 4"},
+		{bytes.Join(pubs, nil), -1, "negative"},
+		{bytes.Join(pubs[:1], nil), 2, "threshold of 2"},
+		{bytes.Join([][]byte{pubs[0], pubs[1], pubs[0]}, nil), 2, "given twice"},
+	}
+	for _, tt := range tests {
+		_, err := WrapAesInfo(tt.bundle, testAesInfo(), tt.threshold)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("threshold %d: %v, want %s", tt.threshold, err, tt.want)
+		}
+	}
+
+	// the same key twice is fine without a threshold
+	if _, err := WrapAesInfo(bytes.Join([][]byte{pubs[0], pubs[0]}, nil), testAesInfo(), 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCombineShares(t *testing.T) {
+	secret := []byte("data key of one file")
+	shares, err := ShamirSplit(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ShamirSplit([]byte("data key of another file"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{"a", "b", "c"}
+
+	tests := []struct {
+		shares []*Share
+		want   string // error, "" for the secret
+	}{
+		{[]*Share{shares[0], shares[2]}, ""},
+		{[]*Share{shares[2], shares[1], shares[0]}, ""},
+		{[]*Share{shares[0], other[1], shares[1]}, ""},
+		{[]*Share{shares[0], shares[0], shares[1]}, ""},
+		{[]*Share{shares[1]}, "not enough key shares, 1 of 2"},
+		{[]*Share{shares[1], shares[1]}, "not enough key shares, 1 of 2"},
+		{[]*Share{shares[1], other[0], other[2]}, "not enough key shares, 1 of 2"},
+		{nil, "no private key for recipients a, b, c"},
+	}
+	for i, tt := range tests {
+		got, err := combineShares(tt.shares, ids)
+		if tt.want == "" {
+			if err != nil || !bytes.Equal(got, secret) {
+				t.Errorf("%d: %q, %v", i, got, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%d: %v, want %s", i, err, tt.want)
+		}
+	}
+}
+
+func TestUnwrapShares(t *testing.T) {
+	pubs, privs := testRecipientKeys(t, 3)
+	dir := t.TempDir()
+	plain := make([]byte, 1000)
+	rand.Read(plain)
+	plainPath := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plainPath, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	encPaths := []string{filepath.Join(dir, "a.enc"), filepath.Join(dir, "b.enc")}
+	for _, p := range encPaths {
+		if err := EncryptFile(plainPath, p, bytes.Join(pubs, nil), 256, "ctr", 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// armor of what key i unwraps of file f
+	part := func(f, i int) []byte {
+		shares, err := UnwrapShares(encPaths[f], privs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != 1 {
+			t.Fatalf("%d shares from one key", len(shares))
+		}
+		return shares[0].Armor()
+	}
+
+	tests := []struct {
+		name   string
+		bundle [][]byte
+		want   string
+	}{
+		{"key and a part", [][]byte{privs[0], part(0, 2)}, ""},
+		{"two parts", [][]byte{part(0, 1), part(0, 2)}, ""},
+		{"part of another file", [][]byte{privs[0], part(1, 2)}, "not enough key shares"},
+		{"another file and enough", [][]byte{part(1, 2), privs[0], part(0, 1)}, ""},
+		{"same share twice", [][]byte{privs[1], part(0, 1)}, "not enough key shares"},
+		{"part given twice", [][]byte{part(0, 0), part(0, 0)}, "not enough key shares"},
+	}
+	for _, tt := range tests {
+		outPath := filepath.Join(dir, "out")
+		os.Remove(outPath)
+		err := DecryptFile(encPaths[0], outPath, bytes.Join(tt.bundle, nil))
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if got, _ := os.ReadFile(outPath); !bytes.Equal(got, plain) {
+				t.Errorf("%s: plaintext differs", tt.name)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %s", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := UnwrapShares(encPaths[0], privs[0][:0]); err == nil {
+		t.Error("unwrapped without a key")
+	}
+}
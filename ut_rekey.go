@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// Wrap the data key of inPath for the keys in rsaPubKey instead of its
+// current recipients, split among them with a threshold above 0; the
+// payload is copied as it is
+func RekeyFile(inPath string, rsaPriKey, rsaPubKey []byte, threshold int) (err error) {
+	hdrf, info, err := ReadEncHdr(inPath, rsaPriKey)
+	if err != nil {
+		return err
+	}
+
+	rsaBin, err := WrapAesInfo(rsaPubKey, info, threshold)
+	if err != nil {
+		return err
+	}
+
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	_, err = inFile.Seek(int64(hdrf.Rlen+int32(binary.Size(HdrInfo{}))), 0)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := CreateTempFile(inPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			AbortTempFile(outFile)
+		}
+	}()
+
+	hdrf.Eflg = EncFlagV2
+	hdrf.Rlen = int32(len(rsaBin))
+	if _, err = outFile.Write(HdrInfo2Bytes(hdrf)); err != nil {
+		return err
+	}
+	if _, err = outFile.Write(rsaBin); err != nil {
+		return err
+	}
+	if _, err = io.Copy(outFile, inFile); err != nil {
+		return err
+	}
+
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	outFile.Chmod(inInfo.Mode())
+	return CommitTempFile(outFile, inPath)
+}
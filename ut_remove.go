@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Check that encPath decrypts to the checksum in its header using the data
+// key from info, so no private key is needed
+func VerifyEncFile(encPath string, info *AesInfo) error {
+	hdrf, err := ReadHdrInfo(encPath)
+	if err != nil {
+		return err
+	}
+	if CheckFchk(hdrf.Fchk[:], info.Fchk[:]) != true {
+		return errors.New("header checksum failed")
+	}
+
+	var reader io.Reader
+	if info.Type == 2 || info.Type == 8 {
+		r, err := NewDecryptReader(encPath, hdrf, info)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		reader = r
+	} else {
+		inFile, err := os.Open(encPath)
+		if err != nil {
+			return err
+		}
+		defer inFile.Close()
+
+		_, err = inFile.Seek(int64(hdrf.Rlen+int32(binary.Size(HdrInfo{}))), 0)
+		if err != nil {
+			return err
+		}
+
+		block, err := aes.NewCipher(info.Aesk[:info.Size])
+		if err != nil {
+			return err
+		}
+
+		var stream cipher.Stream
+		if info.Type == 1 {
+			stream = cipher.NewCFBDecrypter(block, info.Aesv[:aes.BlockSize])
+		} else {
+			stream = cipher.NewOFB(block, info.Aesv[:aes.BlockSize])
+		}
+		reader = &cipher.StreamReader{S: stream, R: inFile}
+	}
+
+	h := md5.New()
+	if _, err = io.Copy(h, reader); err != nil {
+		return err
+	}
+	if CheckFchk(hdrf.Fchk[:], h.Sum(nil)) != true {
+		return errors.New("encrypted file checksum not match")
+	}
+	return nil
+}
+
+// Remove a file, first overwriting it with random data if overwrite; that
+// pass is of no use on copy-on-write filesystems and is refused for files
+// with other hard links, see checkShred
+func RemoveFile(path string, overwrite bool) error {
+	if fi, err := os.Lstat(path); err == nil && !fi.Mode().IsRegular() {
+		overwrite = false
+	}
+	if overwrite {
+		if err := checkShred(path); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+
+		fileInfo, err := file.Stat()
+		if err == nil {
+			_, err = io.CopyN(file, rand.Reader, fileInfo.Size())
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// Overwriting one name of a file with other hard links would only remove
+// that name, the data stays in place under the others
+func checkShred(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if _, nlink := FileLinkID(fi); nlink > 1 {
+		return fmt.Errorf("%s has %d hard links, shred can't overwrite the data under the other names", path, nlink)
+	}
+	return nil
+}
+
+// Encrypt inPath, verify outPath by decrypting it and only then remove inPath
+func EncryptFileRemove(inPath, outPath string, rsaPubKey []byte, aesBits int, aesCtp string, threshold int, overwrite bool) error {
+	if overwrite {
+		if err := checkShred(inPath); err != nil {
+			return err
+		}
+	}
+	// inPath stays on any error, an output that may not be durable too
+	info, err := encryptFile(inPath, outPath, rsaPubKey, aesBits, aesCtp, threshold, true)
+	if err != nil {
+		return err
+	}
+	if err = VerifyEncFile(outPath, info); err != nil {
+		return err
+	}
+	return RemoveFile(inPath, overwrite)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// One processed file in -json output
+type FileRecord struct {
+	Path    string      `json:"path"`
+	Output  string      `json:"output,omitempty"`
+	Action  string      `json:"action"` // see ProgressEvent, or "generated", "inspected", "verified"
+	Bytes   int64       `json:"bytes"`
+	Seconds float64     `json:"seconds"`
+	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"` // see ErrorCode
+	Header  *FileHeader `json:"header,omitempty"`
+}
+
+// Last record of -json output
+type SummaryRecord struct {
+	Summary bool             `json:"summary"`
+	Command string           `json:"command"`
+	OK      bool             `json:"ok"`
+	Files   int64            `json:"files"`
+	Counts  map[string]int64 `json:"counts"`
+	Bytes   int64            `json:"bytes"`
+	Seconds float64          `json:"seconds"`
+	Error   string           `json:"error,omitempty"`
+	Code    string           `json:"code,omitempty"`
+}
+
+// Stable short name for the kind of err, for scripts
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if os.IsNotExist(err) || strings.Contains(err.Error(), "isn't exist") {
+		return "not_found"
+	}
+	if os.IsPermission(err) {
+		return "permission_denied"
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "not modified"):
+		return "not_modified"
+	case strings.Contains(msg, "not an encrypted file"):
+		return "not_encrypted"
+	case strings.Contains(msg, "not enough key shares"):
+		return "shares_needed"
+	case strings.Contains(msg, "decrypt rsa bin") || strings.Contains(msg, "RSA decrypt") ||
+		strings.Contains(msg, "no private key"):
+		return "wrong_key"
+	case strings.Contains(msg, "key error") || strings.Contains(msg, "key file"):
+		return "bad_key"
+	case strings.Contains(msg, "checksum") || strings.Contains(msg, "authentication failed") ||
+		strings.Contains(msg, "truncated") || strings.Contains(msg, "shorter than"):
+		return "corrupt"
+	case strings.Contains(msg, "exist") || strings.Contains(msg, "not empty"):
+		return "exists"
+	case strings.Contains(msg, "entries failed"):
+		return "partial"
+	}
+	return "error"
+}
+
+// Writes -json output, one FileRecord per line and a SummaryRecord at the end
+type Reporter struct {
+	Command string
+	Stats   *ProgressStats
+	enc     *json.Encoder
+}
+
+func NewReporter(w io.Writer, command string) *Reporter {
+	return &Reporter{Command: command, Stats: NewProgressStats(), enc: json.NewEncoder(w)}
+}
+
+// ProgressFunc writing a record per file
+func (rp *Reporter) Progress(ev *ProgressEvent) {
+	if ev.Kind == "file" {
+		rp.File(ev, nil)
+	} else {
+		rp.Stats.Update(ev)
+	}
+}
+
+func (rp *Reporter) File(ev *ProgressEvent, hdr *FileHeader) {
+	rp.Stats.Update(&ProgressEvent{Kind: "file", Action: ev.Action, Bytes: ev.Bytes})
+
+	rec := &FileRecord{
+		Path:    ev.Path,
+		Output:  ev.Output,
+		Action:  ev.Action,
+		Bytes:   ev.Bytes,
+		Seconds: ev.Duration.Seconds(),
+		Code:    ErrorCode(ev.Err),
+		Header:  hdr,
+	}
+	if ev.Err != nil {
+		rec.Error = ev.Err.Error()
+	}
+	rp.enc.Encode(rec)
+}
+
+// Record a single file done outside a directory run
+func (rp *Reporter) FileDone(path, outPath, action string, size int64, start time.Time, err error) {
+	if err != nil {
+		action = "failed"
+	}
+	rp.File(&ProgressEvent{Path: path, Output: outPath, Action: action, Bytes: size, Duration: time.Since(start), Err: err}, nil)
+}
+
+func (rp *Reporter) Summary(err error) {
+	st := rp.Stats
+	d := st.Duration
+	if d == 0 {
+		d = time.Since(st.Start)
+	}
+
+	rec := &SummaryRecord{
+		Summary: true,
+		Command: rp.Command,
+		OK:      err == nil,
+		Files:   st.DoneFiles,
+		Counts:  st.Counts,
+		Bytes:   st.DoneBytes,
+		Seconds: d.Seconds(),
+		Code:    ErrorCode(err),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	rp.enc.Encode(rec)
+}
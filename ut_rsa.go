@@ -98,7 +98,15 @@ func RsaEncrypt(publicKey []byte, origData []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	pub := pubInterface.(*rsa.PublicKey)
+	pub, ok := pubInterface.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key error")
+	}
+	return RsaEncryptKey(pub, origData)
+}
+
+// RSA encrypt with a parsed key, data longer than one block is split in two
+func RsaEncryptKey(pub *rsa.PublicKey, origData []byte) ([]byte, error) {
 	k := (pub.N.BitLen() + 7) / 8
 	if len(origData) > k-11 {
 		o1, e1 := rsa.EncryptPKCS1v15(rand.Reader, pub, origData[:k-19])
@@ -122,7 +130,11 @@ func RsaDecrypt(privateKey []byte, ciphertext []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return RsaDecryptKey(priv, ciphertext)
+}
 
+// RSA decrypt with a parsed key, the inverse of RsaEncryptKey
+func RsaDecryptKey(priv *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
 	k := (priv.N.BitLen() + 7) / 8
 	if len(ciphertext) > k {
 		o1, e1 := rsa.DecryptPKCS1v15(rand.Reader, priv, ciphertext[:k])
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// scrypt of RFC 7914, the passphrase key derivation of the age format.
+// N is the CPU/memory cost, a power of 2; memory used is 128*r*N bytes
+func Scrypt(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+	if N <= 1 || N&(N-1) != 0 {
+		return nil, errors.New("scrypt N must be a power of 2 above 1")
+	}
+	if r < 1 || p < 1 || uint64(r)*uint64(p) >= 1<<30 || r > 1<<24/p || N > 1<<30/r {
+		return nil, errors.New("scrypt parameters too large")
+	}
+
+	b, err := pbkdf2.Key(sha256.New, string(password), salt, 1, p*128*r)
+	if err != nil {
+		return nil, err
+	}
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*N*r)
+	for i := 0; i < p; i++ {
+		scryptSmix(b[i*128*r:], r, N, v, xy)
+	}
+	return pbkdf2.Key(sha256.New, string(password), b, 1, keyLen)
+}
+
+// ROMix of one 128*r byte block of b, in place
+func scryptSmix(b []byte, r, N int, v, xy []uint32) {
+	R := 32 * r
+	x, y := xy[:R], xy[R:]
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	for i := 0; i < N; i += 2 {
+		copy(v[i*R:], x)
+		scryptBlockMix(x, y, r)
+		copy(v[(i+1)*R:], y)
+		scryptBlockMix(y, x, r)
+	}
+	for i := 0; i < N; i += 2 {
+		j := int(x[R-16]) & (N - 1)
+		for k, w := range v[j*R : (j+1)*R] {
+			x[k] ^= w
+		}
+		scryptBlockMix(x, y, r)
+		j = int(y[R-16]) & (N - 1)
+		for k, w := range v[j*R : (j+1)*R] {
+			y[k] ^= w
+		}
+		scryptBlockMix(y, x, r)
+	}
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+}
+
+// BlockMix of the 2*r 64-byte blocks of in into out, even blocks first
+func scryptBlockMix(in, out []uint32, r int) {
+	var t [16]uint32
+	copy(t[:], in[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := range t {
+			t[k] ^= in[i*16+k]
+		}
+		salsa208(&t)
+		dst := (i/2)*16 + (i%2)*r*16
+		copy(out[dst:dst+16], t[:])
+	}
+}
+
+// Salsa20/8 core, in place
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
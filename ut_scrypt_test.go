@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Test vectors of RFC 7914, leaving out the one with N = 2^20
+
+// 8, salsa20/8 core
+func TestSalsa208(t *testing.T) {
+	in := unhex(t, "7e879a214f3ec9867ca940e641718f26baee555b8c61c1b50df846116dcd3b1d"+
+		"ee24f319df9b3d8514121e4b5ac5aa3276021d2909c74829edebc68db8b8c25e")
+	want := unhex(t, "a41f859c6608cc993b81cacb020cef05044b2181a2fd337dfd7b1c6396682f29"+
+		"b4393168e3c9e6bcfe6bc5b7a06d96bae424cc102c91745c24ad673dc7618f81")
+
+	var b [16]uint32
+	for i := range b {
+		b[i] = binary.LittleEndian.Uint32(in[4*i:])
+	}
+	salsa208(&b)
+	got := make([]byte, 64)
+	for i, v := range b {
+		binary.LittleEndian.PutUint32(got[4*i:], v)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("salsa20/8 %x, want %x", got, want)
+	}
+}
+
+// 12
+func TestScrypt(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		N, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1,
+			"77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442" +
+				"fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16,
+			"fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162" +
+				"2eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1,
+			"7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2" +
+				"d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+	}
+	for _, tt := range tests {
+		got, err := Scrypt([]byte(tt.password), []byte(tt.salt), tt.N, tt.r, tt.p, 64)
+		if err != nil {
+			t.Errorf("scrypt(%q, %q): %v", tt.password, tt.salt, err)
+			continue
+		}
+		if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("scrypt(%q, %q) = %x, want %x", tt.password, tt.salt, got, want)
+		}
+	}
+}
+
+func TestScryptParams(t *testing.T) {
+	for _, N := range []int{0, 1, 3, 1000} {
+		if _, err := Scrypt([]byte("p"), []byte("s"), N, 8, 1, 32); err == nil {
+			t.Errorf("N = %d accepted", N)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Shamir secret sharing over GF(256) with the AES polynomial, each byte of
+// the secret is the constant term of its own random polynomial of degree
+// threshold-1 and share x holds the polynomials evaluated at x
+
+var gfExp, gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		// multiply by the generator 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+255-int(gfLog[b]))%255]
+}
+
+// One share of a split secret
+type Share struct {
+	Index     int    // x coordinate, 1 to Total
+	Total     int    // shares made
+	Threshold int    // shares needed
+	Set       []byte // first 8 bytes of the SHA-256 of the secret
+	Data      []byte // y coordinates, one per secret byte
+}
+
+// Split secret into n shares any m of which give it back
+func ShamirSplit(secret []byte, n, m int) ([]*Share, error) {
+	if m < 2 || m > n || n > 255 {
+		return nil, errors.New("shares need 2 <= threshold <= count <= 255")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+
+	sum := sha256.Sum256(secret)
+	shares := make([]*Share, n)
+	for i := range shares {
+		shares[i] = &Share{Index: i + 1, Total: n, Threshold: m, Set: sum[:8], Data: make([]byte, len(secret))}
+	}
+
+	coef := make([]byte, m)
+	for j, b := range secret {
+		coef[0] = b
+		if _, err := rand.Read(coef[1:]); err != nil {
+			return nil, err
+		}
+		for _, sh := range shares {
+			// Horner's rule at x = Index
+			x, y := byte(sh.Index), byte(0)
+			for k := m - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coef[k]
+			}
+			sh.Data[j] = y
+		}
+	}
+	return shares, nil
+}
+
+// Recover the secret from at least threshold shares of one set
+func ShamirCombine(shares []*Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	first := shares[0]
+	seen := make(map[int]bool)
+	var use []*Share
+	for _, sh := range shares {
+		if !bytes.Equal(sh.Set, first.Set) || sh.Threshold != first.Threshold || len(sh.Data) != len(first.Data) {
+			return nil, errors.New("shares are from different sets")
+		}
+		if seen[sh.Index] {
+			return nil, fmt.Errorf("share %d given twice", sh.Index)
+		}
+		seen[sh.Index] = true
+		use = append(use, sh)
+	}
+	if len(use) < first.Threshold {
+		return nil, fmt.Errorf("%d of %d shares needed, %d given", first.Threshold, first.Total, len(use))
+	}
+	use = use[:first.Threshold]
+
+	// Lagrange interpolation at x = 0
+	secret := make([]byte, len(first.Data))
+	for i, si := range use {
+		basis := byte(1)
+		for j, sj := range use {
+			if i != j {
+				basis = gfMul(basis, gfDiv(byte(sj.Index), byte(si.Index)^byte(sj.Index)))
+			}
+		}
+		for k, y := range si.Data {
+			secret[k] ^= gfMul(basis, y)
+		}
+	}
+
+	sum := sha256.Sum256(secret)
+	if !bytes.Equal(sum[:8], first.Set) {
+		return nil, errors.New("shares don't give back the secret, checksum mismatch")
+	}
+	return secret, nil
+}
+
+const (
+	shareBegin    = "-----BEGIN BITCRYPT SHARE-----"
+	shareEnd      = "-----END BITCRYPT SHARE-----"
+	shareLineSize = 20 // bytes per line, 32 base32 characters
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Checksum of one armor line, the first byte of its SHA-256
+func shareLineSum(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return strings.ToUpper(hex.EncodeToString(sum[:1]))
+}
+
+// Text armor of a share, upper case letters, digits, spaces and dashes only
+// so it can be typed back or put in a QR code in alphanumeric mode:
+//
+//	-----BEGIN BITCRYPT SHARE-----
+//	SHARE 2 OF 5 THRESHOLD 3
+//	SET 1A2B3C4D5E6F7081
+//	01 MFRGGZDFMZTWQ2LKNNWG23TPOBYXE43T 3A
+//	...
+//	CHECK 9F8E7D6C
+//	-----END BITCRYPT SHARE-----
+//
+// each data line ends in its checksum, CHECK covers the whole share
+func (sh *Share) Armor() []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, shareBegin)
+	fmt.Fprintf(buf, "SHARE %d OF %d THRESHOLD %d\n", sh.Index, sh.Total, sh.Threshold)
+	fmt.Fprintf(buf, "SET %s\n", strings.ToUpper(hex.EncodeToString(sh.Set)))
+	for i := 0; i*shareLineSize < len(sh.Data); i++ {
+		end := (i + 1) * shareLineSize
+		if end > len(sh.Data) {
+			end = len(sh.Data)
+		}
+		line := fmt.Sprintf("%02d %s", i+1, shareEncoding.EncodeToString(sh.Data[i*shareLineSize:end]))
+		fmt.Fprintf(buf, "%s %s\n", line, shareLineSum(line))
+	}
+	fmt.Fprintf(buf, "CHECK %s\n", sh.check())
+	fmt.Fprintln(buf, shareEnd)
+	return buf.Bytes()
+}
+
+func (sh *Share) check() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d %d ", sh.Index, sh.Total, sh.Threshold)
+	h.Write(sh.Set)
+	h.Write(sh.Data)
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil)[:4]))
+}
+
+// Parse the armor of a share, case and extra spaces don't matter
+func ParseShare(text []byte) (*Share, error) {
+	sh := new(Share)
+	state := 0 // 0 before BEGIN, 1 inside, 2 after END
+	check := ""
+	sc := bufio.NewScanner(bytes.NewReader(text))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.Join(strings.Fields(strings.ToUpper(sc.Text())), " ")
+		if line == "" {
+			continue
+		}
+		bad := func(what string) error {
+			return fmt.Errorf("share line %d: %s", n, what)
+		}
+
+		switch {
+		case state == 0:
+			if line == shareBegin {
+				state = 1
+			}
+		case line == shareEnd:
+			state = 2
+		case strings.HasPrefix(line, "SHARE "):
+			if _, err := fmt.Sscanf(line, "SHARE %d OF %d THRESHOLD %d", &sh.Index, &sh.Total, &sh.Threshold); err != nil {
+				return nil, bad("invalid SHARE line")
+			}
+		case strings.HasPrefix(line, "SET "):
+			set, err := hex.DecodeString(strings.TrimPrefix(line, "SET "))
+			if err != nil || len(set) != 8 {
+				return nil, bad("invalid SET line")
+			}
+			sh.Set = set
+		case strings.HasPrefix(line, "CHECK "):
+			check = strings.TrimPrefix(line, "CHECK ")
+		default:
+			f := strings.Fields(line)
+			if len(f) != 3 {
+				return nil, bad("unrecognized")
+			}
+			if num, err := strconv.Atoi(f[0]); err != nil || num != len(sh.Data)/shareLineSize+1 {
+				return nil, bad("lines out of order or missing")
+			}
+			if shareLineSum(f[0]+" "+f[1]) != f[2] {
+				return nil, bad("checksum mismatch, check the line for typos")
+			}
+			data, err := shareEncoding.DecodeString(f[1])
+			if err != nil {
+				return nil, bad("invalid characters")
+			}
+			sh.Data = append(sh.Data, data...)
+		}
+		if state == 2 {
+			break
+		}
+	}
+
+	if state != 2 {
+		return nil, errors.New("no complete share found")
+	}
+	if sh.Index < 1 || sh.Index > sh.Total || sh.Threshold < 2 || sh.Threshold > sh.Total || sh.Set == nil || len(sh.Data) == 0 {
+		return nil, errors.New("share header incomplete")
+	}
+	if check != sh.check() {
+		return nil, errors.New("share checksum mismatch, a line is missing or wrong")
+	}
+	return sh, nil
+}
+
+// Binary form of a share: index, total and threshold bytes, the set, the
+// data
+func (sh *Share) Bytes() []byte {
+	b := []byte{byte(sh.Index), byte(sh.Total), byte(sh.Threshold)}
+	b = append(b, sh.Set...)
+	return append(b, sh.Data...)
+}
+
+func ParseShareBytes(b []byte) (*Share, error) {
+	if len(b) < 3+8+1 {
+		return nil, errors.New("share truncated")
+	}
+	sh := &Share{Index: int(b[0]), Total: int(b[1]), Threshold: int(b[2]), Set: b[3:11], Data: b[11:]}
+	if sh.Index < 1 || sh.Index > sh.Total || sh.Threshold < 2 || sh.Threshold > sh.Total {
+		return nil, errors.New("share header invalid")
+	}
+	return sh, nil
+}
+
+// Armored shares among the PEM blocks of a key bundle
+func BundleShares(bundle []byte) ([]*Share, error) {
+	var shares []*Share
+	for {
+		i := bytes.Index(bundle, []byte(shareBegin))
+		if i < 0 {
+			return shares, nil
+		}
+		bundle = bundle[i:]
+		end := bytes.Index(bundle, []byte(shareEnd))
+		if end < 0 {
+			return nil, errors.New("share not complete")
+		}
+		end += len(shareEnd)
+
+		sh, err := ParseShare(bundle[:end])
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, sh)
+		bundle = bundle[end:]
+	}
+}
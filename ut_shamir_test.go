@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/bits"
+	"strings"
+	"testing"
+)
+
+// Subsets of shares picked by the bits of a mask with k bits set
+func shareSubsets(shares []*Share, k int) [][]*Share {
+	var subsets [][]*Share
+	for mask := 0; mask < 1<<len(shares); mask++ {
+		if bits.OnesCount(uint(mask)) != k {
+			continue
+		}
+		var sub []*Share
+		for i, sh := range shares {
+			if mask&(1<<i) != 0 {
+				sub = append(sub, sh)
+			}
+		}
+		subsets = append(subsets, sub)
+	}
+	return subsets
+}
+
+func TestShamirSplitCombine(t *testing.T) {
+	tests := []struct{ n, m, size int }{
+		{2, 2, 1},
+		{3, 2, 32},
+		{5, 3, 104},
+		{5, 5, 20},
+		{6, 4, 45},
+	}
+	for _, tt := range tests {
+		secret := make([]byte, tt.size)
+		rand.Read(secret)
+		shares, err := ShamirSplit(secret, tt.n, tt.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range shareSubsets(shares, tt.m) {
+			got, err := ShamirCombine(sub)
+			if err != nil || !bytes.Equal(got, secret) {
+				t.Errorf("%d of %d: %v", tt.m, tt.n, err)
+			}
+		}
+
+		for _, sub := range shareSubsets(shares, tt.m-1) {
+			if _, err := ShamirCombine(sub); err == nil || !strings.Contains(err.Error(), "shares needed") {
+				t.Errorf("%d of %d, one short: %v", tt.m, tt.n, err)
+			}
+			// interpolated anyway, they give some other secret
+			var lied []*Share
+			for _, sh := range sub {
+				c := *sh
+				c.Threshold = tt.m - 1
+				lied = append(lied, &c)
+			}
+			if tt.m > 2 {
+				if _, err := ShamirCombine(lied); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+					t.Errorf("%d of %d, one short: %v", tt.m, tt.n, err)
+				}
+			}
+		}
+	}
+}
+
+func TestShamirCombineRejects(t *testing.T) {
+	secret := []byte("a secret of some bytes")
+	a, _ := ShamirSplit(secret, 3, 2)
+	b, _ := ShamirSplit(secret, 3, 2) // same set, other polynomials
+	c, _ := ShamirSplit([]byte("another secret"), 3, 2)
+
+	tests := []struct {
+		shares []*Share
+		want   string
+	}{
+		{nil, "no shares"},
+		{[]*Share{a[0], c[1]}, "different sets"},
+		{[]*Share{a[0], a[0]}, "share 1 given twice"},
+		{[]*Share{a[0], b[1]}, "checksum mismatch"},
+	}
+	for i, tt := range tests {
+		if _, err := ShamirCombine(tt.shares); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%d: %v, want %s", i, err, tt.want)
+		}
+	}
+
+	for _, nm := range [][2]int{{3, 1}, {2, 3}, {256, 2}} {
+		if _, err := ShamirSplit(secret, nm[0], nm[1]); err == nil {
+			t.Errorf("split %d of %d", nm[1], nm[0])
+		}
+	}
+	if _, err := ShamirSplit(nil, 3, 2); err == nil {
+		t.Error("split an empty secret")
+	}
+}
+
+func TestParseShare(t *testing.T) {
+	secret := make([]byte, 2*shareLineSize+7) // three data lines
+	rand.Read(secret)
+	shares, err := ShamirSplit(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armor := string(shares[1].Armor())
+	lines := strings.Split(strings.TrimSuffix(armor, "\n"), "\n")
+	join := func(l []string) string { return strings.Join(l, "\n") + "\n" }
+	// armor with line i replaced by s
+	with := func(i int, s string) string {
+		l := append([]string(nil), lines...)
+		l[i] = s
+		return join(l)
+	}
+	// a data line with its last data character changed, the line checksum
+	// fixed up or not
+	typo := func(fix bool) string {
+		f := strings.Fields(lines[3])
+		d := []byte(f[1])
+		d[len(d)-1] = 'A' + ('B'-d[len(d)-1])&1
+		line := f[0] + " " + string(d)
+		sum := f[2]
+		if fix {
+			sum = shareLineSum(line)
+		}
+		return with(3, line+" "+sum)
+	}
+
+	tests := []struct {
+		name, text string
+		want       string // error, "" for shares[1]
+	}{
+		{"as armored", armor, ""},
+		{"lower case", strings.ToLower(armor), ""},
+		{"extra spaces", strings.ReplaceAll(armor, " ", "   "), ""},
+		{"blank lines", strings.ReplaceAll(armor, "\n", "\n\n"), ""},
+		{"indented", "   " + strings.ReplaceAll(armor, "\n", "\n\t "), ""},
+		{"text around", "my share:\n" + armor + "thanks\n", ""},
+		{"crlf", strings.ReplaceAll(armor, "\n", "\r\n"), ""},
+		{"typo", typo(false), "line 4: checksum mismatch"},
+		{"typo with its checksum", typo(true), "share checksum mismatch"},
+		{"bad CHECK", with(len(lines)-2, "CHECK 00000000"), "share checksum mismatch"},
+		{"other index", with(1, "SHARE 3 OF 3 THRESHOLD 2"), "share checksum mismatch"},
+		{"other set", with(2, "SET 0011223344556677"), "share checksum mismatch"},
+		{"lines swapped", join(append(append(lines[:3:3], lines[4], lines[3]), lines[5:]...)), "lines out of order"},
+		{"line missing", join(append(lines[:4:4], lines[5:]...)), "lines out of order"},
+		{"line twice", join(append(append(lines[:4:4], lines[3]), lines[4:]...)), "lines out of order"},
+		{"short SET", with(2, "SET 0011"), "invalid SET"},
+		{"no END", join(lines[:len(lines)-1]), "no complete share"},
+		{"no SHARE", join(append(lines[:1:1], lines[2:]...)), "header incomplete"},
+	}
+	for _, tt := range tests {
+		sh, err := ParseShare([]byte(tt.text))
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if sh.Index != 2 || sh.Total != 3 || sh.Threshold != 2 || !bytes.Equal(sh.Set, shares[1].Set) || !bytes.Equal(sh.Data, shares[1].Data) {
+				t.Errorf("%s: share differs", tt.name)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %s", tt.name, err, tt.want)
+		}
+	}
+
+	// parsed shares of different sets don't combine
+	other, _ := ShamirSplit([]byte("another secret"), 3, 2)
+	s1, err1 := ParseShare(shares[0].Armor())
+	s2, err2 := ParseShare(other[1].Armor())
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if _, err = ShamirCombine([]*Share{s1, s2}); err == nil || !strings.Contains(err.Error(), "different sets") {
+		t.Errorf("different sets: %v", err)
+	}
+	s2, _ = ParseShare([]byte(armor))
+	if got, err := ShamirCombine([]*Share{s2, s1}); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("parsed shares: %v", err)
+	}
+}
+
+func TestBundleShares(t *testing.T) {
+	shares, _ := ShamirSplit([]byte("a secret"), 3, 2)
+	bundle := append([]byte("-----BEGIN PUBLIC KEY-----\nxx\n-----END PUBLIC KEY-----\n"), shares[0].Armor()...)
+	bundle = append(bundle, shares[2].Armor()...)
+	got, err := BundleShares(bundle)
+	if err != nil || len(got) != 2 || got[0].Index != 1 || got[1].Index != 3 {
+		t.Errorf("%d shares, %v", len(got), err)
+	}
+
+	cut := shares[0].Armor()
+	if _, err = BundleShares(cut[:len(cut)-10]); err == nil {
+		t.Error("incomplete share taken")
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+)
+
+// SSH wire format, RFC 4251: a string is a uint32 length and its bytes
+
+func sshString(b []byte) []byte {
+	out := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(out, uint32(len(b)))
+	return append(out, b...)
+}
+
+func sshMpint(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return sshString(b)
+}
+
+// Reads SSH wire fields, the first error sticks
+type sshReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sshReader) string() []byte {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = errors.New("ssh data truncated")
+		return nil
+	}
+	n := binary.BigEndian.Uint32(r.b)
+	if uint32(len(r.b)-4) < n {
+		r.err = errors.New("ssh data truncated")
+		return nil
+	}
+	s := r.b[4 : 4+n]
+	r.b = r.b[4+n:]
+	return s
+}
+
+func (r *sshReader) uint32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = errors.New("ssh data truncated")
+		return 0
+	}
+	n := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return n
+}
+
+// SSH public key blob of pub, rsa, ed25519 or ecdsa on P-256
+func SshPublicKeyBlob(pub crypto.PublicKey) ([]byte, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		b := sshString([]byte("ssh-rsa"))
+		b = append(b, sshMpint(big.NewInt(int64(k.E)))...)
+		return append(b, sshMpint(k.N)...), nil
+	case ed25519.PublicKey:
+		return append(sshString([]byte("ssh-ed25519")), sshString(k)...), nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			break
+		}
+		point, err := k.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		b := sshString([]byte("ecdsa-sha2-nistp256"))
+		b = append(b, sshString([]byte("nistp256"))...)
+		return append(b, sshString(point)...), nil
+	}
+	return nil, errors.New(KeyType(pub) + " key has no ssh form")
+}
+
+// Public key of an SSH public key blob
+func ParseSshPublicKey(blob []byte) (crypto.PublicKey, error) {
+	r := &sshReader{b: blob}
+	switch string(r.string()) {
+	case "ssh-rsa":
+		e := new(big.Int).SetBytes(r.string())
+		n := new(big.Int).SetBytes(r.string())
+		if r.err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid ssh-rsa key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "ssh-ed25519":
+		k := r.string()
+		if r.err != nil || len(k) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ssh-ed25519 key")
+		}
+		return ed25519.PublicKey(k), nil
+	case "ecdsa-sha2-nistp256":
+		r.string()
+		point := r.string()
+		if r.err != nil {
+			return nil, errors.New("invalid ecdsa key")
+		}
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return nil, errors.New("unsupported ssh key type")
+}
+
+// Parse an authorized_keys style line, "type base64 comment"
+func ParseSshAuthorizedKey(line []byte) ([]byte, string, error) {
+	f := strings.Fields(string(line))
+	if len(f) < 2 {
+		return nil, "", errors.New("not an ssh public key")
+	}
+	blob, err := base64.StdEncoding.DecodeString(f[1])
+	if err != nil {
+		return nil, "", errors.New("not an ssh public key")
+	}
+	if typ := (&sshReader{b: blob}).string(); string(typ) != f[0] {
+		return nil, "", errors.New("ssh key type mismatch")
+	}
+	return blob, strings.Join(f[2:], " "), nil
+}
+
+// Private key of an unencrypted "OPENSSH PRIVATE KEY" block, as ssh-keygen
+// writes them: rsa, ed25519 or ecdsa on P-256
+func ParseOpenSshPrivateKey(der []byte) (crypto.PrivateKey, error) {
+	const magic = "openssh-key-v1\x00"
+	if !strings.HasPrefix(string(der), magic) {
+		return nil, errors.New("invalid openssh private key")
+	}
+	r := &sshReader{b: der[len(magic):]}
+	cipherName, _, _ := string(r.string()), r.string(), r.string()
+	nkeys := r.uint32()
+	r.string()
+	priv := &sshReader{b: r.string()}
+	if r.err != nil {
+		return nil, errors.New("invalid openssh private key")
+	}
+	if cipherName != "none" {
+		return nil, errors.New("openssh private key has a passphrase, remove it with ssh-keygen -p or convert the key")
+	}
+	if nkeys != 1 || priv.uint32() != priv.uint32() {
+		return nil, errors.New("invalid openssh private key")
+	}
+
+	mpint := func() *big.Int { return new(big.Int).SetBytes(priv.string()) }
+	var key crypto.PrivateKey
+	switch string(priv.string()) {
+	case "ssh-ed25519":
+		priv.string()
+		k := priv.string()
+		if priv.err != nil || len(k) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid ssh-ed25519 private key")
+		}
+		key = ed25519.PrivateKey(append([]byte(nil), k...))
+	case "ssh-rsa":
+		n, e, d := mpint(), mpint(), mpint()
+		mpint()
+		p, q := mpint(), mpint()
+		if priv.err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid ssh-rsa private key")
+		}
+		k := &rsa.PrivateKey{PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())}, D: d, Primes: []*big.Int{p, q}}
+		if err := k.Validate(); err != nil {
+			return nil, err
+		}
+		k.Precompute()
+		key = k
+	case "ecdsa-sha2-nistp256":
+		priv.string()
+		priv.string()
+		d := mpint()
+		if priv.err != nil || d.BitLen() > 256 {
+			return nil, errors.New("invalid ecdsa private key")
+		}
+		k, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), d.FillBytes(make([]byte, 32)))
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	default:
+		return nil, errors.New("unsupported openssh private key type")
+	}
+	if priv.err != nil {
+		return nil, errors.New("invalid openssh private key")
+	}
+	return key, nil
+}
+
+// Fingerprint of an SSH key blob as ssh-keygen -l and ssh-add -l show it
+func SshFingerprint(blob []byte) string {
+	return FingerprintSSH(sha256.Sum256(blob))
+}
+
+// Client of the ssh-agent at SSH_AUTH_SOCK, a connection per request
+type SshAgent struct {
+	Socket string
+}
+
+// A key the agent holds
+type SshAgentKey struct {
+	Blob    []byte
+	Comment string
+}
+
+func (k *SshAgentKey) Type() string {
+	return string((&sshReader{b: k.Blob}).string())
+}
+
+const (
+	sshAgentRequestIdentities = 11
+	sshAgentIdentitiesAnswer  = 12
+	sshAgentSignRequest       = 13
+	sshAgentSignResponse      = 14
+
+	sshAgentRsaSha512 = 4 // sign flag, rsa-sha2-512 instead of ssh-rsa
+)
+
+func NewSshAgent() (*SshAgent, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK isn't set, no ssh-agent to ask")
+	}
+	return &SshAgent{Socket: sock}, nil
+}
+
+func (a *SshAgent) call(req []byte) (byte, []byte, error) {
+	conn, err := net.Dial("unix", a.Socket)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(sshString(req)); err != nil {
+		return 0, nil, err
+	}
+	var n uint32
+	if err = binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return 0, nil, err
+	}
+	if n == 0 || n > 256*1024 {
+		return 0, nil, errors.New("ssh-agent answer invalid")
+	}
+	resp := make([]byte, n)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return 0, nil, err
+	}
+	return resp[0], resp[1:], nil
+}
+
+// Keys the agent holds
+func (a *SshAgent) List() ([]*SshAgentKey, error) {
+	typ, resp, err := a.call([]byte{sshAgentRequestIdentities})
+	if err != nil {
+		return nil, err
+	}
+	if typ != sshAgentIdentitiesAnswer {
+		return nil, errors.New("ssh-agent refused to list keys")
+	}
+
+	r := &sshReader{b: resp}
+	n := r.uint32()
+	var keys []*SshAgentKey
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		keys = append(keys, &SshAgentKey{Blob: r.string(), Comment: string(r.string())})
+	}
+	return keys, r.err
+}
+
+// Signature blob of data by key, rsa keys sign with rsa-sha2-512
+func (a *SshAgent) Sign(key *SshAgentKey, data []byte) ([]byte, error) {
+	var flags uint32
+	if key.Type() == "ssh-rsa" {
+		flags = sshAgentRsaSha512
+	}
+	req := append([]byte{sshAgentSignRequest}, sshString(key.Blob)...)
+	req = append(req, sshString(data)...)
+	req = binary.BigEndian.AppendUint32(req, flags)
+
+	typ, resp, err := a.call(req)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sshAgentSignResponse {
+		return nil, errors.New("ssh-agent refused to sign with " + SshFingerprint(key.Blob))
+	}
+	r := &sshReader{b: resp}
+	sig := r.string()
+	return sig, r.err
+}
+
+// Key of the agent by fingerprint (prefix), comment or, for "", the only or
+// first one
+func (a *SshAgent) Find(sel string) (*SshAgentKey, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("ssh-agent holds no keys, add one with ssh-add")
+	}
+	if sel == "" {
+		return keys[0], nil
+	}
+	for _, k := range keys {
+		if k.Comment == sel || strings.HasPrefix(SshFingerprint(k.Blob), sel) {
+			return k, nil
+		}
+	}
+	return nil, errors.New("ssh-agent holds no key " + sel)
+}
+
+// Data key wrapping with a key held by ssh-agent. The agent can only sign,
+// so the wrap key is derived from the signature of a random challenge,
+// which needs deterministic signatures: ed25519 and rsa keys only.
+// Wrapped is challenge, GCM nonce and ciphertext
+type sshAgentWrapper struct {
+	agent *SshAgent
+	key   *SshAgentKey
+}
+
+const (
+	SshAgentPrefix     = "ssh-agent:" // recipient names of agent keys, ssh-agent:[fingerprint or comment]
+	sshAgentPemType    = "SSH AGENT KEY"
+	sshAgentWrapDomain = "bitcrypt ssh-agent wrap v1"
+)
+
+// PEM block naming an agent key, to go in a recipient bundle
+func SshAgentPEM(sel string) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: sshAgentPemType, Headers: map[string]string{"Key": strings.TrimPrefix(sel, SshAgentPrefix)}})
+}
+
+func NewSshAgentWrapper(sel string) (KeyWrapper, error) {
+	agent, err := NewSshAgent()
+	if err != nil {
+		return nil, err
+	}
+	key, err := agent.Find(strings.TrimPrefix(sel, SshAgentPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if t := key.Type(); t != "ssh-ed25519" && t != "ssh-rsa" {
+		return nil, errors.New(t + " signatures aren't deterministic, use an ed25519 or rsa key of the agent")
+	}
+	return &sshAgentWrapper{agent: agent, key: key}, nil
+}
+
+func (w *sshAgentWrapper) Type() uint32 { return WrapSshAgent }
+
+func (w *sshAgentWrapper) Fingerprint() [32]byte {
+	return sha256.Sum256(w.key.Blob)
+}
+
+// AES-256-GCM of the key derived from the signature of challenge
+func (w *sshAgentWrapper) aead(challenge []byte) (cipher.AEAD, error) {
+	sig, err := w.agent.Sign(w.key, append([]byte(sshAgentWrapDomain+"\x00"), challenge...))
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, sig, challenge, sshAgentWrapDomain, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (w *sshAgentWrapper) Wrap(data []byte) ([]byte, error) {
+	challenge := make([]byte, 32+12)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	aead, err := w.aead(challenge[:32])
+	if err != nil {
+		return nil, err
+	}
+	// a key whose signatures vary could never unwrap again
+	again, err := w.aead(challenge[:32])
+	if err != nil {
+		return nil, err
+	}
+	wrapped := aead.Seal(challenge, challenge[32:], data, nil)
+	if _, err = again.Open(nil, challenge[32:], wrapped[len(challenge):], nil); err != nil {
+		return nil, errors.New("ssh-agent signatures of " + SshFingerprint(w.key.Blob) + " aren't deterministic")
+	}
+	return wrapped, nil
+}
+
+func (w *sshAgentWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 32+12 {
+		return nil, errors.New("ssh-agent wrapped key truncated")
+	}
+	aead, err := w.aead(wrapped[:32])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, wrapped[32:44], wrapped[44:], nil)
+}
+
+// Wrapper for the agent key with fingerprint fprt, nil unless the agent
+// holds it
+func sshAgentWrapperFor(fprt [32]byte) KeyWrapper {
+	agent, err := NewSshAgent()
+	if err != nil {
+		return nil
+	}
+	keys, err := agent.List()
+	if err != nil {
+		return nil
+	}
+	for _, k := range keys {
+		if sha256.Sum256(k.Blob) == fprt {
+			return &sshAgentWrapper{agent: agent, key: k}
+		}
+	}
+	return nil
+}
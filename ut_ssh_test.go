@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+// An unencrypted openssh-key-v1 blob holding the ecdsa key with the private
+// scalar d as given
+func opensshEcdsaBlob(t *testing.T, k *ecdsa.PrivateKey, d []byte) []byte {
+	t.Helper()
+	pubBlob, err := SshPublicKeyBlob(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point, err := k.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv := []byte{1, 2, 3, 4, 1, 2, 3, 4}
+	priv = append(priv, sshString([]byte("ecdsa-sha2-nistp256"))...)
+	priv = append(priv, sshString([]byte("nistp256"))...)
+	priv = append(priv, sshString(point)...)
+	priv = append(priv, sshString(d)...)
+	priv = append(priv, sshString([]byte("comment"))...)
+
+	blob := []byte("openssh-key-v1\x00")
+	for _, s := range []string{"none", "none", ""} {
+		blob = append(blob, sshString([]byte(s))...)
+	}
+	blob = binary.BigEndian.AppendUint32(blob, 1)
+	blob = append(blob, sshString(pubBlob)...)
+	return append(blob, sshString(priv)...)
+}
+
+func TestParseOpenSshEcdsa(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an mpint with a leading zero byte is fine
+	got, err := ParseOpenSshPrivateKey(opensshEcdsaBlob(t, k, append([]byte{0}, d...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gk, ok := got.(*ecdsa.PrivateKey); !ok || !gk.Equal(k) {
+		t.Error("parsed ecdsa key differs")
+	}
+
+	// a scalar beyond 32 bytes is refused, not a panic
+	long := append(bytes.Repeat([]byte{0xff}, 8), d...)
+	if _, err = ParseOpenSshPrivateKey(opensshEcdsaBlob(t, k, long)); err == nil {
+		t.Error("ecdsa scalar of 40 bytes parsed")
+	}
+}
@@ -0,0 +1,186 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An ssh-agent on a unix socket that lists and signs with keys, as
+// SSH_AUTH_SOCK for the test
+func newTestSshAgent(t *testing.T, keys ...crypto.PrivateKey) map[string]SshSigner {
+	// unix socket paths are short, t.TempDir() may be too long
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	signers := map[string]SshSigner{}
+	var blobs [][]byte
+	for _, k := range keys {
+		s, err := NewLocalSshSigner(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[string(s.PublicBlob())] = s
+		blobs = append(blobs, s.PublicBlob())
+	}
+
+	answer := func(req []byte) []byte {
+		r := &sshReader{b: req[1:]}
+		switch req[0] {
+		case sshAgentRequestIdentities:
+			resp := binary.BigEndian.AppendUint32([]byte{sshAgentIdentitiesAnswer}, uint32(len(blobs)))
+			for i, blob := range blobs {
+				resp = append(resp, sshString(blob)...)
+				resp = append(resp, sshString([]byte("key"+string(rune('0'+i))))...)
+			}
+			return resp
+		case sshAgentSignRequest:
+			blob, data := r.string(), r.string()
+			if s := signers[string(blob)]; s != nil && r.err == nil {
+				if sig, err := s.SignSsh(data); err == nil {
+					return append([]byte{sshAgentSignResponse}, sshString(sig)...)
+				}
+			}
+		}
+		return []byte{5} // SSH_AGENT_FAILURE
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var n uint32
+			if binary.Read(conn, binary.BigEndian, &n) == nil && n > 0 && n < 1<<20 {
+				req := make([]byte, n)
+				if _, err = io.ReadFull(conn, req); err == nil {
+					conn.Write(sshString(answer(req)))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return signers
+}
+
+func TestSshAgentWrapper(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newTestSshAgent(t, edKey, rsaKey, ecKey)
+
+	agent, err := NewSshAgent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := agent.List()
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("list: %d keys, %v", len(keys), err)
+	}
+
+	data := make([]byte, 64)
+	rand.Read(data)
+	for _, k := range keys[:2] {
+		w, err := NewSshAgentWrapper(SshAgentPrefix + SshFingerprint(k.Blob))
+		if err != nil {
+			t.Fatalf("%s: %v", k.Type(), err)
+		}
+		wrapped, err := w.Wrap(data)
+		if err != nil {
+			t.Fatalf("%s wrap: %v", k.Type(), err)
+		}
+		got, err := w.Unwrap(wrapped)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s unwrap: %v", k.Type(), err)
+		}
+
+		// found again by the fingerprint of a header entry
+		again := sshAgentWrapperFor(sha256.Sum256(k.Blob))
+		if again == nil {
+			t.Fatalf("%s: no wrapper for the fingerprint", k.Type())
+		}
+		if got, err = again.Unwrap(wrapped); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s unwrap by fingerprint: %v", k.Type(), err)
+		}
+		wrapped[len(wrapped)-1] ^= 1
+		if _, err = w.Unwrap(wrapped); err == nil {
+			t.Errorf("%s: tampered entry unwrapped", k.Type())
+		}
+	}
+
+	if _, err = NewSshAgentWrapper("key2"); err == nil || !strings.Contains(err.Error(), "deterministic") {
+		t.Errorf("ecdsa key: %v", err)
+	}
+	if _, err = NewSshAgentWrapper("missing"); err == nil {
+		t.Error("wrapper for a key the agent doesn't hold")
+	}
+	if sshAgentWrapperFor([32]byte{1}) != nil {
+		t.Error("wrapper for an unknown fingerprint")
+	}
+}
+
+func TestSignFileSshAgent(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestSshAgent(t, edKey, rsaKey)
+
+	path := filepath.Join(t.TempDir(), "file")
+	if err = os.WriteFile(path, []byte(strings.Repeat("signed ", 1000)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, sel := range []string{"key0", "key1"} {
+		signer, err := NewAgentSshSigner(sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := SignFileSsh(path, signer, "file")
+		if err != nil {
+			t.Fatalf("%s: %v", sel, err)
+		}
+		blob, err := VerifyFileSsh(path, sig, "file")
+		if err != nil || !bytes.Equal(blob, signer.PublicBlob()) {
+			t.Errorf("%s verify: %v", sel, err)
+		}
+		if _, err = VerifyFileSsh(path, sig, "git"); err == nil || !strings.Contains(err.Error(), "namespace") {
+			t.Errorf("%s: other namespace: %v", sel, err)
+		}
+
+		tampered := path + ".tampered"
+		data, _ := os.ReadFile(path)
+		data[10] ^= 1
+		os.WriteFile(tampered, data, 0600)
+		if _, err = VerifyFileSsh(tampered, sig, "file"); err == nil {
+			t.Errorf("%s: tampered file verified", sel)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// Signatures in the OpenSSH SSHSIG format, so ssh-keygen -Y verify can
+// check them too
+
+const (
+	sshSigMagic = "SSHSIG"
+	sshSigBegin = "-----BEGIN SSH SIGNATURE-----"
+	sshSigEnd   = "-----END SSH SIGNATURE-----"
+)
+
+// Makes SSH signature blobs, with a key of its own or one held by ssh-agent
+type SshSigner interface {
+	PublicBlob() []byte
+	SignSsh(data []byte) ([]byte, error)
+}
+
+type localSshSigner struct {
+	priv crypto.PrivateKey
+	blob []byte
+}
+
+// Signer for a local rsa, ed25519 or ecdsa P-256 private key
+func NewLocalSshSigner(priv crypto.PrivateKey) (SshSigner, error) {
+	blob, err := SshPublicKeyBlob(PublicOf(priv))
+	if err != nil {
+		return nil, err
+	}
+	return &localSshSigner{priv: priv, blob: blob}, nil
+}
+
+func (s *localSshSigner) PublicBlob() []byte {
+	return s.blob
+}
+
+func (s *localSshSigner) SignSsh(data []byte) ([]byte, error) {
+	switch k := s.priv.(type) {
+	case ed25519.PrivateKey:
+		return append(sshString([]byte("ssh-ed25519")), sshString(ed25519.Sign(k, data))...), nil
+	case *rsa.PrivateKey:
+		sum := sha512.Sum512(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA512, sum[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(sshString([]byte("rsa-sha2-512")), sshString(sig)...), nil
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256(data)
+		r, ss, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(sshString([]byte("ecdsa-sha2-nistp256")), sshString(append(sshMpint(r), sshMpint(ss)...))...), nil
+	}
+	return nil, errors.New("key can't sign")
+}
+
+type agentSshSigner struct {
+	agent *SshAgent
+	key   *SshAgentKey
+}
+
+// Signer for the ssh-agent key sel, see SshAgent.Find
+func NewAgentSshSigner(sel string) (SshSigner, error) {
+	agent, err := NewSshAgent()
+	if err != nil {
+		return nil, err
+	}
+	key, err := agent.Find(sel)
+	if err != nil {
+		return nil, err
+	}
+	return &agentSshSigner{agent: agent, key: key}, nil
+}
+
+func (s *agentSshSigner) PublicBlob() []byte {
+	return s.key.Blob
+}
+
+func (s *agentSshSigner) SignSsh(data []byte) ([]byte, error) {
+	return s.agent.Sign(s.key, data)
+}
+
+// Check an SSH signature blob of data by the key in pubBlob
+func verifySshSignature(pubBlob, data, sigBlob []byte) error {
+	pub, err := ParseSshPublicKey(pubBlob)
+	if err != nil {
+		return err
+	}
+	r := &sshReader{b: sigBlob}
+	algo, sig := string(r.string()), r.string()
+	if r.err != nil {
+		return errors.New("signature truncated")
+	}
+
+	ok := false
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		ok = algo == "ssh-ed25519" && ed25519.Verify(k, data, sig)
+	case *rsa.PublicKey:
+		switch algo {
+		case "rsa-sha2-512":
+			sum := sha512.Sum512(data)
+			ok = rsa.VerifyPKCS1v15(k, crypto.SHA512, sum[:], sig) == nil
+		case "rsa-sha2-256":
+			sum := sha256.Sum256(data)
+			ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+		}
+	case *ecdsa.PublicKey:
+		rs := &sshReader{b: sig}
+		er, es := new(big.Int).SetBytes(rs.string()), new(big.Int).SetBytes(rs.string())
+		sum := sha256.Sum256(data)
+		ok = algo == "ecdsa-sha2-nistp256" && rs.err == nil && ecdsa.Verify(k, sum[:], er, es)
+	}
+	if !ok {
+		return errors.New("signature check failed")
+	}
+	return nil
+}
+
+// What SSHSIG signs: the namespace and the hash of the message
+func sshSigSignedData(namespace, hashAlg string, msgHash []byte) []byte {
+	b := []byte(sshSigMagic)
+	b = append(b, sshString([]byte(namespace))...)
+	b = append(b, sshString(nil)...)
+	b = append(b, sshString([]byte(hashAlg))...)
+	return append(b, sshString(msgHash)...)
+}
+
+// Hash of inPath with hashAlg, sha512 or sha256
+func hashFileSsh(inPath, hashAlg string) ([]byte, error) {
+	var h hash.Hash
+	switch hashAlg {
+	case "sha512":
+		h = sha512.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, errors.New("unsupported signature hash " + hashAlg)
+	}
+
+	f, err := os.Open(inPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Armored SSHSIG signature of inPath in namespace, "file" as ssh-keygen
+// uses by default
+func SignFileSsh(inPath string, signer SshSigner, namespace string) ([]byte, error) {
+	sum, err := hashFileSsh(inPath, "sha512")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.SignSsh(sshSigSignedData(namespace, "sha512", sum))
+	if err != nil {
+		return nil, err
+	}
+
+	blob := []byte(sshSigMagic)
+	blob = append(blob, 0, 0, 0, 1)
+	blob = append(blob, sshString(signer.PublicBlob())...)
+	blob = append(blob, sshString([]byte(namespace))...)
+	blob = append(blob, sshString(nil)...)
+	blob = append(blob, sshString([]byte("sha512"))...)
+	blob = append(blob, sshString(sig)...)
+
+	enc := base64.StdEncoding.EncodeToString(blob)
+	buf := new(bytes.Buffer)
+	buf.WriteString(sshSigBegin + "\n")
+	for len(enc) > 70 {
+		buf.WriteString(enc[:70] + "\n")
+		enc = enc[70:]
+	}
+	buf.WriteString(enc + "\n" + sshSigEnd + "\n")
+	return buf.Bytes(), nil
+}
+
+// Check the armored SSHSIG signature of inPath, giving the key blob of the
+// signer; who that is remains for the caller to judge
+func VerifyFileSsh(inPath string, armored []byte, namespace string) ([]byte, error) {
+	text := strings.TrimSpace(string(armored))
+	if !strings.HasPrefix(text, sshSigBegin) || !strings.HasSuffix(text, sshSigEnd) {
+		return nil, errors.New("not an ssh signature")
+	}
+	text = strings.Join(strings.Fields(text[len(sshSigBegin):len(text)-len(sshSigEnd)]), "")
+	blob, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || !bytes.HasPrefix(blob, []byte(sshSigMagic)) {
+		return nil, errors.New("not an ssh signature")
+	}
+
+	r := &sshReader{b: blob[len(sshSigMagic):]}
+	version := r.uint32()
+	pubBlob := r.string()
+	ns := string(r.string())
+	r.string()
+	hashAlg := string(r.string())
+	sig := r.string()
+	if r.err != nil || version != 1 {
+		return nil, errors.New("ssh signature invalid")
+	}
+	if ns != namespace {
+		return nil, errors.New("signature is for namespace " + ns + ", not " + namespace)
+	}
+
+	sum, err := hashFileSsh(inPath, hashAlg)
+	if err != nil {
+		return nil, err
+	}
+	data := sshSigSignedData(namespace, hashAlg, sum)
+	if err = verifySshSignature(pubBlob, data, sig); err != nil {
+		return nil, err
+	}
+	return pubBlob, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	VaultPrefix  = "vault:" // recipient names of Vault transit keys, vault:[mount/]key
+	vaultPemType = "VAULT TRANSIT KEY"
+)
+
+// Key of a HashiCorp Vault transit engine; the data key is sent to the
+// service to wrap and unwrap it, and the header records mount/key before
+// the returned ciphertext so any client of the same Vault can unwrap it
+type VaultTransit struct {
+	Addr      string // VAULT_ADDR
+	Token     string // VAULT_TOKEN or ~/.vault-token
+	Namespace string // VAULT_NAMESPACE
+	Mount     string // "transit" by default
+	Key       string
+	Client    *http.Client
+}
+
+// Transit key of ref, mount/key or key alone, with the server and token
+// from the environment as the vault command takes them
+func NewVaultTransit(ref string) (*VaultTransit, error) {
+	ref = strings.TrimPrefix(ref, VaultPrefix)
+	mount, key := "transit", ref
+	if i := strings.LastIndex(ref, "/"); i >= 0 {
+		mount, key = ref[:i], ref[i+1:]
+	}
+	if !vaultPathOk(mount) || !vaultPathOk(key) {
+		return nil, errors.New("invalid vault key " + ref + ", want vault:[mount/]key")
+	}
+
+	v := &VaultTransit{
+		Addr:      strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Mount:     mount,
+		Key:       key,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if v.Token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			data, _ := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+			v.Token = strings.TrimSpace(string(data))
+		}
+	}
+	return v, nil
+}
+
+// Whether s can go in a request path: letters, digits and "_.-/", with no
+// empty, "." or ".." parts, as the ref of a file header isn't trusted
+func vaultPathOk(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_.-/", c)) {
+			return false
+		}
+	}
+	for _, part := range strings.Split(s, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *VaultTransit) Ref() string {
+	return v.Mount + "/" + v.Key
+}
+
+// PEM block naming the key, to go in a recipient bundle
+func (v *VaultTransit) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: vaultPemType, Headers: map[string]string{"Key": v.Ref()}})
+}
+
+func ParseVaultPem(block *pem.Block) (*VaultTransit, error) {
+	return NewVaultTransit(block.Headers["Key"])
+}
+
+func (v *VaultTransit) Type() uint32 { return WrapVault }
+
+func (v *VaultTransit) Fingerprint() [32]byte {
+	return sha256.Sum256([]byte("vault transit " + v.Ref()))
+}
+
+func (v *VaultTransit) Wrap(data []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(data)}
+	if err := v.call("encrypt", req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, errors.New("vault encrypt returned no ciphertext")
+	}
+	return []byte(v.Ref() + "\n" + resp.Data.Ciphertext), nil
+}
+
+func (v *VaultTransit) Unwrap(wrapped []byte) ([]byte, error) {
+	ref, ciphertext, ok := strings.Cut(string(wrapped), "\n")
+	if !ok || ref != v.Ref() {
+		return nil, errors.New("vault key mismatch")
+	}
+
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.call("decrypt", map[string]string{"ciphertext": ciphertext}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+// POST req to the encrypt or decrypt endpoint of the key
+func (v *VaultTransit) call(op string, req interface{}, resp interface{}) error {
+	if v.Addr == "" {
+		return errors.New("VAULT_ADDR isn't set for vault key " + v.Ref())
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequest("POST", v.Addr+"/v1/"+v.Mount+"/"+op+"/"+v.Key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if v.Token != "" {
+		hreq.Header.Set("X-Vault-Token", v.Token)
+	}
+	if v.Namespace != "" {
+		hreq.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+
+	hresp, err := v.Client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+	data, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return err
+	}
+
+	if hresp.StatusCode != http.StatusOK {
+		var verr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(data, &verr)
+		if len(verr.Errors) > 0 {
+			return fmt.Errorf("vault %s with %s: %s", op, v.Ref(), strings.Join(verr.Errors, "; "))
+		}
+		return fmt.Errorf("vault %s with %s: %s", op, v.Ref(), hresp.Status)
+	}
+	return json.Unmarshal(data, resp)
+}
+
+// Wrapper for the Vault key a header entry was wrapped with, nil unless
+// VAULT_ADDR is set and the key named in the entry has its fingerprint
+func vaultWrapperFor(rcp *Recipient) KeyWrapper {
+	ref, _, ok := strings.Cut(string(rcp.Wrapped), "\n")
+	if !ok || os.Getenv("VAULT_ADDR") == "" {
+		return nil
+	}
+	v, err := NewVaultTransit(ref)
+	if err != nil || v.Fingerprint() != rcp.Fprt {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testVaultToken = "s.test-token"
+
+// Transit engine at /v1/transit with the key "files", answering as Vault
+// does; ciphertexts name their key so that other keys can't decrypt them
+func newTestVault(t *testing.T) (*httptest.Server, *int32) {
+	var calls int32
+	fail := func(w http.ResponseWriter, code int, msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			fail(w, http.StatusForbidden, "permission denied")
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+		if r.Method != "POST" || len(parts) != 3 || parts[0] != "transit" {
+			fail(w, http.StatusNotFound, "no handler for route")
+			return
+		}
+		if parts[2] == "broken" {
+			http.Error(w, "upstream gone", http.StatusBadGateway)
+			return
+		}
+		if parts[2] != "files" {
+			fail(w, http.StatusBadRequest, "encryption key not found")
+			return
+		}
+
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fail(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+		prefix := "vault:v1:" + parts[2] + ":"
+		var data map[string]string
+		switch parts[1] {
+		case "encrypt":
+			data = map[string]string{"ciphertext": prefix + req["plaintext"]}
+		case "decrypt":
+			if !strings.HasPrefix(req["ciphertext"], prefix) {
+				fail(w, http.StatusBadRequest, "cipher: message authentication failed")
+				return
+			}
+			data = map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"], prefix)}
+		default:
+			fail(w, http.StatusNotFound, "no handler for route")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", testVaultToken)
+	t.Setenv("VAULT_NAMESPACE", "")
+	return srv, &calls
+}
+
+func TestVaultTransit(t *testing.T) {
+	newTestVault(t)
+
+	v, err := NewVaultTransit(VaultPrefix + "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Ref() != "transit/files" {
+		t.Errorf("ref %s", v.Ref())
+	}
+	data := make([]byte, 128)
+	rand.Read(data)
+	wrapped, err := v.Wrap(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(wrapped, []byte("transit/files\n")) {
+		t.Errorf("wrapped %q doesn't start with the key", wrapped)
+	}
+	got, err := v.Unwrap(wrapped)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("unwrap: %v", err)
+	}
+
+	// the recipient block of a file, unwrapped with no local keys
+	info := &AesInfo{Size: 32, Type: 1}
+	rand.Read(info.Aesk[:])
+	rand.Read(info.Fchk[:])
+	block, err := WrapAesInfo(v.PEM(), info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrf := &HdrInfo{Eflg: EncFlagV2, Fchk: info.Fchk}
+	back, err := UnwrapAesInfo(hdrf, block, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Aesk != info.Aesk {
+		t.Error("unwrapped data key differs")
+	}
+}
+
+func TestVaultTransitErrors(t *testing.T) {
+	newTestVault(t)
+
+	tests := []struct {
+		ref, token, want string
+	}{
+		{"transit/nokey", testVaultToken, "encryption key not found"},
+		{"transit/files", "s.wrong", "permission denied"},
+		{"other/files", testVaultToken, "no handler for route"},
+		{"transit/broken", testVaultToken, "502 Bad Gateway"},
+	}
+	for _, tt := range tests {
+		t.Setenv("VAULT_TOKEN", tt.token)
+		v, err := NewVaultTransit(tt.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = v.Wrap([]byte("data key")); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %s", tt.ref, err, tt.want)
+		}
+	}
+
+	t.Setenv("VAULT_TOKEN", testVaultToken)
+	v, _ := NewVaultTransit("transit/files")
+	wrapped := []byte("transit/files\nvault:v1:other:" + base64.StdEncoding.EncodeToString([]byte("x")))
+	if _, err := v.Unwrap(wrapped); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("decrypt of another key's ciphertext: %v", err)
+	}
+	if _, err := v.Unwrap([]byte("transit/other\nvault:v1:files:eA==")); err == nil {
+		t.Error("unwrap of another key's entry succeeded")
+	}
+}
+
+func TestVaultRefs(t *testing.T) {
+	for _, ref := range []string{"files", "transit/files", "team.a/transit_2/key-1"} {
+		if _, err := NewVaultTransit(VaultPrefix + ref); err != nil {
+			t.Errorf("%s: %v", ref, err)
+		}
+	}
+	for _, ref := range []string{
+		"", "transit/", "/files", "transit//files", "../sys/raw", "transit/..", "transit/../../sys/raw",
+		"./files", "transit/files?x=1", "transit/files#x", "transit/fi les", "transit/%2e%2e", "transit/files\n",
+	} {
+		if _, err := NewVaultTransit(ref); err == nil {
+			t.Errorf("%q accepted", ref)
+		}
+	}
+}
+
+// Header entries naming another key than their fingerprint, or a path out
+// of the transit API, never reach the server
+func TestVaultUntrustedHeader(t *testing.T) {
+	_, calls := newTestVault(t)
+
+	v, _ := NewVaultTransit("transit/files")
+	for _, wrapped := range []string{
+		"sys/raw\nvault:v1:files:eA==",
+		"../../sys/raw\nvault:v1:files:eA==",
+		"transit/other\nvault:v1:files:eA==",
+	} {
+		rcp := &Recipient{RecipientHdr: RecipientHdr{Type: WrapVault, Fprt: v.Fingerprint()}, Wrapped: []byte(wrapped)}
+		if w := vaultWrapperFor(rcp); w != nil {
+			t.Errorf("wrapper for %q", wrapped)
+		}
+		binInfo, _, _ := unwrapRecipients([]*Recipient{rcp}, nil)
+		if binInfo != nil {
+			t.Errorf("unwrapped %q", wrapped)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 0 {
+		t.Errorf("%d requests made to the server", n)
+	}
+}
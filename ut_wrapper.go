@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hpke"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+)
+
+// Wraps the data key of a file for one recipient of its header, and
+// unwraps it again where the recipient's secret is at hand
+type KeyWrapper interface {
+	Type() uint32          // RecipientHdr.Type, without WrapShare
+	Fingerprint() [32]byte // RecipientHdr.Fprt
+	Wrap(data []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+var errNoPrivateKey = errors.New("no private key to unwrap with")
+
+// Local RSA key, priv is nil to only wrap
+type rsaWrapper struct {
+	pub  *rsa.PublicKey
+	priv *rsa.PrivateKey
+}
+
+func (w *rsaWrapper) Type() uint32          { return WrapRsa }
+func (w *rsaWrapper) Fingerprint() [32]byte { return KeyFingerprint(w.pub) }
+
+func (w *rsaWrapper) Wrap(data []byte) ([]byte, error) {
+	return RsaEncryptKey(w.pub, data)
+}
+
+func (w *rsaWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if w.priv == nil {
+		return nil, errNoPrivateKey
+	}
+	return RsaDecryptKey(w.priv, wrapped)
+}
+
+// Local X25519 key by HPKE, priv is nil to only wrap
+type x25519Wrapper struct {
+	pub  *ecdh.PublicKey
+	priv *ecdh.PrivateKey
+}
+
+// HPKE info string of WrapX25519
+var x25519WrapInfo = []byte("bitcrypt aes info")
+
+func (w *x25519Wrapper) Type() uint32          { return WrapX25519 }
+func (w *x25519Wrapper) Fingerprint() [32]byte { return KeyFingerprint(w.pub) }
+
+func (w *x25519Wrapper) Wrap(data []byte) ([]byte, error) {
+	pk, err := hpke.NewDHKEMPublicKey(w.pub)
+	if err != nil {
+		return nil, err
+	}
+	return hpke.Seal(pk, hpke.HKDFSHA256(), hpke.AES256GCM(), x25519WrapInfo, data)
+}
+
+func (w *x25519Wrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if w.priv == nil {
+		return nil, errNoPrivateKey
+	}
+	k, err := hpke.NewDHKEMPrivateKey(w.priv)
+	if err != nil {
+		return nil, err
+	}
+	return hpke.Open(k, hpke.HKDFSHA256(), hpke.AES256GCM(), x25519WrapInfo, wrapped)
+}
+
+// Wrapper for a local public or private key
+func NewKeyWrapper(key interface{}) (KeyWrapper, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return &rsaWrapper{pub: k}, nil
+	case *rsa.PrivateKey:
+		return &rsaWrapper{pub: &k.PublicKey, priv: k}, nil
+	case *ecdh.PublicKey:
+		if KeyType(k) == "x25519" {
+			return &x25519Wrapper{pub: k}, nil
+		}
+	case *ecdh.PrivateKey:
+		if KeyType(k.PublicKey()) == "x25519" {
+			return &x25519Wrapper{pub: k.PublicKey(), priv: k}, nil
+		}
+	}
+	pub := PublicOf(key)
+	if pub == nil {
+		pub = key
+	}
+	return nil, errors.New(KeyType(pub) + " key can't encrypt, only rsa and x25519 keys can")
+}
+
+// Wrappers to encrypt for: the public keys, OpenPGP keys, Vault keys and
+// ssh-agent keys in bundle
+func RecipientWrappers(bundle []byte) ([]KeyWrapper, error) {
+	var list []KeyWrapper
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == vaultPemType || block.Type == sshAgentPemType {
+			var w KeyWrapper
+			var err error
+			if block.Type == vaultPemType {
+				w, err = ParseVaultPem(block)
+			} else {
+				w, err = NewSshAgentWrapper(block.Headers["Key"])
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, w)
+			continue
+		}
+
+		enc, ok := pemEncodings[block.Type]
+		if !ok || PrivateEncoding(enc) {
+			continue
+		}
+		kf, err := parseKeyDer(block.Bytes, enc)
+		if err != nil {
+			return nil, err
+		}
+		w, err := NewKeyWrapper(kf.Public)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, w)
+	}
+	pgpKeys, err := pgpBundleKeys(bundle, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, kf := range pgpKeys {
+		w, err := NewKeyWrapper(kf.Public)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, w)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("public key error")
+	}
+	return list, nil
+}
+
+// Wrappers to decrypt with: the private keys and PKCS#11 keys in bundle,
+// signing keys are left out
+func IdentityWrappers(bundle []byte) []KeyWrapper {
+	keys, _ := PrivateKeys(bundle)
+	var list []KeyWrapper
+	for _, key := range keys {
+		if w, err := NewKeyWrapper(key); err == nil {
+			list = append(list, w)
+		}
+	}
+	for rest := bundle; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != pkcs11PemType {
+			continue
+		}
+		if k, err := ParsePkcs11Pem(block); err == nil {
+			if w, err := OpenPkcs11Key(k); err == nil {
+				list = append(list, w)
+			}
+		}
+	}
+	return list
+}